@@ -0,0 +1,363 @@
+package mascaras
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+var (
+	errApprovalRejected = errors.New("approval rejected")
+	errApprovalTimeout  = errors.New("approval timeout")
+	// errApprovalSignalIgnored means that the signal is not for the run, and waiting continues.
+	errApprovalSignalIgnored = errors.New("approval signal ignored")
+)
+
+const maxApprovalPollInterval = 10 * time.Second
+
+type approvalSummary struct {
+	RunID                     string            `json:"run_id"`
+	SourceDBClusterIdentifier string            `json:"source_db_cluster_identifier"`
+	TempDBClusterIdentifier   string            `json:"temp_db_cluster_identifier"`
+	SQLFiles                  []SQLFileReport   `json:"sql_files,omitempty"`
+	MaskedTime                time.Time         `json:"masked_time"`
+	Statements                []StatementReport `json:"statements"`
+	TotalRowsAffected         int64             `json:"total_rows_affected"`
+	Tables                    []approvalTable   `json:"tables,omitempty"`
+	Assertions                []approvalResult  `json:"assertions,omitempty"`
+	FailedAssertions          int               `json:"failed_assertions"`
+}
+
+// approvalTable is the number of rows of a table of the masked database.
+type approvalTable struct {
+	Database string `json:"database,omitempty"`
+	Table    string `json:"table"`
+	Rows     int64  `json:"rows"`
+}
+
+// approvalResult is the result of an assertion.
+type approvalResult struct {
+	Name     string `json:"name"`
+	Database string `json:"database,omitempty"`
+	Query    string `json:"query"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+	Passed   bool   `json:"passed"`
+	Error    string `json:"error,omitempty"`
+}
+
+// queryExecuter is implemented by executers which can query values for the approval summary.
+type queryExecuter interface {
+	tableLister
+	queryValue(ctx context.Context, query string) (string, error)
+}
+
+// queryValue returns the first column of the first row as a string. NULL is "NULL".
+func (e *dbExecuter) queryValue(ctx context.Context, query string) (string, error) {
+	var v sql.NullString
+	if err := e.db.QueryRowContext(ctx, query).Scan(&v); err != nil {
+		return "", err
+	}
+	if !v.Valid {
+		return "NULL", nil
+	}
+	return v.String, nil
+}
+
+// inspectMaskedData counts rows of tables of the masked databases and checks the assertions for the summary.
+// Failed assertions are recorded in the summary, and left to the approver.
+func (app *App) inspectMaskedData(ctx context.Context, summary *approvalSummary, dbtype, host string, port int) error {
+	executers := make(map[string]executer)
+	defer func() {
+		for _, e := range executers {
+			e.Close()
+		}
+	}()
+	open := func(database string) (queryExecuter, error) {
+		e, ok := executers[database]
+		if !ok {
+			var err error
+			if e, err = app.newExecuter(app.cfg, dbtype, database, host, port); err != nil {
+				return nil, err
+			}
+			executers[database] = e
+		}
+		qe, ok := e.(queryExecuter)
+		if !ok {
+			return nil, errors.New("approval summary is not supported by the executer")
+		}
+		return qe, nil
+	}
+	for _, database := range app.cfg.maskedDatabases() {
+		qe, err := open(database)
+		if err != nil {
+			return err
+		}
+		tables, err := qe.tables(ctx)
+		if err != nil {
+			return fmt.Errorf("tables of database `%s`: %w", database, err)
+		}
+		for _, table := range tables {
+			v, err := qe.queryValue(ctx, "SELECT COUNT(*) FROM "+quoteIdentifier(dbtype, table))
+			if err != nil {
+				return fmt.Errorf("count rows of table `%s` of database `%s`: %w", table, database, err)
+			}
+			rows, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return fmt.Errorf("count rows of table `%s` of database `%s`: %w", table, database, err)
+			}
+			summary.Tables = append(summary.Tables, approvalTable{Database: database, Table: table, Rows: rows})
+		}
+	}
+	for _, a := range app.cfg.Approval.Assertions {
+		r := approvalResult{
+			Name:     coalesceString(a.Name, a.Query),
+			Database: coalesceString(a.Database, app.cfg.Database),
+			Query:    a.Query,
+			Expected: a.Expected,
+		}
+		qe, err := open(r.Database)
+		if err == nil {
+			r.Actual, err = qe.queryValue(ctx, a.Query)
+		}
+		if err != nil {
+			r.Error = err.Error()
+		} else {
+			r.Passed = r.Actual == r.Expected
+		}
+		if !r.Passed {
+			summary.FailedAssertions++
+			app.logger.Printf("[warn] assertion `%s` failed: expected %q, got %q %s\n", r.Name, r.Expected, r.Actual, r.Error)
+		}
+		summary.Assertions = append(summary.Assertions, r)
+	}
+	return nil
+}
+
+// waitApproval writes the summary and blocks until an approval signal arrives.
+// It returns errApprovalRejected or errApprovalTimeout if the run should not continue.
+func (app *App) waitApproval(ctx context.Context, summary *approvalSummary) error {
+	cfg := app.cfg.Approval
+	timeout, err := cfg.timeout()
+	if err != nil {
+		return err
+	}
+	bs, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	app.logger.Printf("[info] approval summary:\n%s\n", string(bs))
+	if cfg.SummaryLocation != "" {
+		if err := writeLocation(cfg.SummaryLocation, bs); err != nil {
+			return fmt.Errorf("write approval summary: %w", err)
+		}
+		app.logger.Printf("[info] approval summary written to %s\n", cfg.SummaryLocation)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	decision := &approvalDecision{
+		ch: make(chan error, 1),
+	}
+	if cfg.Listen != "" {
+		shutdown, err := app.startApprovalListener(decision, bs)
+		if err != nil {
+			return err
+		}
+		defer shutdown()
+	}
+	if cfg.SignalLocation != "" {
+		app.logger.Printf("[info] waiting for approval signal at %s\n", cfg.SignalLocation)
+		go app.pollApprovalSignal(ctx, cfg.SignalLocation, summary.RunID, decision)
+	}
+	app.logger.Printf("[info] waiting for approval (timeout %s)...\n", timeout)
+	select {
+	case err := <-decision.ch:
+		if err != nil {
+			app.logger.Printf("[warn] %s\n", err)
+			return err
+		}
+		app.logger.Println("[info] approved!")
+		return nil
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			app.logger.Println("[warn] approval timed out, abort.")
+			return errApprovalTimeout
+		}
+		return ctx.Err()
+	}
+}
+
+type approvalDecision struct {
+	once sync.Once
+	ch   chan error
+}
+
+func (d *approvalDecision) decide(err error) {
+	d.once.Do(func() {
+		d.ch <- err
+	})
+}
+
+func (app *App) pollApprovalSignal(ctx context.Context, loc, runID string, decision *approvalDecision) {
+	interval := app.baseInterval
+	if interval > maxApprovalPollInterval {
+		interval = maxApprovalPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var lastWarning string
+	for {
+		found, rejected, err := app.consumeApprovalSignal(loc, runID)
+		if err != nil && err.Error() != lastWarning {
+			app.logger.Printf("[warn] read approval signal: %s\n", err)
+			lastWarning = err.Error()
+		}
+		if found {
+			if rejected {
+				decision.decide(errApprovalRejected)
+			} else {
+				decision.decide(nil)
+			}
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// isNotFoundLocation reports whether err means that no object exists at the location.
+func isNotFoundLocation(err error) bool {
+	if os.IsNotExist(err) {
+		return true
+	}
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && (aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound")
+}
+
+// readApprovalSignal reports whether the signal of the run exists at loc.
+// The signal is "approve <run id>", or "reject <run id>" ("abort <run id>") for a rejection.
+// A signal of another run, e.g. left by the previous run, or with unknown content is ignored with errApprovalSignalIgnored.
+func readApprovalSignal(loc, runID string) (found bool, rejected bool, err error) {
+	r, err := openLocation(loc)
+	if err != nil {
+		if isNotFoundLocation(err) {
+			return false, false, nil
+		}
+		return false, false, err
+	}
+	defer r.Close()
+	bs, err := io.ReadAll(r)
+	if err != nil {
+		return false, false, err
+	}
+	content := strings.TrimSpace(string(bs))
+	fields := strings.Fields(content)
+	if len(fields) != 2 {
+		return false, false, fmt.Errorf("%w: %q, expected \"approve %s\" or \"reject %s\"", errApprovalSignalIgnored, content, runID, runID)
+	}
+	if fields[1] != runID {
+		return false, false, fmt.Errorf("%w: %q is not for run %s", errApprovalSignalIgnored, content, runID)
+	}
+	switch strings.ToLower(fields[0]) {
+	case "approve":
+		return true, false, nil
+	case "reject", "abort":
+		return true, true, nil
+	}
+	return false, false, fmt.Errorf("%w: %q, expected \"approve %s\" or \"reject %s\"", errApprovalSignalIgnored, content, runID, runID)
+}
+
+// consumeApprovalSignal reads the signal of the run, and deletes it once found.
+func (app *App) consumeApprovalSignal(loc, runID string) (found bool, rejected bool, err error) {
+	found, rejected, err = readApprovalSignal(loc, runID)
+	if !found {
+		return found, rejected, err
+	}
+	if err := deleteLocation(loc); err != nil {
+		app.logger.Printf("[warn] delete approval signal %s: %s\n", loc, err)
+	}
+	return found, rejected, nil
+}
+
+func (app *App) startApprovalListener(decision *approvalDecision, summary []byte) (func(), error) {
+	token := app.cfg.Approval.Token
+	if token == "" {
+		var err error
+		token, err = randstr(32)
+		if err != nil {
+			return nil, err
+		}
+		app.logger.Printf("[info] approval token: %s\n", token)
+	}
+	listener, err := net.Listen("tcp", app.cfg.Approval.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("approval listen: %w", err)
+	}
+	server := &http.Server{
+		Handler: approvalHandler(app.logger, token, decision, summary),
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			app.logger.Printf("[error] approval server: %s\n", err)
+		}
+	}()
+	app.logger.Printf("[info] approval listening on http://%s/ (POST /approve or /reject)\n", listener.Addr())
+	return func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			app.logger.Printf("[warn] approval server shutdown: %s\n", err)
+		}
+	}, nil
+}
+
+func approvalHandler(logger *log.Logger, token string, decision *approvalDecision, summary []byte) http.Handler {
+	authorized := func(r *http.Request) bool {
+		return authorizedRequest(r, token)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/summary", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(summary)
+	})
+	decide := func(err error) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+				return
+			}
+			if !authorized(r) {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			logger.Printf("[info] approval callback %s from %s\n", r.URL.Path, r.RemoteAddr)
+			decision.decide(err)
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}
+	mux.HandleFunc("/approve", decide(nil))
+	mux.HandleFunc("/reject", decide(errApprovalRejected))
+	return mux
+}
@@ -0,0 +1,406 @@
+package mascaras
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/mashiike/mysqlbatch"
+)
+
+const (
+	chunkMarker           = "-- mascaras:chunk"
+	chunkStartPlaceholder = ":chunk_start"
+	chunkEndPlaceholder   = ":chunk_end"
+
+	defaultChunkSize         = 10000
+	chunkProgressLogInterval = 10 * time.Second
+)
+
+var chunkIdentifierRegexp = regexp.MustCompile(`^[A-Za-z0-9_$.]+$`)
+
+// chunkSpec is the annotation of a chunked statement.
+//
+//	-- mascaras:chunk table=users key=id size=5000
+//	UPDATE users SET name = md5(name) WHERE id BETWEEN :chunk_start AND :chunk_end;
+type chunkSpec struct {
+	Table string
+	Key   string
+	Size  int64
+}
+
+// sqlPart is a part of SQL text. A part with chunk is a single statement executed chunk by chunk.
+type sqlPart struct {
+	text  string
+	chunk *chunkSpec
+}
+
+func parseChunkSpec(line string) (*chunkSpec, error) {
+	spec := &chunkSpec{Key: "id"}
+	for _, field := range strings.Fields(strings.TrimPrefix(strings.TrimSpace(line), chunkMarker)) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid chunk option `%s`", field)
+		}
+		switch kv[0] {
+		case "table":
+			spec.Table = kv[1]
+		case "key":
+			spec.Key = kv[1]
+		case "size":
+			size, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil || size <= 0 {
+				return nil, fmt.Errorf("invalid chunk size `%s`", kv[1])
+			}
+			spec.Size = size
+		default:
+			return nil, fmt.Errorf("unknown chunk option `%s`", kv[0])
+		}
+	}
+	if !chunkIdentifierRegexp.MatchString(spec.Table) {
+		return nil, fmt.Errorf("invalid chunk table `%s`", spec.Table)
+	}
+	if !chunkIdentifierRegexp.MatchString(spec.Key) {
+		return nil, fmt.Errorf("invalid chunk key `%s`", spec.Key)
+	}
+	return spec, nil
+}
+
+// splitSQLParts splits the SQL into chunked statements annotated by "-- mascaras:chunk" and the others.
+// A chunked statement continues until a line ending with `;`.
+func splitSQLParts(sql string) ([]sqlPart, error) {
+	if !strings.Contains(sql, chunkMarker) {
+		return []sqlPart{{text: sql}}, nil
+	}
+	var parts []sqlPart
+	var current strings.Builder
+	var chunk *chunkSpec
+	flush := func() {
+		if strings.TrimSpace(current.String()) != "" {
+			parts = append(parts, sqlPart{text: current.String(), chunk: chunk})
+		}
+		current.Reset()
+		chunk = nil
+	}
+	for _, line := range strings.SplitAfter(sql, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, chunkMarker) {
+			flush()
+			spec, err := parseChunkSpec(trimmed)
+			if err != nil {
+				return nil, err
+			}
+			chunk = spec
+			continue
+		}
+		current.WriteString(line)
+		if chunk != nil && strings.HasSuffix(trimmed, ";") {
+			flush()
+		}
+	}
+	if chunk != nil {
+		return nil, fmt.Errorf("chunked statement of table `%s` is not terminated by `;`", chunk.Table)
+	}
+	flush()
+	for _, p := range parts {
+		if p.chunk != nil && (!strings.Contains(p.text, chunkStartPlaceholder) || !strings.Contains(p.text, chunkEndPlaceholder)) {
+			return nil, fmt.Errorf("chunked statement of table `%s` must contain %s and %s", p.chunk.Table, chunkStartPlaceholder, chunkEndPlaceholder)
+		}
+	}
+	return parts, nil
+}
+
+// chunkExecuter is implemented by executers which can execute chunked statements.
+type chunkExecuter interface {
+	keyRange(ctx context.Context, table, key string) (min int64, max int64, found bool, err error)
+	execChunk(ctx context.Context, query string) (rowsAffected int64, err error)
+	now(ctx context.Context) (time.Time, error)
+}
+
+// dbExecuter is the executer with the connection, to execute chunked statements and dump tables.
+type dbExecuter struct {
+	*mysqlbatch.Executer
+	db          *sql.DB
+	dbtype      string
+	executeHook func(query string, rowsAffected int64, lastInsertId int64)
+}
+
+// SetExecuteHook sets the hook called after each statement other than SELECT.
+func (e *dbExecuter) SetExecuteHook(hook func(query string, rowsAffected int64, lastInsertId int64)) {
+	e.executeHook = hook
+	if e.dbtype != "postgresql" {
+		e.Executer.SetExecuteHook(hook)
+	}
+}
+
+// ExecuteContext executes the statements. For PostgreSQL with the execute hook, statements other than SELECT
+// are executed here, because the embedded executer calls LastInsertId before the hook, which lib/pq does not
+// support. The loop is a minimal copy of Executer.executeContext of mysqlbatch v0.3.0: SELECT statements and
+// the last execute time are left to the embedded executer. Compare it with mysqlbatch on upgrading.
+func (e *dbExecuter) ExecuteContext(ctx context.Context, r io.Reader) error {
+	if e.dbtype != "postgresql" || e.executeHook == nil {
+		return e.Executer.ExecuteContext(ctx, r)
+	}
+	scanner := mysqlbatch.NewQueryScanner(r)
+	for scanner.Scan() {
+		query := scanner.Query()
+		if query == "" {
+			continue
+		}
+		if isSelectQuery(query) {
+			if err := e.Executer.ExecuteContext(ctx, strings.NewReader(query)); err != nil {
+				return err
+			}
+			continue
+		}
+		result, err := e.db.ExecContext(ctx, query)
+		if err != nil {
+			return fmt.Errorf("execute query failed: %w", err)
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		e.executeHook(query, rowsAffected, 0)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("query scanner err: %w", err)
+	}
+	// an empty batch updates the last execute time.
+	return e.Executer.ExecuteContext(ctx, strings.NewReader(""))
+}
+
+// isSelectQuery reports whether the query returns rows. It is the default heuristic of Executer.executeContext
+// of mysqlbatch v0.3.0, so queries are routed as the embedded executer does.
+func isSelectQuery(query string) bool {
+	q := strings.ToUpper(query)
+	return strings.HasPrefix(q, "SELECT") || strings.HasPrefix(q, "SHOW") || strings.HasPrefix(q, `\`)
+}
+
+func newDBExecuter(db *sql.DB, dbtype string) *dbExecuter {
+	return &dbExecuter{
+		Executer: mysqlbatch.NewWithDB(db),
+		db:       db,
+		dbtype:   dbtype,
+	}
+}
+
+func (e *dbExecuter) keyRange(ctx context.Context, table, key string) (int64, int64, bool, error) {
+	var min, max sql.NullInt64
+	query := fmt.Sprintf("SELECT MIN(%s), MAX(%s) FROM %s", key, key, table)
+	if err := e.db.QueryRowContext(ctx, query).Scan(&min, &max); err != nil {
+		return 0, 0, false, err
+	}
+	return min.Int64, max.Int64, min.Valid && max.Valid, nil
+}
+
+func (e *dbExecuter) now(ctx context.Context) (time.Time, error) {
+	var now time.Time
+	err := e.db.QueryRowContext(ctx, "SELECT NOW()").Scan(&now)
+	return now, err
+}
+
+func (e *dbExecuter) execChunk(ctx context.Context, query string) (int64, error) {
+	result, err := e.db.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// chunkState is the progress of chunked statements, saved to resume them by a retry of the same run.
+// The state is keyed by the run, because a temporary cluster with a fixed identifier is cloned again by the next run.
+type chunkState struct {
+	mu  sync.Mutex
+	loc string
+
+	RunID                   string           `json:"run_id"`
+	TempDBClusterIdentifier string           `json:"temp_db_cluster_identifier"`
+	Completed               map[string]int64 `json:"completed"`
+}
+
+// loadChunkState loads the state at loc. The state of another run or temporary cluster is discarded.
+func loadChunkState(loc, runID, tempDBClusterIdentifier string) (*chunkState, error) {
+	state := &chunkState{
+		loc:                     loc,
+		RunID:                   runID,
+		TempDBClusterIdentifier: tempDBClusterIdentifier,
+		Completed:               make(map[string]int64),
+	}
+	if loc == "" {
+		return state, nil
+	}
+	r, err := openLocation(loc)
+	if err != nil {
+		if isNotFoundLocation(err) {
+			return state, nil
+		}
+		return nil, err
+	}
+	defer r.Close()
+	bs, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var saved chunkState
+	if err := json.Unmarshal(bs, &saved); err != nil {
+		return nil, fmt.Errorf("chunk state %s: %w", loc, err)
+	}
+	if saved.RunID == runID && saved.TempDBClusterIdentifier == tempDBClusterIdentifier && saved.Completed != nil {
+		state.Completed = saved.Completed
+	}
+	return state, nil
+}
+
+// deleteChunkState deletes the state at loc after all chunked statements of the run are completed.
+func (app *App) deleteChunkState() {
+	loc := app.cfg.Chunk.StateLocation
+	if loc == "" {
+		return
+	}
+	if err := deleteLocation(loc); err != nil && !isNotFoundLocation(err) {
+		app.logger.Printf("[warn] delete chunk state %s: %s\n", loc, err)
+	}
+}
+
+func (s *chunkState) completed(id string) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last, ok := s.Completed[id]
+	return last, ok
+}
+
+func (s *chunkState) complete(id string, last int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Completed[id] = last
+	if s.loc == "" {
+		return nil
+	}
+	bs, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return writeLocation(s.loc, bs)
+}
+
+func chunkStatementID(database, statement string) string {
+	sum := sha256.Sum256([]byte(statement))
+	return database + ":" + hex.EncodeToString(sum[:8])
+}
+
+// executeSQLText executes the SQL text on the executer. Chunked statements are executed chunk by chunk.
+func (app *App) executeSQLText(ctx context.Context, e executer, text string, sess *sqlSession) error {
+	parts, err := splitSQLParts(text)
+	if err != nil {
+		return err
+	}
+	for _, p := range parts {
+		if p.chunk == nil {
+			if err := e.ExecuteContext(ctx, strings.NewReader(p.text)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := app.executeChunked(ctx, e, p, sess); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (app *App) executeChunked(ctx context.Context, e executer, p sqlPart, sess *sqlSession) error {
+	ce, ok := e.(chunkExecuter)
+	if !ok {
+		return errors.New("chunked statements are not supported by the executer")
+	}
+	spec := p.chunk
+	size := spec.Size
+	if size == 0 {
+		size = app.cfg.chunkSize()
+	}
+	min, max, found, err := ce.keyRange(ctx, spec.Table, spec.Key)
+	if err != nil {
+		return fmt.Errorf("key range of %s.%s: %w", spec.Table, spec.Key, err)
+	}
+	if !found {
+		app.logger.Printf("[info] chunked statement of table `%s` skipped, no rows\n", spec.Table)
+		return nil
+	}
+	id := chunkStatementID(sess.database, p.text)
+	start := min
+	if last, ok := sess.chunks.completed(id); ok {
+		start = last + 1
+		app.logger.Printf("[info] resume chunked statement of table `%s` from %s=%d\n", spec.Table, spec.Key, start)
+	}
+	app.logger.Printf("[info] start chunked statement of table `%s` %s=%d..%d, size %d\n", spec.Table, spec.Key, start, max, size)
+	startedAt := flextime.Now()
+	lastLogAt := startedAt
+	var rowsAffected int64
+	resumed := start
+	for start <= max {
+		end := start + size - 1
+		if end > max {
+			end = max
+		}
+		query := strings.NewReplacer(
+			chunkStartPlaceholder, strconv.FormatInt(start, 10),
+			chunkEndPlaceholder, strconv.FormatInt(end, 10),
+		).Replace(p.text)
+		chunkStartedAt := flextime.Now()
+		n, err := ce.execChunk(ctx, query)
+		if err != nil {
+			return fmt.Errorf("chunk %s=%d..%d of table `%s`: %w", spec.Key, start, end, spec.Table, err)
+		}
+		rowsAffected += n
+		traceSQLStatement(ctx, sess.dbtype, query, n, chunkStartedAt, flextime.Now())
+		if err := sess.chunks.complete(id, end); err != nil {
+			return fmt.Errorf("save chunk state: %w", err)
+		}
+		now := flextime.Now()
+		if now.Sub(lastLogAt) >= chunkProgressLogInterval || end == max {
+			progress := float64(end-resumed+1) / float64(max-resumed+1)
+			elapsed := now.Sub(startedAt)
+			eta := time.Duration(float64(elapsed)/progress) - elapsed
+			app.logger.Printf("[info] chunked statement of table `%s`: %s=%d/%d (%.1f%%), %d rows affected, ETA %s\n",
+				spec.Table, spec.Key, end, max, progress*100, rowsAffected, eta.Round(time.Second))
+			lastLogAt = now
+		} else {
+			app.logger.Printf("[debug] chunk %s=%d..%d of table `%s`, %d rows affected\n", spec.Key, start, end, spec.Table, n)
+		}
+		start = end + 1
+	}
+	statement := StatementReport{
+		Database:        sess.database,
+		Query:           p.text,
+		RowsAffected:    rowsAffected,
+		DurationSeconds: flextime.Since(startedAt).Seconds(),
+	}
+	sess.result.addStatement(statement)
+	app.metrics.addStatement(statement)
+	// chunks are not executed by the executer, so LastExecuteTime of the executer is not updated.
+	executedAt, err := ce.now(ctx)
+	if err != nil {
+		return err
+	}
+	sess.result.executedAt(executedAt)
+	return nil
+}
+
+func (cfg *Config) chunkSize() int64 {
+	if cfg.Chunk.Size <= 0 {
+		return defaultChunkSize
+	}
+	return cfg.Chunk.Size
+}
@@ -0,0 +1,180 @@
+package mascaras
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	gconf "github.com/kayac/go-config"
+)
+
+// classificationSafe is the classification of columns which are not masked.
+const classificationSafe = "safe"
+
+// classification is the schema classification file, classifications of columns by database, table and column.
+// A column is classified as safe or with a masking rule. An empty classification means unclassified.
+//
+//	db01:
+//	  users:
+//	    id: safe
+//	    email: md5
+type classification map[string]map[string]map[string]string
+
+func readClassification(location string) (classification, error) {
+	r, err := openLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	bs, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var c classification
+	if err := gconf.LoadBytes(&c, bs); err != nil {
+		return nil, fmt.Errorf("classification file %s: %w", location, err)
+	}
+	return c, nil
+}
+
+func (c classification) classified(database, table, column string) bool {
+	return strings.TrimSpace(c[database][table][column]) != ""
+}
+
+type tableColumn struct {
+	Table  string
+	Column string
+}
+
+// columnLister is implemented by executers which can list columns of tables of the database.
+type columnLister interface {
+	columns(ctx context.Context) ([]tableColumn, error)
+}
+
+func (e *dbExecuter) columns(ctx context.Context) ([]tableColumn, error) {
+	schema := "DATABASE()"
+	if e.dbtype == "postgresql" {
+		schema = "current_schema()"
+	}
+	rows, err := e.db.QueryContext(ctx, fmt.Sprintf(`SELECT c.table_name, c.column_name
+FROM information_schema.columns c
+JOIN information_schema.tables t ON t.table_schema = c.table_schema AND t.table_name = c.table_name
+WHERE c.table_schema = %s AND t.table_type = 'BASE TABLE'
+ORDER BY c.table_name, c.ordinal_position`, schema))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []tableColumn
+	for rows.Next() {
+		var c tableColumn
+		if err := rows.Scan(&c.Table, &c.Column); err != nil {
+			return nil, err
+		}
+		columns = append(columns, c)
+	}
+	return columns, rows.Err()
+}
+
+// checkClassification compares columns of the masked databases with the classification, and fails if any column
+// is not classified. Tables matching drop_tables are excluded. The stub of unclassified columns is logged, to be
+// added to the classification file. It returns unclassified columns as database.table.column.
+func (app *App) checkClassification(ctx context.Context, c classification, dbtype, host string, port int) ([]string, error) {
+	var unclassified []string
+	var stub strings.Builder
+	for _, database := range app.cfg.maskedDatabases() {
+		columns, err := app.listColumns(ctx, dbtype, database, host, port)
+		if err != nil {
+			return nil, err
+		}
+		var tables []string
+		exists := make(map[string]map[string]bool)
+		for _, col := range columns {
+			if exists[col.Table] == nil {
+				exists[col.Table] = make(map[string]bool)
+				tables = append(tables, col.Table)
+			}
+			exists[col.Table][col.Column] = true
+		}
+		dropped, _ := matchTables(tables, app.cfg.DropTables)
+		excluded := make(map[string]bool, len(dropped))
+		for _, t := range dropped {
+			excluded[t] = true
+		}
+		var lastTable string
+		for _, col := range columns {
+			if excluded[col.Table] || c.classified(database, col.Table, col.Column) {
+				continue
+			}
+			if lastTable == "" {
+				fmt.Fprintf(&stub, "%s:\n", yamlKey(database))
+			}
+			if col.Table != lastTable {
+				fmt.Fprintf(&stub, "  %s:\n", yamlKey(col.Table))
+				lastTable = col.Table
+			}
+			fmt.Fprintf(&stub, "    %s: \"\"\n", yamlKey(col.Column))
+			unclassified = append(unclassified, database+"."+col.Table+"."+col.Column)
+		}
+		for _, stale := range staleClassifications(c[database], exists) {
+			app.logger.Printf("[warn] `%s.%s` is classified, but not found in the database\n", database, stale)
+		}
+	}
+	if len(unclassified) == 0 {
+		app.logger.Println("[info] all columns are classified")
+		return nil, nil
+	}
+	app.logger.Printf("[error] %d columns are not classified. add them to %s as %s or with a masking rule:\n%s",
+		len(unclassified), app.cfg.ClassificationFile, classificationSafe, stub.String())
+	return unclassified, fmt.Errorf("%d columns are not classified in %s", len(unclassified), app.cfg.ClassificationFile)
+}
+
+func (app *App) listColumns(ctx context.Context, dbtype, database, host string, port int) ([]tableColumn, error) {
+	e, err := app.newExecuter(app.cfg, dbtype, database, host, port)
+	if err != nil {
+		return nil, err
+	}
+	defer e.Close()
+	cl, ok := e.(columnLister)
+	if !ok {
+		return nil, errors.New("classification is not supported by the executer")
+	}
+	columns, err := cl.columns(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("columns of database `%s`: %w", database, err)
+	}
+	return columns, nil
+}
+
+// staleClassifications returns table.column classified but not existing, sorted.
+func staleClassifications(tables map[string]map[string]string, exists map[string]map[string]bool) []string {
+	var stale []string
+	for table, columns := range tables {
+		for column := range columns {
+			if !exists[table][column] {
+				stale = append(stale, table+"."+column)
+			}
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+var yamlPlainKeyRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$-]*$`)
+
+// yamlKey quotes the key of the stub unless it is a plain identifier, which is not a boolean or null in YAML.
+func yamlKey(key string) string {
+	switch strings.ToLower(key) {
+	case "y", "yes", "n", "no", "true", "false", "on", "off", "null":
+		return strconv.Quote(key)
+	}
+	if yamlPlainKeyRegexp.MatchString(key) {
+		return key
+	}
+	return strconv.Quote(key)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/fujiwara/logutils"
+	"github.com/kayac/mascaras"
+)
+
+var (
+	Version  = "0.0.0"
+	Revision = ""
+)
+
+const envPrefix = "MASCARAS_"
+
+// main starts the Lambda handler which executes a step of the run.
+// The event and the response are mascaras.State, so that it can be orchestrated by Step Functions.
+// Options are read from environment variables with the MASCARAS_ prefix, in the same manner as the mascaras command.
+func main() {
+	var debug bool
+	var configFile, logFormat string
+	cfg := &mascaras.Config{}
+	f := flag.NewFlagSet("mascaras-lambda", flag.ExitOnError)
+	cfg.SetFlags(f)
+	f.BoolVar(&debug, "debug", false, "enable debug log")
+	f.StringVar(&configFile, "config", "", "config file path")
+	f.StringVar(&logFormat, "log-format", "text", "log format: text or json")
+	f.VisitAll(func(f *flag.Flag) {
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if v, exists := os.LookupEnv(name); exists {
+			f.Value.Set(v)
+		}
+	})
+
+	filter := &logutils.LevelFilter{
+		Levels:   []logutils.LogLevel{"debug", "info", "warn", "error"},
+		MinLevel: logutils.LogLevel("info"),
+		Writer:   os.Stderr,
+	}
+	if debug {
+		filter.MinLevel = logutils.LogLevel("debug")
+	}
+	switch logFormat {
+	case "text":
+		log.SetOutput(filter)
+	case "json":
+		log.SetFlags(0)
+		log.SetOutput(mascaras.NewJSONLogWriter(os.Stderr, string(filter.MinLevel)))
+	default:
+		log.Fatalf("[error] unknown log format `%s`", logFormat)
+	}
+
+	if configFile != "" {
+		o, err := mascaras.LoadConfig(configFile)
+		if err != nil {
+			log.Fatalf("[error] load config %s", err.Error())
+		}
+		cfg = o.MergeIn(cfg)
+	} else {
+		o := mascaras.DefaultConfig()
+		cfg = o.MergeIn(cfg)
+	}
+
+	if _, err := mascaras.SetupTracing(context.Background(), Version); err != nil {
+		log.Fatalf("[error] setup tracing %v\n", err)
+	}
+	app, err := mascaras.New(cfg)
+	if err != nil {
+		log.Fatalf("[error] %v\n", err)
+	}
+	lambda.Start(func(ctx context.Context, state *mascaras.State) (*mascaras.State, error) {
+		// flush spans in each invocation, the execution environment may be frozen after returning.
+		defer mascaras.FlushTracing(ctx)
+		return app.Step(ctx, state)
+	})
+}
@@ -9,6 +9,7 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/fatih/color"
 	"github.com/fujiwara/logutils"
@@ -36,14 +37,24 @@ var (
 const envPrefix = "MASCARAS_"
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "serve":
+			serve(os.Args[2:])
+			return
+		case "jobs":
+			os.Exit(jobs(os.Args[2:]))
+		}
+	}
 	var debug, showHelp, showVersion bool
-	var configFile string
+	var configFile, logFormat string
 	cfg := &mascaras.Config{}
 	cfg.SetFlags(flag.CommandLine)
 	flag.BoolVar(&debug, "debug", false, "enable debug log")
 	flag.BoolVar(&showVersion, "version", false, "show version")
 	flag.BoolVar(&showHelp, "help", false, "show help")
 	flag.StringVar(&configFile, "config", "", "config file path")
+	flag.StringVar(&logFormat, "log-format", "text", "log format: text or json")
 	flag.VisitAll(func(f *flag.Flag) {
 		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
 		if v, exists := os.LookupEnv(name); exists {
@@ -52,6 +63,8 @@ func main() {
 	})
 	flag.Usage = func() {
 		fmt.Fprintln(flag.CommandLine.Output(), "Usage: mascaras [options] <source db cluster identifier>")
+		fmt.Fprintln(flag.CommandLine.Output(), "       mascaras jobs [options]")
+		fmt.Fprintln(flag.CommandLine.Output(), "       mascaras serve [options]")
 		fmt.Fprintf(flag.CommandLine.Output(), "\t can use %s env prefix\n", envPrefix)
 		flag.PrintDefaults()
 	}
@@ -70,10 +83,7 @@ func main() {
 		sourceDBClusterIdentifier = flag.Arg(0)
 	}
 
-	if debug {
-		filter.MinLevel = logutils.LogLevel("debug")
-	}
-	log.SetOutput(filter)
+	setupLog(debug, logFormat)
 
 	if configFile != "" {
 		o, err := mascaras.LoadConfig(configFile)
@@ -89,11 +99,21 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM|syscall.SIGHUP|syscall.SIGINT)
 	defer stop()
 
+	shutdownTracing, err := mascaras.SetupTracing(ctx, Version)
+	if err != nil {
+		log.Fatalf("[error] setup tracing %v\n", err)
+	}
 	app, err := mascaras.New(cfg)
 	if err != nil {
 		log.Fatalf("[error] %v\n", err)
 	}
-	err = app.Run(ctx, sourceDBClusterIdentifier)
+	_, err = app.Run(ctx, sourceDBClusterIdentifier)
+	// flush spans before exit, log.Fatalf does not run deferred functions.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.Printf("[warn] shutdown tracing %v\n", err)
+	}
+	cancel()
 	switch err {
 	case nil:
 		log.Println("[info] success.")
@@ -103,3 +123,133 @@ func main() {
 		log.Fatalf("[error] %v\n", err)
 	}
 }
+
+func setupLog(debug bool, logFormat string) {
+	if debug {
+		filter.MinLevel = logutils.LogLevel("debug")
+	}
+	switch logFormat {
+	case "text":
+		log.SetOutput(filter)
+	case "json":
+		log.SetFlags(0)
+		log.SetOutput(mascaras.NewJSONLogWriter(os.Stderr, string(filter.MinLevel)))
+	default:
+		log.Fatalf("[error] unknown log format `%s`", logFormat)
+	}
+}
+
+// serve runs jobs on schedule.
+func serve(args []string) {
+	var debug bool
+	var configFile, listen, logFormat string
+	f := flag.NewFlagSet("mascaras serve", flag.ExitOnError)
+	f.BoolVar(&debug, "debug", false, "enable debug log")
+	f.StringVar(&configFile, "config", "", "serve config file path. required")
+	f.StringVar(&listen, "listen", "", "listen address of the job status HTTP API (e.g. 127.0.0.1:8080)")
+	f.StringVar(&logFormat, "log-format", "text", "log format: text or json")
+	f.Usage = func() {
+		fmt.Fprintln(f.Output(), "Usage: mascaras serve [options]")
+		fmt.Fprintf(f.Output(), "\t can use %sSERVE_ env prefix\n", envPrefix)
+		f.PrintDefaults()
+	}
+	f.VisitAll(func(f *flag.Flag) {
+		name := envPrefix + "SERVE_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if v, exists := os.LookupEnv(name); exists {
+			f.Value.Set(v)
+		}
+	})
+	f.Parse(args)
+	setupLog(debug, logFormat)
+	if configFile == "" {
+		f.Usage()
+		os.Exit(2)
+	}
+	cfg, err := mascaras.LoadJobsConfig(configFile)
+	if err != nil {
+		log.Fatalf("[error] load config %s", err.Error())
+	}
+	cfg.Listen = coalesce(listen, cfg.Listen)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGHUP, syscall.SIGINT)
+	defer stop()
+	shutdownTracing, err := mascaras.SetupTracing(ctx, Version)
+	if err != nil {
+		log.Fatalf("[error] setup tracing %v\n", err)
+	}
+	defer shutdownTracing(context.Background())
+	server, err := mascaras.NewServer(cfg)
+	if err != nil {
+		log.Fatalf("[error] %v\n", err)
+	}
+	if err := server.Run(ctx); err != nil {
+		log.Fatalf("[error] %v\n", err)
+	}
+	log.Println("[info] shutdown.")
+}
+
+// jobs runs all jobs once, and returns the exit status.
+func jobs(args []string) int {
+	var debug bool
+	var configFile, reportLocation, logFormat string
+	var concurrency int
+	f := flag.NewFlagSet("mascaras jobs", flag.ExitOnError)
+	f.BoolVar(&debug, "debug", false, "enable debug log")
+	f.StringVar(&configFile, "config", "", "jobs config file path. required")
+	f.IntVar(&concurrency, "concurrency", 0, "max number of jobs running at a time. default is 1")
+	f.StringVar(&reportLocation, "report-location", "", "aggregated report json output location. \"-\" (stdout), file path or s3://")
+	f.StringVar(&logFormat, "log-format", "text", "log format: text or json")
+	f.Usage = func() {
+		fmt.Fprintln(f.Output(), "Usage: mascaras jobs [options]")
+		fmt.Fprintf(f.Output(), "\t can use %sJOBS_ env prefix\n", envPrefix)
+		f.PrintDefaults()
+	}
+	f.VisitAll(func(f *flag.Flag) {
+		name := envPrefix + "JOBS_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if v, exists := os.LookupEnv(name); exists {
+			f.Value.Set(v)
+		}
+	})
+	f.Parse(args)
+	setupLog(debug, logFormat)
+	if configFile == "" {
+		f.Usage()
+		return 2
+	}
+	cfg, err := mascaras.LoadJobsConfig(configFile)
+	if err != nil {
+		log.Printf("[error] load config %s", err.Error())
+		return 1
+	}
+	if concurrency > 0 {
+		cfg.Concurrency = concurrency
+	}
+	cfg.ReportLocation = coalesce(reportLocation, cfg.ReportLocation)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGHUP, syscall.SIGINT)
+	defer stop()
+	shutdownTracing, err := mascaras.SetupTracing(ctx, Version)
+	if err != nil {
+		log.Printf("[error] setup tracing %v\n", err)
+		return 1
+	}
+	defer shutdownTracing(context.Background())
+	server, err := mascaras.NewServer(cfg)
+	if err != nil {
+		log.Printf("[error] %v\n", err)
+		return 1
+	}
+	report := server.RunAll(ctx)
+	if report.Failed > 0 {
+		return 1
+	}
+	log.Println("[info] success.")
+	return 0
+}
+
+func coalesce(str1, str2 string) string {
+	if str1 == "" {
+		return str2
+	}
+	return str1
+}
@@ -1,16 +1,22 @@
 package mascaras
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/Songmu/flextime"
 	"github.com/aws/aws-sdk-go/aws"
@@ -21,25 +27,187 @@ import (
 )
 
 type Config struct {
-	TempCluster               TempDBClusterConfig `json:"temp_cluster,omitempty" yaml:"temp_cluster,omitempty"`
-	DBUserName                string              `json:"db_user_name,omitempty" yaml:"db_user_name,omitempty"`
-	DBUserPassword            string              `json:"db_user_password,omitempty" yaml:"db_user_password,omitempty"`
-	Database                  string              `json:"database,omitempty" yaml:"database,omitempty"`
-	SSLMode                   string              `json:"ssl_mode,omitempty" yaml:"ssl_mode,omitempty"`
-	SQLFile                   string              `json:"sql_file,omitempty" yaml:"sql_file,omitempty"`
-	SourceDBClusterIdentifier string              `json:"source_db_cluster_identifier,omitempty" yaml:"source_db_cluster_identifier,omitempty"`
-	Interactive               bool                `json:"interactive,omitempty" yaml:"interactive,omitempty"`
+	TempCluster               TempDBClusterConfig  `json:"temp_cluster,omitempty" yaml:"temp_cluster,omitempty"`
+	DBUserName                string               `json:"db_user_name,omitempty" yaml:"db_user_name,omitempty"`
+	DBUserPassword            string               `json:"db_user_password,omitempty" yaml:"db_user_password,omitempty"`
+	Database                  string               `json:"database,omitempty" yaml:"database,omitempty"`
+	SSLMode                   string               `json:"ssl_mode,omitempty" yaml:"ssl_mode,omitempty"`
+	SQLFile                   string               `json:"sql_file,omitempty" yaml:"sql_file,omitempty"`
+	Databases                 map[string]SQLFiles  `json:"databases,omitempty" yaml:"databases,omitempty"`
+	SQLConcurrency            int                  `json:"sql_concurrency,omitempty" yaml:"sql_concurrency,omitempty"`
+	Chunk                     ChunkConfig          `json:"chunk,omitempty" yaml:"chunk,omitempty"`
+	SourceDBClusterIdentifier string               `json:"source_db_cluster_identifier,omitempty" yaml:"source_db_cluster_identifier,omitempty"`
+	Interactive               bool                 `json:"interactive,omitempty" yaml:"interactive,omitempty"`
+	Prompt                    PromptConfig         `json:"prompt,omitempty" yaml:"prompt,omitempty"`
+	RemoteConsole             RemoteConsoleConfig  `json:"remote_console,omitempty" yaml:"remote_console,omitempty"`
+	ReportLocation            string               `json:"report_location,omitempty" yaml:"report_location,omitempty"`
+	Notifications             []NotificationConfig `json:"notifications,omitempty" yaml:"notifications,omitempty"`
+	Publish                   []PublishConfig      `json:"publish,omitempty" yaml:"publish,omitempty"`
+	Metrics                   MetricsConfig        `json:"metrics,omitempty" yaml:"metrics,omitempty"`
+	Snapshot                  SnapshotConfig       `json:"snapshot,omitempty" yaml:"snapshot,omitempty"`
+	Target                    TargetClusterConfig  `json:"target,omitempty" yaml:"target,omitempty"`
+	Dump                      DumpConfig           `json:"dump,omitempty" yaml:"dump,omitempty"`
+	Subset                    SubsetConfig         `json:"subset,omitempty" yaml:"subset,omitempty"`
+	TruncateTables            []string             `json:"truncate_tables,omitempty" yaml:"truncate_tables,omitempty"`
+	DropTables                []string             `json:"drop_tables,omitempty" yaml:"drop_tables,omitempty"`
+	ClassificationFile        string               `json:"classification_file,omitempty" yaml:"classification_file,omitempty"`
+
+	EnableApproval bool           `json:"enable_approval,omitempty" yaml:"enable_approval,omitempty"`
+	Approval       ApprovalConfig `json:"approval,omitempty" yaml:"approval,omitempty"`
 
 	EnableExportTask bool             `json:"enable_export_task,omitempty" yaml:"enable_export_task,omitempty"`
 	ExportTask       ExportTaskConfig `json:"export_task,omitempty" yaml:"export_task,omitempty"`
 }
 
+// SQLFiles is a list of SQL file locations. It can be written as a single string in the config file.
+type SQLFiles []string
+
+func (l *SQLFiles) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*l = SQLFiles{s}
+		return nil
+	}
+	var ss []string
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return err
+	}
+	*l = ss
+	return nil
+}
+
+func (l *SQLFiles) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*l = SQLFiles{s}
+		return nil
+	}
+	var ss []string
+	if err := unmarshal(&ss); err != nil {
+		return err
+	}
+	*l = ss
+	return nil
+}
+
 type TempDBClusterConfig struct {
-	DBClusterIdentifierPrefix string `json:"db_cluster_identifier_prefix,omitempty" yaml:"db_cluster_identifier_prefix,omitempty"`
-	DBClusterIdentifier       string `json:"db_cluster_identifier,omitempty" yaml:"db_cluster_identifier,omitempty"`
-	DBInstanceClass           string `json:"db_instance_class,omitempty" yaml:"db_instance_class,omitempty"`
-	SecurityGroupIDs          string `json:"security_group_ids,omitempty" yaml:"security_group_ids,omitempty"`
-	PubliclyAccessible        bool   `json:"publicly_accessible,omitempty" yaml:"publicly_accessible,omitempty"`
+	DBClusterIdentifierPrefix string  `json:"db_cluster_identifier_prefix,omitempty" yaml:"db_cluster_identifier_prefix,omitempty"`
+	DBClusterIdentifier       string  `json:"db_cluster_identifier,omitempty" yaml:"db_cluster_identifier,omitempty"`
+	DBInstanceClass           string  `json:"db_instance_class,omitempty" yaml:"db_instance_class,omitempty"`
+	SQLDBInstanceClass        string  `json:"sql_db_instance_class,omitempty" yaml:"sql_db_instance_class,omitempty"`
+	MinCapacity               float64 `json:"min_capacity,omitempty" yaml:"min_capacity,omitempty"`
+	MaxCapacity               float64 `json:"max_capacity,omitempty" yaml:"max_capacity,omitempty"`
+	SQLMinCapacity            float64 `json:"sql_min_capacity,omitempty" yaml:"sql_min_capacity,omitempty"`
+	SQLMaxCapacity            float64 `json:"sql_max_capacity,omitempty" yaml:"sql_max_capacity,omitempty"`
+	SecurityGroupIDs          string  `json:"security_group_ids,omitempty" yaml:"security_group_ids,omitempty"`
+	PubliclyAccessible        bool    `json:"publicly_accessible,omitempty" yaml:"publicly_accessible,omitempty"`
+
+	DBSubnetGroupName               string `json:"db_subnet_group_name,omitempty" yaml:"db_subnet_group_name,omitempty"`
+	DBClusterParameterGroupName     string `json:"db_cluster_parameter_group_name,omitempty" yaml:"db_cluster_parameter_group_name,omitempty"`
+	DBParameterGroupName            string `json:"db_parameter_group_name,omitempty" yaml:"db_parameter_group_name,omitempty"`
+	AvailabilityZone                string `json:"availability_zone,omitempty" yaml:"availability_zone,omitempty"`
+	KmsKeyID                        string `json:"kms_key_id,omitempty" yaml:"kms_key_id,omitempty"`
+	Port                            int    `json:"port,omitempty" yaml:"port,omitempty"`
+	EnableIAMDatabaseAuthentication bool   `json:"enable_iam_database_authentication,omitempty" yaml:"enable_iam_database_authentication,omitempty"`
+}
+
+type PromptConfig struct {
+	HistoryFile           string   `json:"history_file,omitempty" yaml:"history_file,omitempty"`
+	DisableHistory        bool     `json:"disable_history,omitempty" yaml:"disable_history,omitempty"`
+	HistoryRedactPatterns []string `json:"history_redact_patterns,omitempty" yaml:"history_redact_patterns,omitempty"`
+}
+
+type RemoteConsoleConfig struct {
+	Listen  string `json:"listen,omitempty" yaml:"listen,omitempty"`
+	Token   string `json:"token,omitempty" yaml:"token,omitempty"`
+	Timeout string `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+type ApprovalConfig struct {
+	SummaryLocation string `json:"summary_location,omitempty" yaml:"summary_location,omitempty"`
+	SignalLocation  string `json:"signal_location,omitempty" yaml:"signal_location,omitempty"`
+	Listen          string `json:"listen,omitempty" yaml:"listen,omitempty"`
+	Token           string `json:"token,omitempty" yaml:"token,omitempty"`
+	Timeout         string `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+
+	Assertions []ApprovalAssertionConfig `json:"assertions,omitempty" yaml:"assertions,omitempty"`
+}
+
+// ApprovalAssertionConfig is a query checked on the masked database before approval.
+// The query returns a value, which is compared with Expected as a string.
+type ApprovalAssertionConfig struct {
+	Name     string `json:"name,omitempty" yaml:"name,omitempty"`
+	Database string `json:"database,omitempty" yaml:"database,omitempty"`
+	Query    string `json:"query,omitempty" yaml:"query,omitempty"`
+	Expected string `json:"expected,omitempty" yaml:"expected,omitempty"`
+}
+
+type NotificationConfig struct {
+	Type         string   `json:"type,omitempty" yaml:"type,omitempty"`
+	URL          string   `json:"url,omitempty" yaml:"url,omitempty"`
+	TopicArn     string   `json:"topic_arn,omitempty" yaml:"topic_arn,omitempty"`
+	EventBusName string   `json:"event_bus_name,omitempty" yaml:"event_bus_name,omitempty"`
+	Source       string   `json:"source,omitempty" yaml:"source,omitempty"`
+	DetailType   string   `json:"detail_type,omitempty" yaml:"detail_type,omitempty"`
+	Events       []string `json:"events,omitempty" yaml:"events,omitempty"`
+}
+
+// PublishConfig is a sink of the latest masked snapshot. Name and Location are name templates.
+type PublishConfig struct {
+	Type     string `json:"type,omitempty" yaml:"type,omitempty"`
+	Name     string `json:"name,omitempty" yaml:"name,omitempty"`
+	Location string `json:"location,omitempty" yaml:"location,omitempty"`
+}
+
+type ChunkConfig struct {
+	Size          int64  `json:"size,omitempty" yaml:"size,omitempty"`
+	StateLocation string `json:"state_location,omitempty" yaml:"state_location,omitempty"`
+}
+
+type MetricsConfig struct {
+	Listen         string `json:"listen,omitempty" yaml:"listen,omitempty"`
+	PushgatewayURL string `json:"pushgateway_url,omitempty" yaml:"pushgateway_url,omitempty"`
+	Job            string `json:"job,omitempty" yaml:"job,omitempty"`
+}
+
+// SnapshotConfig is the config of the masked snapshot.
+// Identifier is a name template. If KmsKeyID is set, the snapshot is copied with the key, and the copy is the result of the run.
+type SnapshotConfig struct {
+	Identifier     string `json:"identifier,omitempty" yaml:"identifier,omitempty"`
+	KmsKeyID       string `json:"kms_key_id,omitempty" yaml:"kms_key_id,omitempty"`
+	DeleteOriginal bool   `json:"delete_original,omitempty" yaml:"delete_original,omitempty"`
+}
+
+// TargetClusterConfig is the long-lived cluster refreshed by the masked snapshot.
+type TargetClusterConfig struct {
+	DBClusterIdentifier         string `json:"db_cluster_identifier,omitempty" yaml:"db_cluster_identifier,omitempty"`
+	DBInstanceClass             string `json:"db_instance_class,omitempty" yaml:"db_instance_class,omitempty"`
+	SecurityGroupIDs            string `json:"security_group_ids,omitempty" yaml:"security_group_ids,omitempty"`
+	DBSubnetGroupName           string `json:"db_subnet_group_name,omitempty" yaml:"db_subnet_group_name,omitempty"`
+	DBClusterParameterGroupName string `json:"db_cluster_parameter_group_name,omitempty" yaml:"db_cluster_parameter_group_name,omitempty"`
+	DBParameterGroupName        string `json:"db_parameter_group_name,omitempty" yaml:"db_parameter_group_name,omitempty"`
+	DeletionProtection          bool   `json:"deletion_protection,omitempty" yaml:"deletion_protection,omitempty"`
+}
+
+// DumpConfig is the config of the logical dump of the masked databases.
+// Location is a name template of the local directory or s3:// prefix. If SkipSnapshot is set, the snapshot is not created.
+type DumpConfig struct {
+	Location     string `json:"location,omitempty" yaml:"location,omitempty"`
+	SkipSnapshot bool   `json:"skip_snapshot,omitempty" yaml:"skip_snapshot,omitempty"`
+}
+
+// SubsetConfig is the config of the subset of the database. Rows of the root tables out of the filters are deleted,
+// and rows referencing deleted rows by foreign keys are deleted too. Database defaults to database.
+type SubsetConfig struct {
+	Database string             `json:"database,omitempty" yaml:"database,omitempty"`
+	Roots    []SubsetRootConfig `json:"roots,omitempty" yaml:"roots,omitempty"`
+}
+
+// SubsetRootConfig is a root table of the subset. Rows matching Where are kept, and sampled by Percent if set.
+type SubsetRootConfig struct {
+	Table   string  `json:"table,omitempty" yaml:"table,omitempty"`
+	Where   string  `json:"where,omitempty" yaml:"where,omitempty"`
+	Percent float64 `json:"percent,omitempty" yaml:"percent,omitempty"`
 }
 
 type ExportTaskConfig struct {
@@ -51,6 +219,15 @@ type ExportTaskConfig struct {
 	ExportOnly     string `json:"export_only,omitempty" yaml:"export_only,omitempty"`
 }
 
+const (
+	serverlessDBInstanceClass = "db.serverless"
+	minServerlessCapacity     = 0.5
+	maxServerlessCapacity     = 128.0
+
+	// Aurora accepts ports 1150-65535.
+	minAuroraPort = 1150
+)
+
 func DefaultConfig() *Config {
 	return &Config{
 		TempCluster: TempDBClusterConfig{
@@ -89,21 +266,96 @@ func (cfg *Config) SetFlags(f *flag.FlagSet) {
 	f.BoolVar(&cfg.EnableExportTask, "enable-export-task", cfg.EnableExportTask, "created snapshot export to s3")
 	f.StringVar(&cfg.SSLMode, "ssl-mode", cfg.SSLMode, "ssl mode setting apply only PostgreSQL type Aurora DB")
 	f.StringVar(&cfg.SQLFile, "sql-file", cfg.SQLFile, "")
+	f.IntVar(&cfg.SQLConcurrency, "sql-concurrency", cfg.SQLConcurrency, "max number of connections executing parallel sections of SQL files at a time. default is 4")
 	f.StringVar(&cfg.SourceDBClusterIdentifier, "src-db-cluster", cfg.SourceDBClusterIdentifier, "")
 	f.BoolVar(&cfg.Interactive, "interactive", cfg.Interactive, "after mask sql,　Launch an interactive prompt after executing SQL")
+	cfg.Chunk.SetFlags(f)
+	cfg.Prompt.SetFlags(f)
+	cfg.RemoteConsole.SetFlags(f)
+	f.StringVar(&cfg.ReportLocation, "report-location", cfg.ReportLocation, "run report json output location. \"-\" (stdout), file path or s3://")
+	f.BoolVar(&cfg.EnableApproval, "enable-approval", cfg.EnableApproval, "wait for approval after masking, before creating snapshot")
+	cfg.Approval.SetFlags(f)
+	cfg.Metrics.SetFlags(f)
+	cfg.Snapshot.SetFlags(f)
+	cfg.Target.SetFlags(f)
+	cfg.Dump.SetFlags(f)
+	f.StringVar(&cfg.ClassificationFile, "classification-file", cfg.ClassificationFile, "schema classification file path or s3://. fail before executing SQL if any column is not classified as safe or with a masking rule")
 	cfg.ExportTask.SetFlags(f)
 }
 
+func (cfg *PromptConfig) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.HistoryFile, "prompt-history-file", cfg.HistoryFile, "interactive prompt history file path. default is mascaras/history in the user cache directory")
+	f.BoolVar(&cfg.DisableHistory, "disable-prompt-history", cfg.DisableHistory, "do not persist interactive prompt history")
+}
+
 func (cfg *TempDBClusterConfig) SetFlags(f *flag.FlagSet) {
 	f.StringVar(&cfg.DBClusterIdentifierPrefix, "db-cluster-identifier-prefix", cfg.DBClusterIdentifierPrefix, "Cloned Aurora DB Cluster Identifier Prefix")
 	f.StringVar(&cfg.DBClusterIdentifier, "db-cluster-identifier", cfg.DBClusterIdentifier, "Cloned Aurora DB Cluster Identifier")
 	f.StringVar(&cfg.DBInstanceClass, "db-instance-class", cfg.DBInstanceClass, "Cloned Aurora DB Instance Class")
+	f.StringVar(&cfg.SQLDBInstanceClass, "sql-db-instance-class", cfg.SQLDBInstanceClass, "Cloned Aurora DB Instance Class while executing SQL. scaled to db-instance-class after executing SQL or the subset")
+	f.Float64Var(&cfg.MinCapacity, "min-capacity", cfg.MinCapacity, "Cloned Aurora Serverless v2 min capacity (ACU). required for db.serverless")
+	f.Float64Var(&cfg.MaxCapacity, "max-capacity", cfg.MaxCapacity, "Cloned Aurora Serverless v2 max capacity (ACU). required for db.serverless")
+	f.Float64Var(&cfg.SQLMinCapacity, "sql-min-capacity", cfg.SQLMinCapacity, "Cloned Aurora Serverless v2 min capacity (ACU) while executing SQL. scaled to min-capacity after executing SQL or the subset")
+	f.Float64Var(&cfg.SQLMaxCapacity, "sql-max-capacity", cfg.SQLMaxCapacity, "Cloned Aurora Serverless v2 max capacity (ACU) while executing SQL. scaled to max-capacity after executing SQL or the subset")
 	f.BoolVar(&cfg.PubliclyAccessible, "publicly-accessible", cfg.PubliclyAccessible, "Cloned Aurora DB PubliclyAccessible.")
 	f.StringVar(&cfg.SecurityGroupIDs, "security-group-ids", cfg.SecurityGroupIDs, "Cloned Aurora DB Cluster Secturity Group IDs")
+	f.StringVar(&cfg.DBSubnetGroupName, "db-subnet-group-name", cfg.DBSubnetGroupName, "Cloned Aurora DB Cluster Subnet Group Name")
+	f.StringVar(&cfg.DBClusterParameterGroupName, "db-cluster-parameter-group-name", cfg.DBClusterParameterGroupName, "Cloned Aurora DB Cluster Parameter Group Name")
+	f.StringVar(&cfg.DBParameterGroupName, "db-parameter-group-name", cfg.DBParameterGroupName, "Cloned Aurora DB Instance Parameter Group Name")
+	f.StringVar(&cfg.AvailabilityZone, "availability-zone", cfg.AvailabilityZone, "Cloned Aurora DB Instance Availability Zone")
+	f.StringVar(&cfg.KmsKeyID, "kms-key-id", cfg.KmsKeyID, "Cloned Aurora DB Cluster KMS Key ID")
+	f.IntVar(&cfg.Port, "port", cfg.Port, "Cloned Aurora DB Cluster Port. default is the port of the source cluster")
+	f.BoolVar(&cfg.EnableIAMDatabaseAuthentication, "enable-iam-database-authentication", cfg.EnableIAMDatabaseAuthentication, "Cloned Aurora DB Cluster EnableIAMDatabaseAuthentication.")
+}
+
+func (cfg *RemoteConsoleConfig) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Listen, "remote-console-listen", cfg.Listen, "listen address of the remote console (e.g. 127.0.0.1:8080). if set, interactive prompt is served over WebSocket instead of stdin")
+	f.StringVar(&cfg.Token, "remote-console-token", cfg.Token, "remote console access token. required if remote-console-listen is set")
+	f.StringVar(&cfg.Timeout, "remote-console-timeout", cfg.Timeout, "remote console timeout. abort when it expires")
+}
+
+func (cfg *ApprovalConfig) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.SummaryLocation, "approval-summary-location", cfg.SummaryLocation, "approval summary json output location. file path or s3://")
+	f.StringVar(&cfg.SignalLocation, "approval-signal-location", cfg.SignalLocation, "approve when \"approve <run id>\" appears at this location. file path or s3://. \"reject <run id>\" or \"abort <run id>\" means rejection")
+	f.StringVar(&cfg.Listen, "approval-listen", cfg.Listen, "listen address of the approval callback (e.g. 127.0.0.1:8081). accepts POST /approve and POST /reject")
+	f.StringVar(&cfg.Token, "approval-token", cfg.Token, "approval callback access token. if empty, generated and logged at startup")
+	f.StringVar(&cfg.Timeout, "approval-timeout", cfg.Timeout, "approval timeout. abort when it expires")
+}
+
+func (cfg *ChunkConfig) SetFlags(f *flag.FlagSet) {
+	f.Int64Var(&cfg.Size, "chunk-size", cfg.Size, "default number of keys in a chunk of chunked statements (-- mascaras:chunk). default is 10000")
+	f.StringVar(&cfg.StateLocation, "chunk-state-location", cfg.StateLocation, "progress of chunked statements is saved to this location, to resume on the same temporary cluster. file path or s3://")
+}
+
+func (cfg *MetricsConfig) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Listen, "metrics-listen", cfg.Listen, "listen address of the prometheus metrics endpoint /metrics while running (e.g. 127.0.0.1:9100)")
+	f.StringVar(&cfg.PushgatewayURL, "metrics-pushgateway-url", cfg.PushgatewayURL, "push metrics to the Pushgateway at the end of run (e.g. http://pushgateway:9091)")
+	f.StringVar(&cfg.Job, "metrics-job", cfg.Job, "job name of pushed metrics. default is mascaras")
+}
+
+func (cfg *SnapshotConfig) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Identifier, "snapshot-identifier", cfg.Identifier, "masked snapshot identifier template. default is <temp db cluster identifier>-snapshot")
+	f.StringVar(&cfg.KmsKeyID, "snapshot-kms-key-id", cfg.KmsKeyID, "copy the masked snapshot with this KMS Key ID, and the copy is the result")
+	f.BoolVar(&cfg.DeleteOriginal, "snapshot-delete-original", cfg.DeleteOriginal, "delete the original snapshot after copying with snapshot-kms-key-id")
+}
+
+func (cfg *DumpConfig) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Location, "dump-location", cfg.Location, "dump masked databases to this directory or s3:// prefix, a gzipped SQL file per table")
+	f.BoolVar(&cfg.SkipSnapshot, "dump-skip-snapshot", cfg.SkipSnapshot, "dump only, without creating the snapshot. requires dump-location")
+}
+
+func (cfg *TargetClusterConfig) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.DBClusterIdentifier, "target-db-cluster-identifier", cfg.DBClusterIdentifier, "long-lived Aurora DB Cluster Identifier refreshed by the masked snapshot")
+	f.StringVar(&cfg.DBInstanceClass, "target-db-instance-class", cfg.DBInstanceClass, "target Aurora DB Instance Class. required when target-db-cluster-identifier is set")
+	f.StringVar(&cfg.SecurityGroupIDs, "target-security-group-ids", cfg.SecurityGroupIDs, "target Aurora DB Cluster Security Group IDs")
+	f.StringVar(&cfg.DBSubnetGroupName, "target-db-subnet-group-name", cfg.DBSubnetGroupName, "target Aurora DB Cluster Subnet Group Name")
+	f.StringVar(&cfg.DBClusterParameterGroupName, "target-db-cluster-parameter-group-name", cfg.DBClusterParameterGroupName, "target Aurora DB Cluster Parameter Group Name")
+	f.StringVar(&cfg.DBParameterGroupName, "target-db-parameter-group-name", cfg.DBParameterGroupName, "target Aurora DB Instance Parameter Group Name")
+	f.BoolVar(&cfg.DeletionProtection, "target-deletion-protection", cfg.DeletionProtection, "enable DeletionProtection of the target Aurora DB Cluster")
 }
 
 func (cfg *ExportTaskConfig) SetFlags(f *flag.FlagSet) {
-	f.StringVar(&cfg.TaskIdentifier, "export-task-identifier", cfg.TaskIdentifier, "export-task identifer.")
+	f.StringVar(&cfg.TaskIdentifier, "export-task-identifier", cfg.TaskIdentifier, "export-task identifer template. default is <snapshot identifier>-export-task")
 	f.StringVar(&cfg.IAMRoleArn, "export-task-iam-role-arn", cfg.IAMRoleArn, "export-task execute IAM Role arn. required when enable export-task")
 	f.StringVar(&cfg.KMSKeyId, "export-task-kms-key-id", cfg.KMSKeyId, "export-task KMS Key ID. required when enable export-task")
 	f.StringVar(&cfg.S3Bucket, "export-task-s3-bucket", cfg.S3Bucket, "export-task destination s3 bucket name. required when enable export-task")
@@ -125,19 +377,147 @@ func (cfg *Config) MergeIn(o *Config) *Config {
 	cfg.Database = coalesceString(o.Database, cfg.Database)
 	cfg.EnableExportTask = o.EnableExportTask || cfg.EnableExportTask
 	cfg.SSLMode = coalesceString(o.SSLMode, cfg.SSLMode)
-	cfg.SQLFile = coalesceString(o.SQLFile, cfg.SQLFile)
+	// sql_file and databases override each other.
+	if o.SQLFile != "" || len(o.Databases) > 0 {
+		cfg.SQLFile = o.SQLFile
+		cfg.Databases = o.Databases
+	}
+	if o.SQLConcurrency != 0 {
+		cfg.SQLConcurrency = o.SQLConcurrency
+	}
 	cfg.SourceDBClusterIdentifier = coalesceString(o.SourceDBClusterIdentifier, cfg.SourceDBClusterIdentifier)
 	cfg.Interactive = o.Interactive || cfg.Interactive
+	cfg.Chunk.MergIn(&o.Chunk)
+	cfg.Prompt.MergIn(&o.Prompt)
+	cfg.RemoteConsole.MergIn(&o.RemoteConsole)
+	cfg.ReportLocation = coalesceString(o.ReportLocation, cfg.ReportLocation)
+	cfg.EnableApproval = o.EnableApproval || cfg.EnableApproval
+	cfg.Approval.MergIn(&o.Approval)
+	if len(o.Notifications) > 0 {
+		cfg.Notifications = o.Notifications
+	}
+	if len(o.Publish) > 0 {
+		cfg.Publish = o.Publish
+	}
+	cfg.Metrics.MergIn(&o.Metrics)
+	cfg.Snapshot.MergIn(&o.Snapshot)
+	cfg.Target.MergIn(&o.Target)
+	cfg.Dump.MergIn(&o.Dump)
+	cfg.Subset.MergIn(&o.Subset)
+	if len(o.TruncateTables) > 0 {
+		cfg.TruncateTables = o.TruncateTables
+	}
+	if len(o.DropTables) > 0 {
+		cfg.DropTables = o.DropTables
+	}
+	cfg.ClassificationFile = coalesceString(o.ClassificationFile, cfg.ClassificationFile)
 	cfg.ExportTask.MergIn(&o.ExportTask)
 	return cfg
 }
 
+func (cfg *PromptConfig) MergIn(o *PromptConfig) *PromptConfig {
+	cfg.HistoryFile = coalesceString(o.HistoryFile, cfg.HistoryFile)
+	cfg.DisableHistory = o.DisableHistory || cfg.DisableHistory
+	if len(o.HistoryRedactPatterns) > 0 {
+		cfg.HistoryRedactPatterns = o.HistoryRedactPatterns
+	}
+	return cfg
+}
+
 func (cfg *TempDBClusterConfig) MergIn(o *TempDBClusterConfig) *TempDBClusterConfig {
 	cfg.DBClusterIdentifier = coalesceString(o.DBClusterIdentifier, cfg.DBClusterIdentifier)
 	cfg.DBClusterIdentifierPrefix = coalesceString(o.DBClusterIdentifierPrefix, cfg.DBClusterIdentifierPrefix)
 	cfg.DBInstanceClass = coalesceString(o.DBInstanceClass, cfg.DBInstanceClass)
+	cfg.SQLDBInstanceClass = coalesceString(o.SQLDBInstanceClass, cfg.SQLDBInstanceClass)
+	if o.MinCapacity != 0 {
+		cfg.MinCapacity = o.MinCapacity
+	}
+	if o.MaxCapacity != 0 {
+		cfg.MaxCapacity = o.MaxCapacity
+	}
+	if o.SQLMinCapacity != 0 {
+		cfg.SQLMinCapacity = o.SQLMinCapacity
+	}
+	if o.SQLMaxCapacity != 0 {
+		cfg.SQLMaxCapacity = o.SQLMaxCapacity
+	}
 	cfg.SecurityGroupIDs = coalesceString(o.SecurityGroupIDs, cfg.SecurityGroupIDs)
 	cfg.PubliclyAccessible = o.PubliclyAccessible || cfg.PubliclyAccessible
+	cfg.DBSubnetGroupName = coalesceString(o.DBSubnetGroupName, cfg.DBSubnetGroupName)
+	cfg.DBClusterParameterGroupName = coalesceString(o.DBClusterParameterGroupName, cfg.DBClusterParameterGroupName)
+	cfg.DBParameterGroupName = coalesceString(o.DBParameterGroupName, cfg.DBParameterGroupName)
+	cfg.AvailabilityZone = coalesceString(o.AvailabilityZone, cfg.AvailabilityZone)
+	cfg.KmsKeyID = coalesceString(o.KmsKeyID, cfg.KmsKeyID)
+	if o.Port != 0 {
+		cfg.Port = o.Port
+	}
+	cfg.EnableIAMDatabaseAuthentication = o.EnableIAMDatabaseAuthentication || cfg.EnableIAMDatabaseAuthentication
+	return cfg
+}
+
+func (cfg *RemoteConsoleConfig) MergIn(o *RemoteConsoleConfig) *RemoteConsoleConfig {
+	cfg.Listen = coalesceString(o.Listen, cfg.Listen)
+	cfg.Token = coalesceString(o.Token, cfg.Token)
+	cfg.Timeout = coalesceString(o.Timeout, cfg.Timeout)
+	return cfg
+}
+
+func (cfg *ApprovalConfig) MergIn(o *ApprovalConfig) *ApprovalConfig {
+	cfg.SummaryLocation = coalesceString(o.SummaryLocation, cfg.SummaryLocation)
+	cfg.SignalLocation = coalesceString(o.SignalLocation, cfg.SignalLocation)
+	cfg.Listen = coalesceString(o.Listen, cfg.Listen)
+	cfg.Token = coalesceString(o.Token, cfg.Token)
+	cfg.Timeout = coalesceString(o.Timeout, cfg.Timeout)
+	if len(o.Assertions) > 0 {
+		cfg.Assertions = o.Assertions
+	}
+	return cfg
+}
+
+func (cfg *ChunkConfig) MergIn(o *ChunkConfig) *ChunkConfig {
+	if o.Size != 0 {
+		cfg.Size = o.Size
+	}
+	cfg.StateLocation = coalesceString(o.StateLocation, cfg.StateLocation)
+	return cfg
+}
+
+func (cfg *MetricsConfig) MergIn(o *MetricsConfig) *MetricsConfig {
+	cfg.Listen = coalesceString(o.Listen, cfg.Listen)
+	cfg.PushgatewayURL = coalesceString(o.PushgatewayURL, cfg.PushgatewayURL)
+	cfg.Job = coalesceString(o.Job, cfg.Job)
+	return cfg
+}
+
+func (cfg *SnapshotConfig) MergIn(o *SnapshotConfig) *SnapshotConfig {
+	cfg.Identifier = coalesceString(o.Identifier, cfg.Identifier)
+	cfg.KmsKeyID = coalesceString(o.KmsKeyID, cfg.KmsKeyID)
+	cfg.DeleteOriginal = o.DeleteOriginal || cfg.DeleteOriginal
+	return cfg
+}
+
+func (cfg *DumpConfig) MergIn(o *DumpConfig) *DumpConfig {
+	cfg.Location = coalesceString(o.Location, cfg.Location)
+	cfg.SkipSnapshot = o.SkipSnapshot || cfg.SkipSnapshot
+	return cfg
+}
+
+func (cfg *SubsetConfig) MergIn(o *SubsetConfig) *SubsetConfig {
+	cfg.Database = coalesceString(o.Database, cfg.Database)
+	if len(o.Roots) > 0 {
+		cfg.Roots = o.Roots
+	}
+	return cfg
+}
+
+func (cfg *TargetClusterConfig) MergIn(o *TargetClusterConfig) *TargetClusterConfig {
+	cfg.DBClusterIdentifier = coalesceString(o.DBClusterIdentifier, cfg.DBClusterIdentifier)
+	cfg.DBInstanceClass = coalesceString(o.DBInstanceClass, cfg.DBInstanceClass)
+	cfg.SecurityGroupIDs = coalesceString(o.SecurityGroupIDs, cfg.SecurityGroupIDs)
+	cfg.DBSubnetGroupName = coalesceString(o.DBSubnetGroupName, cfg.DBSubnetGroupName)
+	cfg.DBClusterParameterGroupName = coalesceString(o.DBClusterParameterGroupName, cfg.DBClusterParameterGroupName)
+	cfg.DBParameterGroupName = coalesceString(o.DBParameterGroupName, cfg.DBParameterGroupName)
+	cfg.DeletionProtection = o.DeletionProtection || cfg.DeletionProtection
 	return cfg
 }
 
@@ -153,7 +533,7 @@ func (cfg *ExportTaskConfig) MergIn(o *ExportTaskConfig) *ExportTaskConfig {
 
 func (cfg *Config) Validate() error {
 	if err := cfg.TempCluster.Validate(); err != nil {
-		return nil
+		return err
 	}
 	if cfg.DBUserName == "" {
 		log.Println("[warn] db-user-name is empty. maybe can not connect Cloaned Aurora")
@@ -161,6 +541,64 @@ func (cfg *Config) Validate() error {
 	if cfg.DBUserPassword == "" {
 		log.Println("[warn] db-user-password is empty. maybe can not connect Cloaned Aurora")
 	}
+	if len(cfg.Databases) > 0 && cfg.SQLFile != "" {
+		return errors.New("sql_file and databases can not be used together")
+	}
+	if cfg.Chunk.Size < 0 {
+		return errors.New("chunk-size must not be negative")
+	}
+	if cfg.SQLConcurrency < 0 {
+		return errors.New("sql-concurrency must not be negative")
+	}
+	for name, files := range cfg.Databases {
+		if len(files) == 0 {
+			return fmt.Errorf("databases: sql file of `%s` is required", name)
+		}
+	}
+	if cfg.Interactive {
+		if err := cfg.Prompt.Validate(); err != nil {
+			return err
+		}
+		if err := cfg.RemoteConsole.Validate(); err != nil {
+			return err
+		}
+	}
+	if cfg.EnableApproval {
+		if err := cfg.Approval.Validate(); err != nil {
+			return err
+		}
+	}
+	for i := range cfg.Notifications {
+		if err := cfg.Notifications[i].Validate(); err != nil {
+			return fmt.Errorf("notifications[%d]: %w", i, err)
+		}
+	}
+	for i := range cfg.Publish {
+		if err := cfg.Publish[i].Validate(); err != nil {
+			return fmt.Errorf("publish[%d]: %w", i, err)
+		}
+	}
+	if err := cfg.Snapshot.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.validateNameTemplates(); err != nil {
+		return err
+	}
+	if err := cfg.Target.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.validateDump(); err != nil {
+		return err
+	}
+	if err := cfg.Subset.Validate(); err != nil {
+		return err
+	}
+	if err := validateTablePatterns("truncate_tables", cfg.TruncateTables); err != nil {
+		return err
+	}
+	if err := validateTablePatterns("drop_tables", cfg.DropTables); err != nil {
+		return err
+	}
 
 	if !cfg.EnableExportTask {
 		return nil
@@ -181,6 +619,224 @@ func (cfg *TempDBClusterConfig) Validate() error {
 	if !strings.HasPrefix(cfg.DBInstanceClass, "db.") {
 		log.Println("[warn] db-instance-class does not have the `db.` prefix. Maybe you can't create a DB instance")
 	}
+	if cfg.SQLDBInstanceClass != "" && !strings.HasPrefix(cfg.SQLDBInstanceClass, "db.") {
+		log.Println("[warn] sql-db-instance-class does not have the `db.` prefix. Maybe you can't create a DB instance")
+	}
+	if err := validateCapacity("", cfg.MinCapacity, cfg.MaxCapacity); err != nil {
+		return err
+	}
+	if err := validateCapacity("sql-", cfg.SQLMinCapacity, cfg.SQLMaxCapacity); err != nil {
+		return err
+	}
+	serverless := cfg.DBInstanceClass == serverlessDBInstanceClass || cfg.SQLDBInstanceClass == serverlessDBInstanceClass
+	if serverless && cfg.MinCapacity == 0 {
+		return fmt.Errorf("min-capacity and max-capacity are required for %s", serverlessDBInstanceClass)
+	}
+	if !serverless && (cfg.MinCapacity != 0 || cfg.SQLMinCapacity != 0) {
+		return fmt.Errorf("min-capacity and max-capacity are available only for %s", serverlessDBInstanceClass)
+	}
+	if cfg.Port != 0 && (cfg.Port < minAuroraPort || cfg.Port > 65535) {
+		return fmt.Errorf("port must be between %d and 65535, got %d", minAuroraPort, cfg.Port)
+	}
+	return nil
+}
+
+// validateCapacity validates the Aurora Serverless v2 capacity range. Both zero means not set.
+func validateCapacity(prefix string, min, max float64) error {
+	if min == 0 && max == 0 {
+		return nil
+	}
+	if min == 0 || max == 0 {
+		return fmt.Errorf("both %smin-capacity and %smax-capacity are required", prefix, prefix)
+	}
+	for _, c := range []float64{min, max} {
+		if c < minServerlessCapacity || c > maxServerlessCapacity || math.Mod(c*2, 1) != 0 {
+			return fmt.Errorf("%scapacity must be between %g and %g in half-step increments, got %g", prefix, minServerlessCapacity, maxServerlessCapacity, c)
+		}
+	}
+	if min > max {
+		return fmt.Errorf("%smin-capacity %g is greater than %smax-capacity %g", prefix, min, prefix, max)
+	}
+	return nil
+}
+
+// initialDBInstanceClass returns the instance class to create the instance, which is used while executing SQL.
+func (cfg *TempDBClusterConfig) initialDBInstanceClass() string {
+	return coalesceString(cfg.SQLDBInstanceClass, cfg.DBInstanceClass)
+}
+
+// initialCapacity returns the capacity range to restore the cluster, which is used while executing SQL.
+func (cfg *TempDBClusterConfig) initialCapacity() (float64, float64) {
+	if cfg.SQLMinCapacity != 0 {
+		return cfg.SQLMinCapacity, cfg.SQLMaxCapacity
+	}
+	return cfg.MinCapacity, cfg.MaxCapacity
+}
+
+// instanceScaleDownRequired reports whether the instance should be scaled down to DBInstanceClass after executing SQL.
+func (cfg *TempDBClusterConfig) instanceScaleDownRequired() bool {
+	return cfg.SQLDBInstanceClass != "" && cfg.SQLDBInstanceClass != cfg.DBInstanceClass
+}
+
+// capacityScaleDownRequired reports whether the cluster should be scaled down to MinCapacity and MaxCapacity after executing SQL.
+func (cfg *TempDBClusterConfig) capacityScaleDownRequired() bool {
+	return cfg.SQLMinCapacity != 0 && (cfg.SQLMinCapacity != cfg.MinCapacity || cfg.SQLMaxCapacity != cfg.MaxCapacity)
+}
+
+func (cfg *TempDBClusterConfig) scaleDownRequired() bool {
+	return cfg.instanceScaleDownRequired() || cfg.capacityScaleDownRequired()
+}
+
+func (cfg *PromptConfig) Validate() error {
+	if _, err := newHistoryRedactor(cfg.HistoryRedactPatterns); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (cfg *PromptConfig) historyFile() (string, error) {
+	if cfg.DisableHistory {
+		return "", nil
+	}
+	if cfg.HistoryFile != "" {
+		return cfg.HistoryFile, nil
+	}
+	return defaultHistoryFile()
+}
+
+func (cfg *RemoteConsoleConfig) Validate() error {
+	if cfg.Listen == "" {
+		return nil
+	}
+	// a generated token would have to be logged, and the logs may be shipped elsewhere.
+	if cfg.Token == "" {
+		return errors.New("remote-console-token is required if remote-console-listen is set")
+	}
+	if _, err := cfg.timeout(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (cfg *RemoteConsoleConfig) timeout() (time.Duration, error) {
+	if cfg.Timeout == "" {
+		return time.Hour, nil
+	}
+	d, err := time.ParseDuration(cfg.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("remote-console-timeout: %w", err)
+	}
+	return d, nil
+}
+
+func (cfg *NotificationConfig) Validate() error {
+	switch cfg.Type {
+	case "webhook", "slack":
+		if cfg.URL == "" {
+			return fmt.Errorf("url is required for %s notification", cfg.Type)
+		}
+	case "sns":
+		if cfg.TopicArn == "" {
+			return errors.New("topic_arn is required for sns notification")
+		}
+	case "eventbridge":
+	default:
+		return fmt.Errorf("unknown notification type `%s`. webhook, slack, sns or eventbridge", cfg.Type)
+	}
+	for _, e := range cfg.Events {
+		switch e {
+		case NotificationEventStart, NotificationEventSuccess, NotificationEventFailure, NotificationEventStage:
+		default:
+			return fmt.Errorf("unknown notification event `%s`. start, success, failure or stage", e)
+		}
+	}
+	return nil
+}
+
+func (cfg *PublishConfig) Validate() error {
+	var target string
+	switch cfg.Type {
+	case "ssm":
+		if cfg.Name == "" {
+			return errors.New("name is required for ssm publish")
+		}
+		target = cfg.Name
+	case "s3":
+		if !strings.HasPrefix(cfg.Location, "s3://") {
+			return errors.New("location s3://bucket/key is required for s3 publish")
+		}
+		target = cfg.Location
+	case "file":
+		if cfg.Location == "" || strings.HasPrefix(cfg.Location, "s3://") {
+			return errors.New("location file path is required for file publish")
+		}
+		target = cfg.Location
+	default:
+		return fmt.Errorf("unknown publish type `%s`. ssm, s3 or file", cfg.Type)
+	}
+	_, err := renderName(cfg.Type+" publish target", target, nameTemplateData{}, flextime.Now())
+	return err
+}
+
+func (cfg *ApprovalConfig) Validate() error {
+	if cfg.SignalLocation == "" && cfg.Listen == "" {
+		return errors.New("either approval-signal-location or approval-listen is required if approval is enabled")
+	}
+	if _, err := cfg.timeout(); err != nil {
+		return err
+	}
+	for i, a := range cfg.Assertions {
+		if a.Query == "" {
+			return fmt.Errorf("approval.assertions[%d]: query is required", i)
+		}
+	}
+	return nil
+}
+
+func (cfg *ApprovalConfig) timeout() (time.Duration, error) {
+	if cfg.Timeout == "" {
+		return time.Hour, nil
+	}
+	d, err := time.ParseDuration(cfg.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("approval-timeout: %w", err)
+	}
+	return d, nil
+}
+
+func (cfg *SnapshotConfig) Validate() error {
+	if cfg.DeleteOriginal && cfg.KmsKeyID == "" {
+		return errors.New("snapshot-delete-original requires snapshot-kms-key-id")
+	}
+	return nil
+}
+
+// copyRequired reports whether the masked snapshot is copied with another KMS key.
+func (cfg *SnapshotConfig) copyRequired() bool {
+	return cfg.KmsKeyID != ""
+}
+
+func (cfg *DumpConfig) enabled() bool {
+	return cfg.Location != ""
+}
+
+// validateDump validates the dump config. Without the snapshot, nothing can use it.
+func (cfg *Config) validateDump() error {
+	if !cfg.Dump.SkipSnapshot {
+		return nil
+	}
+	switch {
+	case !cfg.Dump.enabled():
+		return errors.New("dump-skip-snapshot requires dump-location")
+	case cfg.EnableExportTask:
+		return errors.New("dump-skip-snapshot can not be used with enable-export-task")
+	case cfg.Snapshot.Identifier != "" || cfg.Snapshot.copyRequired():
+		return errors.New("dump-skip-snapshot can not be used with snapshot settings")
+	case len(cfg.Publish) > 0:
+		return errors.New("dump-skip-snapshot can not be used with publish")
+	case cfg.Target.enabled():
+		return errors.New("dump-skip-snapshot can not be used with target-db-cluster-identifier")
+	}
 	return nil
 }
 
@@ -198,6 +854,29 @@ func (cfg *ExportTaskConfig) Validate() error {
 	return nil
 }
 
+// stringOrNil returns nil for an empty string, to leave the parameter of the API unset.
+func stringOrNil(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
+
+func (cfg *TempDBClusterConfig) port() *int64 {
+	if cfg.Port == 0 {
+		return nil
+	}
+	return aws.Int64(int64(cfg.Port))
+}
+
+// enableIAMDatabaseAuthentication returns nil unless enabled, to leave the parameter of the API unset.
+func (cfg *TempDBClusterConfig) enableIAMDatabaseAuthentication() *bool {
+	if !cfg.EnableIAMDatabaseAuthentication {
+		return nil
+	}
+	return aws.Bool(true)
+}
+
 func (cfg *TempDBClusterConfig) securityGroupIDs() []string {
 	if cfg.SecurityGroupIDs == "" {
 		return nil
@@ -230,6 +909,146 @@ func openLocation(loc string) (io.ReadCloser, error) {
 }
 
 func openS3(u *url.URL) (io.ReadCloser, error) {
+	svc, err := newS3Client(u.Host)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[debug] try get bucket=%s key=%s\n", u.Host, u.Path)
+	result, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(u.Host),
+		Key:    aws.String(u.Path),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.Body, err
+}
+
+func writeLocation(loc string, body []byte) error {
+	if u, err := url.Parse(loc); err == nil {
+		if u.Scheme == "" {
+			return os.WriteFile(loc, body, 0644)
+		}
+		if u.Scheme == "file" {
+			return os.WriteFile(u.Path, body, 0644)
+		}
+		if u.Scheme == "s3" {
+			log.Println("[debug] put to s3 loc=", loc)
+			return writeS3(u, body)
+		}
+		return fmt.Errorf("schema %s is not support, can not put %s", u.Scheme, loc)
+	}
+	return os.WriteFile(loc, body, 0644)
+}
+
+func writeS3(u *url.URL, body []byte) error {
+	svc, err := newS3Client(u.Host)
+	if err != nil {
+		return err
+	}
+	log.Printf("[debug] try put bucket=%s key=%s\n", u.Host, u.Path)
+	_, err = svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(u.Host),
+		Key:    aws.String(u.Path),
+		Body:   bytes.NewReader(body),
+	})
+	return err
+}
+
+func deleteLocation(loc string) error {
+	if u, err := url.Parse(loc); err == nil {
+		if u.Scheme == "" {
+			return os.Remove(loc)
+		}
+		if u.Scheme == "file" {
+			return os.Remove(u.Path)
+		}
+		if u.Scheme == "s3" {
+			log.Println("[debug] delete from s3 loc=", loc)
+			return deleteS3(u)
+		}
+		return fmt.Errorf("schema %s is not support, can not delete %s", u.Scheme, loc)
+	}
+	return os.Remove(loc)
+}
+
+func deleteS3(u *url.URL) error {
+	svc, err := newS3Client(u.Host)
+	if err != nil {
+		return err
+	}
+	log.Printf("[debug] try delete bucket=%s key=%s\n", u.Host, u.Path)
+	_, err = svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(u.Host),
+		Key:    aws.String(u.Path),
+	})
+	return err
+}
+
+// createLocation creates the file or s3 object at loc, and returns the writer streaming to it.
+// The s3 object is uploaded while writing, and completed by Close.
+func createLocation(loc string) (io.WriteCloser, error) {
+	if u, err := url.Parse(loc); err == nil {
+		if u.Scheme == "" {
+			return createFile(loc)
+		}
+		if u.Scheme == "file" {
+			return createFile(u.Path)
+		}
+		if u.Scheme == "s3" {
+			log.Println("[debug] upload to s3 loc=", loc)
+			return createS3(u)
+		}
+		return nil, fmt.Errorf("schema %s is not support, can not put %s", u.Scheme, loc)
+	}
+	return createFile(loc)
+}
+
+func createFile(path string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return os.Create(path)
+}
+
+// s3Writer uploads the written body. CloseWithError aborts the upload.
+type s3Writer struct {
+	*io.PipeWriter
+	done chan error
+}
+
+func (w *s3Writer) Close() error {
+	w.PipeWriter.Close()
+	return <-w.done
+}
+
+func (w *s3Writer) CloseWithError(err error) error {
+	w.PipeWriter.CloseWithError(err)
+	<-w.done
+	return nil
+}
+
+func createS3(u *url.URL) (io.WriteCloser, error) {
+	svc, err := newS3Client(u.Host)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[debug] try upload bucket=%s key=%s\n", u.Host, u.Path)
+	pr, pw := io.Pipe()
+	w := &s3Writer{PipeWriter: pw, done: make(chan error, 1)}
+	go func() {
+		_, err := s3manager.NewUploaderWithClient(svc).Upload(&s3manager.UploadInput{
+			Bucket: aws.String(u.Host),
+			Key:    aws.String(u.Path),
+			Body:   pr,
+		})
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+func newS3Client(bucket string) (*s3.S3, error) {
 	region := os.Getenv("AWS_DEFAULT_REGION")
 	if region == "" {
 		log.Println("[debug] missing region")
@@ -237,7 +1056,7 @@ func openS3(u *url.URL) (io.ReadCloser, error) {
 		region, err = s3manager.GetBucketRegion(
 			context.Background(),
 			session.Must(session.NewSession()),
-			u.Host,
+			bucket,
 			"us-east-1",
 		)
 		if err != nil {
@@ -253,14 +1072,47 @@ func openS3(u *url.URL) (io.ReadCloser, error) {
 	if err != nil {
 		return nil, err
 	}
-	svc := s3.New(sess)
-	log.Printf("[debug] try get bucket=%s key=%s\n", u.Host, u.Path)
-	result, err := svc.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(u.Host),
-		Key:    aws.String(u.Path),
-	})
-	if err != nil {
-		return nil, err
+	return s3.New(sess), nil
+}
+
+// maskedDatabases returns the names of the masked databases, sorted. If databases is not set, database is masked.
+func (cfg *Config) maskedDatabases() []string {
+	if len(cfg.Databases) == 0 {
+		return []string{cfg.Database}
 	}
-	return result.Body, err
+	databases := make([]string, 0, len(cfg.Databases))
+	for name := range cfg.Databases {
+		databases = append(databases, name)
+	}
+	sort.Strings(databases)
+	return databases
+}
+
+// maskSQLTargets returns SQL files to execute, grouped by database and sorted by database name.
+// If databases is not set, sql_file is executed on database. Tables are truncated or dropped even without SQL files.
+func (cfg *Config) maskSQLTargets() []maskSQLTarget {
+	if len(cfg.Databases) == 0 {
+		if cfg.SQLFile == "" {
+			if cfg.tableStatementsRequired() {
+				return []maskSQLTarget{{Database: cfg.Database}}
+			}
+			return nil
+		}
+		return []maskSQLTarget{{
+			Database: cfg.Database,
+			Files:    []maskSQLFile{{Location: cfg.SQLFile}},
+		}}
+	}
+	targets := make([]maskSQLTarget, 0, len(cfg.Databases))
+	for name, locations := range cfg.Databases {
+		t := maskSQLTarget{Database: name}
+		for _, loc := range locations {
+			t.Files = append(t.Files, maskSQLFile{Location: loc})
+		}
+		targets = append(targets, t)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].Database < targets[j].Database
+	})
+	return targets
 }
@@ -0,0 +1,328 @@
+package mascaras
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Songmu/flextime"
+)
+
+// dumpInsertRows is the number of rows in an INSERT statement of the dump.
+const dumpInsertRows = 100
+
+// DumpTableReport is a table dumped to the location.
+type DumpTableReport struct {
+	Database        string  `json:"database,omitempty"`
+	Table           string  `json:"table"`
+	Location        string  `json:"location"`
+	Rows            int64   `json:"rows"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// dumpExecuter is implemented by executers which can dump tables.
+type dumpExecuter interface {
+	tableLister
+	dumpTable(ctx context.Context, table string, w io.Writer) (rows int64, err error)
+}
+
+// foreignKeyDumper is implemented by executers which dump foreign keys apart from the tables.
+type foreignKeyDumper interface {
+	foreignKeyStatements(ctx context.Context) ([]string, error)
+}
+
+func dumpTableLocation(location, database, table string) string {
+	return strings.TrimSuffix(location, "/") + "/" + database + "/" + table + ".sql.gz"
+}
+
+// dumpForeignKeysLocation is beside the directory of the tables, so the tables are loaded by a glob before it.
+func dumpForeignKeysLocation(location, database string) string {
+	return strings.TrimSuffix(location, "/") + "/" + database + ".foreign_keys.sql.gz"
+}
+
+// dump dumps all tables of the databases on the temporary cluster to the location, a gzipped SQL file per table.
+func (app *App) dump(ctx context.Context, dbtype, location, host string, port int) ([]DumpTableReport, error) {
+	var reports []DumpTableReport
+	for _, database := range app.cfg.maskedDatabases() {
+		r, err := app.dumpDatabase(ctx, dbtype, location, database, host, port)
+		reports = append(reports, r...)
+		if err != nil {
+			return reports, err
+		}
+	}
+	return reports, nil
+}
+
+func (app *App) dumpDatabase(ctx context.Context, dbtype, location, database, host string, port int) ([]DumpTableReport, error) {
+	e, err := app.newExecuter(app.cfg, dbtype, database, host, port)
+	if err != nil {
+		return nil, err
+	}
+	defer e.Close()
+	de, ok := e.(dumpExecuter)
+	if !ok {
+		return nil, errors.New("dump is not supported by the executer")
+	}
+	tables, err := de.tables(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("tables of database `%s`: %w", database, err)
+	}
+	app.logger.Printf("[info] dump %d tables of database `%s` to %s\n", len(tables), database, location)
+	reports := make([]DumpTableReport, 0, len(tables))
+	for _, table := range tables {
+		loc := dumpTableLocation(location, database, table)
+		startedAt := flextime.Now()
+		rows, err := writeGzipLocation(loc, func(w io.Writer) (int64, error) {
+			return de.dumpTable(ctx, table, w)
+		})
+		if err != nil {
+			return reports, fmt.Errorf("dump table `%s` of database `%s`: %w", table, database, err)
+		}
+		app.logger.Printf("[info] dumped table `%s` of database `%s`, %d rows: %s\n", table, database, rows, loc)
+		reports = append(reports, DumpTableReport{
+			Database:        database,
+			Table:           table,
+			Location:        loc,
+			Rows:            rows,
+			DurationSeconds: flextime.Since(startedAt).Seconds(),
+		})
+	}
+	if fd, ok := de.(foreignKeyDumper); ok && dbtype == "postgresql" {
+		if err := dumpForeignKeys(ctx, fd, dumpForeignKeysLocation(location, database)); err != nil {
+			return reports, fmt.Errorf("dump foreign keys of database `%s`: %w", database, err)
+		}
+		app.logger.Printf("[info] dumped foreign keys of database `%s`: %s\n", database, dumpForeignKeysLocation(location, database))
+	}
+	return reports, nil
+}
+
+// dumpForeignKeys writes the foreign keys of PostgreSQL, added after all tables are loaded.
+// The file is written even if there are no foreign keys, so it can be loaded always.
+func dumpForeignKeys(ctx context.Context, fd foreignKeyDumper, loc string) error {
+	stmts, err := fd.foreignKeyStatements(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = writeGzipLocation(loc, func(w io.Writer) (int64, error) {
+		return int64(len(stmts)), writeStatements(w, stmts)
+	})
+	return err
+}
+
+// writeGzipLocation streams the gzipped output of write to loc. A failed s3 upload is aborted.
+func writeGzipLocation(loc string, write func(w io.Writer) (int64, error)) (int64, error) {
+	w, err := createLocation(loc)
+	if err != nil {
+		return 0, err
+	}
+	gw := gzip.NewWriter(w)
+	rows, err := write(gw)
+	if err == nil {
+		err = gw.Close()
+	}
+	if err != nil {
+		if a, ok := w.(interface{ CloseWithError(error) error }); ok {
+			a.CloseWithError(err)
+		} else {
+			w.Close()
+		}
+		return rows, err
+	}
+	return rows, w.Close()
+}
+
+// dumpTable writes the statements to drop, create and insert the table.
+func (e *dbExecuter) dumpTable(ctx context.Context, table string, w io.Writer) (int64, error) {
+	schema, err := e.tableSchema(ctx, table)
+	if err != nil {
+		return 0, err
+	}
+	ident := quoteIdentifier(e.dbtype, table)
+	if e.dbtype == "postgresql" {
+		fmt.Fprint(w, "SET client_encoding = 'UTF8';\nSET standard_conforming_strings = on;\n")
+		writeStatements(w, schema.before)
+		fmt.Fprintf(w, "DROP TABLE IF EXISTS %s CASCADE;\n", ident)
+	} else {
+		fmt.Fprintf(w, "SET NAMES utf8mb4;\nSET time_zone = '+00:00';\nSET FOREIGN_KEY_CHECKS = 0;\nDROP TABLE IF EXISTS %s;\n", ident)
+	}
+	if err := writeStatements(w, schema.create); err != nil {
+		return 0, err
+	}
+	if _, err := io.WriteString(w, "\n"); err != nil {
+		return 0, err
+	}
+
+	selected := "*"
+	if len(schema.columns) > 0 {
+		quoted := make([]string, len(schema.columns))
+		for i, c := range schema.columns {
+			quoted[i] = quoteIdentifier(e.dbtype, c)
+		}
+		selected = strings.Join(quoted, ", ")
+	}
+	conn, err := e.db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if e.dbtype != "postgresql" {
+		// TIMESTAMP values are read in UTC and loaded in UTC by the header, as mysqldump does,
+		// so the dump does not depend on the time zones of the sessions.
+		if _, err := conn.ExecContext(ctx, "SET @mascaras_time_zone = @@session.time_zone, time_zone = '+00:00'"); err != nil {
+			return 0, err
+		}
+		// restore the time zone of the connection, which goes back to the pool.
+		defer conn.ExecContext(context.Background(), "SET time_zone = @mascaras_time_zone")
+	}
+	rows, err := conn.QueryContext(ctx, "SELECT "+selected+" FROM "+ident)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return 0, err
+	}
+	columns := make([]string, len(columnTypes))
+	binary := make([]bool, len(columnTypes))
+	for i, ct := range columnTypes {
+		columns[i] = quoteIdentifier(e.dbtype, ct.Name())
+		binary[i] = isBinaryColumnType(ct.DatabaseTypeName())
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES\n", ident, strings.Join(columns, ", "))
+	if schema.insertOption != "" {
+		insert = fmt.Sprintf("INSERT INTO %s (%s) %s VALUES\n", ident, strings.Join(columns, ", "), schema.insertOption)
+	}
+	values := make([]interface{}, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	var n int64
+	var b strings.Builder
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return n, err
+		}
+		if n%dumpInsertRows == 0 {
+			b.WriteString(insert)
+		} else {
+			b.WriteString(",\n")
+		}
+		b.WriteString("(")
+		for i, v := range values {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(dumpLiteral(e.dbtype, v, binary[i]))
+		}
+		b.WriteString(")")
+		n++
+		if n%dumpInsertRows == 0 {
+			b.WriteString(";\n")
+			if _, err := io.WriteString(w, b.String()); err != nil {
+				return n, err
+			}
+			b.Reset()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+	if n%dumpInsertRows != 0 {
+		b.WriteString(";\n")
+	}
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return n, err
+	}
+	if len(schema.after) > 0 {
+		if _, err := io.WriteString(w, "\n"); err != nil {
+			return n, err
+		}
+	}
+	return n, writeStatements(w, schema.after)
+}
+
+func writeStatements(w io.Writer, stmts []string) error {
+	for _, stmt := range stmts {
+		if _, err := fmt.Fprintf(w, "%s;\n", stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isBinaryColumnType(name string) bool {
+	switch strings.ToUpper(name) {
+	case "BINARY", "VARBINARY", "BLOB", "TINYBLOB", "MEDIUMBLOB", "LONGBLOB", "BIT", "GEOMETRY", "BYTEA":
+		return true
+	}
+	return false
+}
+
+func quoteIdentifier(dbtype, name string) string {
+	if dbtype == "postgresql" {
+		return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+	}
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+var mysqlStringReplacer = strings.NewReplacer(
+	`\`, `\\`,
+	`'`, `\'`,
+	"\x00", `\0`,
+	"\n", `\n`,
+	"\r", `\r`,
+	"\x1a", `\Z`,
+)
+
+// quoteString quotes the string literal. PostgreSQL literals assume standard_conforming_strings = on.
+func quoteString(dbtype, s string) string {
+	if dbtype == "postgresql" {
+		return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+	}
+	return "'" + mysqlStringReplacer.Replace(s) + "'"
+}
+
+// dumpLiteral returns the SQL literal of the scanned value.
+func dumpLiteral(dbtype string, v interface{}, binary bool) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		if !binary {
+			return quoteString(dbtype, string(v))
+		}
+		if dbtype == "postgresql" {
+			return `'\x` + hex.EncodeToString(v) + "'"
+		}
+		return "X'" + hex.EncodeToString(v) + "'"
+	case string:
+		return quoteString(dbtype, v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return quoteString(dbtype, strings.TrimPrefix(strings.Replace(strconv.FormatFloat(v, 'g', -1, 64), "Inf", "Infinity", 1), "+"))
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		if v {
+			return "TRUE"
+		}
+		return "FALSE"
+	case time.Time:
+		if dbtype == "postgresql" {
+			return quoteString(dbtype, v.Format(time.RFC3339Nano))
+		}
+		return quoteString(dbtype, v.Format("2006-01-02 15:04:05.999999"))
+	}
+	return quoteString(dbtype, fmt.Sprint(v))
+}
@@ -0,0 +1,397 @@
+package mascaras
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// tableSchema is the statements to create a table in the dump.
+type tableSchema struct {
+	// before is executed before the table is dropped, e.g. CREATE TYPE of the column types.
+	before []string
+	// create is executed after the table is dropped, e.g. CREATE SEQUENCE and CREATE TABLE.
+	create []string
+	// after is executed after the rows are inserted, e.g. CREATE INDEX and setval of the sequences.
+	after []string
+	// columns are the dumped columns. Empty means all columns.
+	columns []string
+	// insertOption is inserted between the columns and VALUES of INSERT, e.g. OVERRIDING SYSTEM VALUE.
+	insertOption string
+}
+
+// pgColumn is a column of a PostgreSQL table read from the catalog.
+type pgColumn struct {
+	name      string
+	typ       string
+	typeOID   uint32
+	notNull   bool
+	def       string
+	identity  string // "a" (ALWAYS), "d" (BY DEFAULT) or empty
+	generated string // "s" (STORED) or empty
+	collation string
+}
+
+// pgSequence is a sequence used by a PostgreSQL table, owned by a column or referenced by a column default.
+type pgSequence struct {
+	name      string
+	typ       string
+	start     int64
+	increment int64
+	min       int64
+	max       int64
+	cache     int64
+	cycle     bool
+	column    string
+	deptype   string // "a" (owned by the column), "i" (identity of the column) or empty
+	lastValue int64
+	isCalled  bool
+}
+
+// pgType is a user-defined type of PostgreSQL read from the catalog.
+type pgType struct {
+	name      string
+	typtype   string
+	array     bool
+	elem      uint32
+	baseType  uint32
+	base      string
+	notNull   bool
+	def       string
+	schema    string
+	extension string
+	labels    []string
+	checks    [][2]string
+}
+
+// tableSchema returns the statements to create the table. For MySQL, it is SHOW CREATE TABLE.
+func (e *dbExecuter) tableSchema(ctx context.Context, table string) (*tableSchema, error) {
+	if e.dbtype == "postgresql" {
+		return e.pgTableSchema(ctx, table)
+	}
+	var name, createTable string
+	if err := e.db.QueryRowContext(ctx, "SHOW CREATE TABLE "+quoteIdentifier(e.dbtype, table)).Scan(&name, &createTable); err != nil {
+		return nil, err
+	}
+	return &tableSchema{create: []string{createTable}}, nil
+}
+
+// pgTableSchema builds the statements from the catalog: column types with their enum and domain types,
+// defaults, identity and generated columns, sequences, constraints except foreign keys, and indexes.
+// Foreign keys are dumped by foreignKeyStatements, because the referenced tables may not be loaded yet.
+func (e *dbExecuter) pgTableSchema(ctx context.Context, table string) (*tableSchema, error) {
+	ident := quoteIdentifier(e.dbtype, table)
+	var relkind string
+	var inherited bool
+	err := e.db.QueryRowContext(ctx, `SELECT c.relkind::text, EXISTS (SELECT 1 FROM pg_catalog.pg_inherits i WHERE i.inhrelid = c.oid OR i.inhparent = c.oid)
+FROM pg_catalog.pg_class c WHERE c.oid = $1::regclass`, ident).Scan(&relkind, &inherited)
+	if err != nil {
+		return nil, err
+	}
+	if relkind != "r" || inherited {
+		return nil, fmt.Errorf("partitioned or inherited table `%s` is not supported by the dump", table)
+	}
+	columns, err := e.pgColumns(ctx, ident)
+	if err != nil {
+		return nil, err
+	}
+	schema := &tableSchema{}
+	seen := make(map[uint32]bool)
+	for _, c := range columns {
+		stmts, err := e.pgTypeStatements(ctx, c.typeOID, seen)
+		if err != nil {
+			return nil, fmt.Errorf("column `%s`: %w", c.name, err)
+		}
+		schema.before = append(schema.before, stmts...)
+	}
+	sequences, err := e.pgSequences(ctx, ident)
+	if err != nil {
+		return nil, err
+	}
+	constraints, err := e.pgQueryStrings(ctx, `SELECT 'CONSTRAINT ' || quote_ident(conname) || ' ' || pg_catalog.pg_get_constraintdef(oid)
+FROM pg_catalog.pg_constraint
+WHERE conrelid = $1::regclass AND contype IN ('p', 'u', 'c', 'x')
+ORDER BY contype = 'p' DESC, conname`, ident)
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := e.pgQueryStrings(ctx, `SELECT pg_catalog.pg_get_indexdef(i.indexrelid)
+FROM pg_catalog.pg_index i
+WHERE i.indrelid = $1::regclass AND NOT EXISTS (
+  SELECT 1 FROM pg_catalog.pg_constraint c WHERE c.conindid = i.indexrelid AND c.conrelid = i.indrelid AND c.contype IN ('p', 'u', 'x')
+)
+ORDER BY i.indexrelid::regclass::text`, ident)
+	if err != nil {
+		return nil, err
+	}
+
+	identities := make(map[string]pgSequence)
+	for _, s := range sequences {
+		if s.deptype == "i" {
+			identities[s.column] = s
+			continue
+		}
+		schema.create = append(schema.create, pgCreateSequenceStatement(s))
+	}
+	defs := make([]string, 0, len(columns)+len(constraints))
+	for _, c := range columns {
+		defs = append(defs, pgColumnDefinition(c, identities[c.name]))
+		if c.generated == "" {
+			schema.columns = append(schema.columns, c.name)
+		}
+		if c.identity == "a" {
+			schema.insertOption = "OVERRIDING SYSTEM VALUE"
+		}
+	}
+	defs = append(defs, constraints...)
+	schema.create = append(schema.create, fmt.Sprintf("CREATE TABLE %s (\n  %s\n)", ident, strings.Join(defs, ",\n  ")))
+	for _, s := range sequences {
+		if s.deptype == "a" {
+			schema.create = append(schema.create, fmt.Sprintf("ALTER SEQUENCE %s OWNED BY %s.%s", s.name, ident, quoteIdentifier(e.dbtype, s.column)))
+		}
+	}
+	schema.after = append(schema.after, indexes...)
+	for _, s := range sequences {
+		schema.after = append(schema.after, pgSetvalStatement(ident, s))
+	}
+	return schema, nil
+}
+
+func (e *dbExecuter) pgColumns(ctx context.Context, ident string) ([]pgColumn, error) {
+	// attgenerated is available since PostgreSQL 12.
+	var version int
+	if err := e.db.QueryRowContext(ctx, "SELECT current_setting('server_version_num')::int").Scan(&version); err != nil {
+		return nil, err
+	}
+	generated := "''"
+	if version >= 120000 {
+		generated = "a.attgenerated::text"
+	}
+	rows, err := e.db.QueryContext(ctx, `SELECT a.attname, pg_catalog.format_type(a.atttypid, a.atttypmod), a.atttypid, a.attnotnull,
+  COALESCE(pg_catalog.pg_get_expr(d.adbin, d.adrelid), ''), a.attidentity::text, `+generated+`,
+  CASE WHEN a.attcollation <> 0 AND a.attcollation <> t.typcollation THEN quote_ident(c.collname) ELSE '' END
+FROM pg_catalog.pg_attribute a
+JOIN pg_catalog.pg_type t ON t.oid = a.atttypid
+LEFT JOIN pg_catalog.pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+LEFT JOIN pg_catalog.pg_collation c ON c.oid = a.attcollation
+WHERE a.attrelid = $1::regclass AND a.attnum > 0 AND NOT a.attisdropped
+ORDER BY a.attnum`, ident)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []pgColumn
+	for rows.Next() {
+		var c pgColumn
+		if err := rows.Scan(&c.name, &c.typ, &c.typeOID, &c.notNull, &c.def, &c.identity, &c.generated, &c.collation); err != nil {
+			return nil, err
+		}
+		columns = append(columns, c)
+	}
+	return columns, rows.Err()
+}
+
+func (e *dbExecuter) pgSequences(ctx context.Context, ident string) ([]pgSequence, error) {
+	rows, err := e.db.QueryContext(ctx, `SELECT s.seqrelid::regclass::text, pg_catalog.format_type(s.seqtypid, NULL),
+  s.seqstart, s.seqincrement, s.seqmin, s.seqmax, s.seqcache, s.seqcycle, COALESCE(o.attname, ''), COALESCE(o.deptype::text, '')
+FROM pg_catalog.pg_sequence s
+LEFT JOIN (
+  SELECT dep.objid, a.attname, dep.deptype
+  FROM pg_catalog.pg_depend dep
+  JOIN pg_catalog.pg_attribute a ON a.attrelid = dep.refobjid AND a.attnum = dep.refobjsubid
+  WHERE dep.classid = 'pg_catalog.pg_class'::regclass AND dep.refclassid = 'pg_catalog.pg_class'::regclass
+    AND dep.refobjid = $1::regclass AND dep.deptype IN ('a', 'i')
+) o ON o.objid = s.seqrelid
+WHERE o.objid IS NOT NULL OR s.seqrelid IN (
+  SELECT dep.refobjid
+  FROM pg_catalog.pg_depend dep
+  JOIN pg_catalog.pg_attrdef d ON d.oid = dep.objid
+  WHERE dep.classid = 'pg_catalog.pg_attrdef'::regclass AND dep.refclassid = 'pg_catalog.pg_class'::regclass
+    AND d.adrelid = $1::regclass
+)
+ORDER BY 1`, ident)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sequences []pgSequence
+	for rows.Next() {
+		var s pgSequence
+		if err := rows.Scan(&s.name, &s.typ, &s.start, &s.increment, &s.min, &s.max, &s.cache, &s.cycle, &s.column, &s.deptype); err != nil {
+			return nil, err
+		}
+		sequences = append(sequences, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range sequences {
+		s := &sequences[i]
+		if err := e.db.QueryRowContext(ctx, "SELECT last_value, is_called FROM "+s.name).Scan(&s.lastValue, &s.isCalled); err != nil {
+			return nil, fmt.Errorf("sequence `%s`: %w", s.name, err)
+		}
+	}
+	return sequences, nil
+}
+
+// pgTypeStatements returns the statements to create the user-defined type and the types it depends on.
+// Built-in types need nothing, and types of extensions need CREATE EXTENSION.
+func (e *dbExecuter) pgTypeStatements(ctx context.Context, oid uint32, seen map[uint32]bool) ([]string, error) {
+	if seen[oid] {
+		return nil, nil
+	}
+	seen[oid] = true
+	var t pgType
+	err := e.db.QueryRowContext(ctx, `SELECT pg_catalog.format_type(t.oid, NULL), t.typtype::text, t.typcategory = 'A' AND t.typelem <> 0, t.typelem,
+  t.typbasetype, pg_catalog.format_type(t.typbasetype, t.typtypmod), t.typnotnull, COALESCE(t.typdefault, ''), n.nspname,
+  COALESCE((
+    SELECT quote_ident(x.extname)
+    FROM pg_catalog.pg_depend dep
+    JOIN pg_catalog.pg_extension x ON x.oid = dep.refobjid
+    WHERE dep.classid = 'pg_catalog.pg_type'::regclass AND dep.objid = t.oid
+      AND dep.refclassid = 'pg_catalog.pg_extension'::regclass AND dep.deptype = 'e'
+  ), '')
+FROM pg_catalog.pg_type t
+JOIN pg_catalog.pg_namespace n ON n.oid = t.typnamespace
+WHERE t.oid = $1`, oid).Scan(&t.name, &t.typtype, &t.array, &t.elem, &t.baseType, &t.base, &t.notNull, &t.def, &t.schema, &t.extension)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case t.schema == "pg_catalog" || t.schema == "information_schema":
+		return nil, nil
+	case t.extension != "":
+		return []string{"CREATE EXTENSION IF NOT EXISTS " + t.extension}, nil
+	case t.array:
+		return e.pgTypeStatements(ctx, t.elem, seen)
+	case t.typtype == "e":
+		if t.labels, err = e.pgQueryStrings(ctx, "SELECT enumlabel FROM pg_catalog.pg_enum WHERE enumtypid = $1 ORDER BY enumsortorder", oid); err != nil {
+			return nil, err
+		}
+		return []string{pgCreateTypeStatement(t)}, nil
+	case t.typtype == "d":
+		stmts, err := e.pgTypeStatements(ctx, t.baseType, seen)
+		if err != nil {
+			return nil, err
+		}
+		rows, err := e.db.QueryContext(ctx, `SELECT quote_ident(conname), pg_catalog.pg_get_constraintdef(oid)
+FROM pg_catalog.pg_constraint WHERE contypid = $1 AND contype = 'c' ORDER BY conname`, oid)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name, def string
+			if err := rows.Scan(&name, &def); err != nil {
+				return nil, err
+			}
+			t.checks = append(t.checks, [2]string{name, def})
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return append(stmts, pgCreateTypeStatement(t)), nil
+	}
+	return nil, fmt.Errorf("type %s is not supported by the dump", t.name)
+}
+
+// foreignKeyStatements returns the statements to add the foreign keys of the tables in the current schema.
+// MySQL has none, because SHOW CREATE TABLE includes them.
+func (e *dbExecuter) foreignKeyStatements(ctx context.Context) ([]string, error) {
+	if e.dbtype != "postgresql" {
+		return nil, nil
+	}
+	return e.pgQueryStrings(ctx, `SELECT 'ALTER TABLE ' || conrelid::regclass::text || ' ADD CONSTRAINT ' || quote_ident(conname) || ' ' || pg_catalog.pg_get_constraintdef(oid)
+FROM pg_catalog.pg_constraint
+WHERE contype = 'f' AND connamespace = current_schema()::regnamespace
+ORDER BY conrelid::regclass::text, conname`)
+}
+
+func (e *dbExecuter) pgQueryStrings(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := e.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+func pgColumnDefinition(c pgColumn, identity pgSequence) string {
+	def := quoteIdentifier("postgresql", c.name) + " " + c.typ
+	if c.collation != "" {
+		def += " COLLATE " + c.collation
+	}
+	switch {
+	case c.generated == "s":
+		def += " GENERATED ALWAYS AS (" + c.def + ") STORED"
+	case c.identity != "":
+		when := "BY DEFAULT"
+		if c.identity == "a" {
+			when = "ALWAYS"
+		}
+		def += " GENERATED " + when + " AS IDENTITY"
+		if identity.name != "" {
+			def += " (" + pgSequenceOptions(identity) + ")"
+		}
+	case c.def != "":
+		def += " DEFAULT " + c.def
+	}
+	if c.notNull {
+		def += " NOT NULL"
+	}
+	return def
+}
+
+func pgSequenceOptions(s pgSequence) string {
+	cycle := "NO CYCLE"
+	if s.cycle {
+		cycle = "CYCLE"
+	}
+	return fmt.Sprintf("INCREMENT BY %d MINVALUE %d MAXVALUE %d START WITH %d CACHE %d %s", s.increment, s.min, s.max, s.start, s.cache, cycle)
+}
+
+// pgCreateSequenceStatement creates the sequence if not exists, because a sequence referenced by defaults may be
+// shared by tables. An owned sequence is dropped with the table before.
+func pgCreateSequenceStatement(s pgSequence) string {
+	return fmt.Sprintf("CREATE SEQUENCE IF NOT EXISTS %s AS %s %s", s.name, s.typ, pgSequenceOptions(s))
+}
+
+func pgSetvalStatement(table string, s pgSequence) string {
+	seq := quoteString("postgresql", s.name)
+	if s.deptype == "i" {
+		seq = fmt.Sprintf("pg_catalog.pg_get_serial_sequence(%s, %s)", quoteString("postgresql", table), quoteString("postgresql", s.column))
+	}
+	return fmt.Sprintf("SELECT pg_catalog.setval(%s, %d, %t)", seq, s.lastValue, s.isCalled)
+}
+
+// pgCreateTypeStatement creates the enum or domain type, ignoring the type created by the dump of another table.
+func pgCreateTypeStatement(t pgType) string {
+	var create string
+	if t.typtype == "e" {
+		labels := make([]string, len(t.labels))
+		for i, l := range t.labels {
+			labels[i] = quoteString("postgresql", l)
+		}
+		create = fmt.Sprintf("CREATE TYPE %s AS ENUM (%s)", t.name, strings.Join(labels, ", "))
+	} else {
+		create = fmt.Sprintf("CREATE DOMAIN %s AS %s", t.name, t.base)
+		if t.def != "" {
+			create += " DEFAULT " + t.def
+		}
+		if t.notNull {
+			create += " NOT NULL"
+		}
+		for _, c := range t.checks {
+			create += " CONSTRAINT " + c[0] + " " + c[1]
+		}
+	}
+	return "DO $mascaras$ BEGIN\n  " + create + ";\nEXCEPTION WHEN duplicate_object THEN NULL;\nEND $mascaras$"
+}
@@ -0,0 +1,122 @@
+package mascaras
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// stringLiteralPattern matches single or double quoted SQL string literals, including escaped quotes.
+var stringLiteralPattern = regexp.MustCompile(`'(?:[^'\\]|\\.|'')*'|"(?:[^"\\]|\\.|"")*"`)
+
+const redactedLiteral = "***"
+
+// historyLimit is the number of lines kept in the history file.
+const historyLimit = 500
+
+type historyRedactor struct {
+	patterns []*regexp.Regexp
+}
+
+func newHistoryRedactor(patterns []string) (*historyRedactor, error) {
+	r := &historyRedactor{
+		patterns: make([]*regexp.Regexp, 0, len(patterns)),
+	}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("history redact pattern `%s`: %w", p, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+// redactStringLiterals replaces all string literals in line, for lines written to the logs.
+func redactStringLiterals(line string) string {
+	return stringLiteralPattern.ReplaceAllStringFunc(line, func(literal string) string {
+		return literal[:1] + redactedLiteral + literal[:1]
+	})
+}
+
+// Redact replaces string literals in line whose content matches any of the patterns.
+func (r *historyRedactor) Redact(line string) string {
+	if len(r.patterns) == 0 {
+		return line
+	}
+	return stringLiteralPattern.ReplaceAllStringFunc(line, func(literal string) string {
+		quote := literal[:1]
+		content := literal[1 : len(literal)-1]
+		for _, re := range r.patterns {
+			if re.MatchString(content) {
+				return quote + redactedLiteral + quote
+			}
+		}
+		return literal
+	})
+}
+
+func defaultHistoryFile() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "mascaras", "history"), nil
+}
+
+// prepareHistoryFile creates the history file and its directory readable only by the current user,
+// and keeps the last limit lines of the file. readline creates missing files as 0666, and rewrites
+// a file over the limit via a temporary file of 0666, so the file must exist within the limit before the prompt starts.
+func prepareHistoryFile(path string, limit int) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		return err
+	}
+	return compactHistoryFile(path, limit)
+}
+
+// compactHistoryFile replaces the file over the limit with its last limit non-empty lines.
+func compactHistoryFile(path string, limit int) error {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// readline counts all lines including empty ones.
+	if strings.Count(string(bs), "\n") <= limit {
+		return nil
+	}
+	var lines []string
+	for _, line := range strings.Split(string(bs), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > limit {
+		lines = lines[len(lines)-limit:]
+	}
+	// CreateTemp creates the file as 0600.
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,224 @@
+package mascaras
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Songmu/flextime"
+	gconf "github.com/kayac/go-config"
+	"github.com/robfig/cron/v3"
+)
+
+// JobsConfig is the config of `mascaras jobs` and `mascaras serve`.
+type JobsConfig struct {
+	Concurrency    int          `json:"concurrency,omitempty" yaml:"concurrency,omitempty"`
+	ReportLocation string       `json:"report_location,omitempty" yaml:"report_location,omitempty"`
+	Listen         string       `json:"listen,omitempty" yaml:"listen,omitempty"`
+	Jobs           []*JobConfig `json:"jobs,omitempty" yaml:"jobs,omitempty"`
+}
+
+// JobConfig is a job, a run of a source db cluster with a config file.
+// SQLFile, Databases, Database and export task settings override the config file.
+type JobConfig struct {
+	Name                      string              `json:"name,omitempty" yaml:"name,omitempty"`
+	Schedule                  string              `json:"schedule,omitempty" yaml:"schedule,omitempty"`
+	SourceDBClusterIdentifier string              `json:"source_db_cluster_identifier,omitempty" yaml:"source_db_cluster_identifier,omitempty"`
+	Config                    string              `json:"config,omitempty" yaml:"config,omitempty"`
+	SQLFile                   string              `json:"sql_file,omitempty" yaml:"sql_file,omitempty"`
+	Databases                 map[string]SQLFiles `json:"databases,omitempty" yaml:"databases,omitempty"`
+	Database                  string              `json:"database,omitempty" yaml:"database,omitempty"`
+	EnableExportTask          bool                `json:"enable_export_task,omitempty" yaml:"enable_export_task,omitempty"`
+	ExportTask                ExportTaskConfig    `json:"export_task,omitempty" yaml:"export_task,omitempty"`
+}
+
+func LoadJobsConfig(loc string) (*JobsConfig, error) {
+	r, err := openLocation(loc)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	bs, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &JobsConfig{}
+	return cfg, gconf.LoadWithEnvBytes(cfg, bs)
+}
+
+func (cfg *JobsConfig) Validate() error {
+	if len(cfg.Jobs) == 0 {
+		return errors.New("jobs are required")
+	}
+	if cfg.Concurrency < 0 {
+		return errors.New("concurrency must be positive")
+	}
+	names := make(map[string]bool, len(cfg.Jobs))
+	for i, job := range cfg.Jobs {
+		if err := job.Validate(); err != nil {
+			return fmt.Errorf("jobs[%d]: %w", i, err)
+		}
+		if job.Schedule != "" {
+			if _, err := cron.ParseStandard(job.Schedule); err != nil {
+				return fmt.Errorf("jobs[%d]: invalid schedule `%s`: %w", i, job.Schedule, err)
+			}
+		}
+		if names[job.name()] {
+			return fmt.Errorf("jobs[%d]: duplicated job name `%s`", i, job.name())
+		}
+		names[job.name()] = true
+	}
+	if cfg.Concurrency > 1 {
+		return cfg.validateSharedResources()
+	}
+	return nil
+}
+
+// validateSharedResources rejects listen addresses and fixed temporary cluster identifiers
+// shared between jobs, which conflict when the jobs run concurrently.
+func (cfg *JobsConfig) validateSharedResources() error {
+	owners := make(map[string]string)
+	for i, job := range cfg.Jobs {
+		c, err := job.loadConfig()
+		if err != nil {
+			return fmt.Errorf("jobs[%d]: %w", i, err)
+		}
+		resources := []struct {
+			name, key, value string
+		}{
+			{"metrics.listen", "listen", c.Metrics.Listen},
+			{"remote_console.listen", "listen", c.RemoteConsole.Listen},
+			{"approval.listen", "listen", c.Approval.Listen},
+			{"temp_cluster.db_cluster_identifier", "temp_cluster", c.TempCluster.DBClusterIdentifier},
+		}
+		for _, r := range resources {
+			if r.value == "" {
+				continue
+			}
+			key := r.key + ":" + r.value
+			if owner, ok := owners[key]; ok && owner != job.name() {
+				return fmt.Errorf("jobs[%d]: %s `%s` is shared with job `%s`, which can not run concurrently", i, r.name, r.value, owner)
+			}
+			owners[key] = job.name()
+		}
+	}
+	return nil
+}
+
+func (cfg *JobConfig) Validate() error {
+	if cfg.Name == "" && cfg.SourceDBClusterIdentifier == "" {
+		return errors.New("either name or source_db_cluster_identifier is required")
+	}
+	if _, err := cfg.loadConfig(); err != nil {
+		return fmt.Errorf("load config `%s`: %w", cfg.Config, err)
+	}
+	return nil
+}
+
+func (cfg *JobConfig) name() string {
+	return coalesceString(cfg.Name, cfg.SourceDBClusterIdentifier)
+}
+
+// loadConfig loads the config of the job. It is loaded at each run, for templates like `now`.
+func (cfg *JobConfig) loadConfig() (*Config, error) {
+	c := DefaultConfig()
+	if cfg.Config != "" {
+		var err error
+		if c, err = LoadConfig(cfg.Config); err != nil {
+			return nil, err
+		}
+	}
+	c.MergeIn(&Config{
+		SourceDBClusterIdentifier: cfg.SourceDBClusterIdentifier,
+		SQLFile:                   cfg.SQLFile,
+		Databases:                 cfg.Databases,
+		Database:                  cfg.Database,
+		EnableExportTask:          cfg.EnableExportTask,
+		ExportTask:                cfg.ExportTask,
+	})
+	if c.SourceDBClusterIdentifier == "" {
+		return nil, errors.New("source db cluster is required")
+	}
+	if c.Interactive {
+		return nil, errors.New("interactive mode is not supported in jobs")
+	}
+	return c, c.Validate()
+}
+
+// JobsReport is the aggregated report of jobs run by Server.RunAll.
+type JobsReport struct {
+	Status     string       `json:"status"`
+	Succeeded  int          `json:"succeeded"`
+	Failed     int          `json:"failed"`
+	Jobs       []*JobReport `json:"jobs"`
+	StartedAt  time.Time    `json:"started_at"`
+	FinishedAt time.Time    `json:"finished_at"`
+}
+
+type JobReport struct {
+	Name   string  `json:"name"`
+	Report *Report `json:"report"`
+}
+
+// RunAll runs all jobs once, at most Concurrency jobs at a time, and returns the aggregated report.
+// Each job cleans up its own temporary resources, and a failed job does not stop the others.
+func (s *Server) RunAll(ctx context.Context) *JobsReport {
+	concurrency := s.cfg.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	report := &JobsReport{
+		Jobs:      make([]*JobReport, len(s.jobs)),
+		StartedAt: flextime.Now(),
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, j := range s.jobs {
+		i, j := i, j
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				report.Jobs[i] = &JobReport{
+					Name: j.cfg.name(),
+					Report: &Report{
+						SourceDBClusterIdentifier: j.cfg.SourceDBClusterIdentifier,
+						Status:                    ReportStatusFailed,
+						Error:                     ctx.Err().Error(),
+					},
+				}
+				return
+			}
+			defer func() { <-sem }()
+			report.Jobs[i] = &JobReport{
+				Name:   j.cfg.name(),
+				Report: s.runJobOnce(ctx, j),
+			}
+		}()
+	}
+	wg.Wait()
+	report.FinishedAt = flextime.Now()
+	report.Status = ReportStatusSucceeded
+	for _, j := range report.Jobs {
+		if j.Report.Status == ReportStatusSucceeded {
+			report.Succeeded++
+		} else {
+			report.Failed++
+			report.Status = ReportStatusFailed
+		}
+	}
+	s.logger.Printf("[info] jobs finished: %d succeeded, %d failed\n", report.Succeeded, report.Failed)
+	if loc := s.cfg.ReportLocation; loc != "" {
+		if err := writeJSONLocation(loc, report); err != nil {
+			s.logger.Printf("[error] write jobs report failed: %s\n", err)
+		} else if loc != "-" {
+			s.logger.Printf("[info] jobs report written to %s\n", loc)
+		}
+	}
+	return report
+}
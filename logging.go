@@ -0,0 +1,210 @@
+package mascaras
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Songmu/flextime"
+)
+
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+// runInfo is the context of a run, attached to each log line in JSON format.
+// It also records the timings of stages for the report.
+type runInfo struct {
+	mu                        sync.Mutex
+	id                        string
+	startedAt                 time.Time
+	stage                     string
+	stages                    []StageReport
+	sourceDBClusterIdentifier string
+	tempDBClusterIdentifier   string
+	tempDBInstanceIdentifier  string
+	err                       error
+}
+
+func newRunInfo(sourceDBClusterIdentifier string) (*runInfo, error) {
+	id, err := randstr(16)
+	if err != nil {
+		return nil, err
+	}
+	now := flextime.Now()
+	return &runInfo{
+		id:        id,
+		startedAt: now,
+		stage:     "prepare",
+		stages: []StageReport{
+			{Name: "prepare", StartedAt: now},
+		},
+		sourceDBClusterIdentifier: sourceDBClusterIdentifier,
+	}, nil
+}
+
+func (r *runInfo) setStage(stage string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := flextime.Now()
+	r.finishStageLocked(now)
+	r.stage = stage
+	r.stages = append(r.stages, StageReport{Name: stage, StartedAt: now})
+}
+
+// finish closes the timing of the current stage.
+func (r *runInfo) finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.finishStageLocked(flextime.Now())
+}
+
+func (r *runInfo) finishStageLocked(now time.Time) {
+	last := &r.stages[len(r.stages)-1]
+	if !last.FinishedAt.IsZero() {
+		return
+	}
+	last.FinishedAt = now
+	last.DurationSeconds = now.Sub(last.StartedAt).Seconds()
+}
+
+func (r *runInfo) stageReports() []StageReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stages := make([]StageReport, len(r.stages))
+	copy(stages, r.stages)
+	return stages
+}
+
+func (r *runInfo) setTempDBClusterIdentifier(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tempDBClusterIdentifier = id
+}
+
+func (r *runInfo) setTempDBInstanceIdentifier(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tempDBInstanceIdentifier = id
+}
+
+func (r *runInfo) setError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = err
+}
+
+func (r *runInfo) currentStage() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stage
+}
+
+func (r *runInfo) addFields(entry map[string]interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry["run_id"] = r.id
+	entry["stage"] = r.stage
+	entry["source_db_cluster_identifier"] = r.sourceDBClusterIdentifier
+	if r.tempDBClusterIdentifier != "" {
+		entry["temp_db_cluster_identifier"] = r.tempDBClusterIdentifier
+	}
+	if r.tempDBInstanceIdentifier != "" {
+		entry["temp_db_instance_identifier"] = r.tempDBInstanceIdentifier
+	}
+	entry["elapsed"] = flextime.Since(r.startedAt).Seconds()
+	if r.err != nil {
+		entry["error"] = r.err.Error()
+	}
+}
+
+// JSONLogWriter is an io.Writer for the log package which converts `[level] message` lines to JSON lines.
+// Lines below MinLevel are discarded.
+type JSONLogWriter struct {
+	mu       *sync.Mutex
+	w        io.Writer
+	minLevel int
+	run      *runInfo
+}
+
+func NewJSONLogWriter(w io.Writer, minLevel string) *JSONLogWriter {
+	return &JSONLogWriter{
+		mu:       &sync.Mutex{},
+		w:        w,
+		minLevel: levelIndex(minLevel),
+	}
+}
+
+// withRun returns the writer which adds the run context fields.
+func (w *JSONLogWriter) withRun(run *runInfo) *JSONLogWriter {
+	return &JSONLogWriter{
+		mu:       w.mu,
+		w:        w.w,
+		minLevel: w.minLevel,
+		run:      run,
+	}
+}
+
+func (w *JSONLogWriter) Write(p []byte) (int, error) {
+	level, message := parseLogLine(p)
+	if level != "" && levelIndex(level) < w.minLevel {
+		return len(p), nil
+	}
+	entry := map[string]interface{}{
+		"time":    flextime.Now().Format(time.RFC3339Nano),
+		"message": message,
+	}
+	if level != "" {
+		entry["level"] = level
+	}
+	if w.run != nil {
+		w.run.addFields(entry)
+	}
+	bs, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.w.Write(append(bs, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// parseLogLine splits a line into the level and the message, in the same manner as logutils.
+func parseLogLine(p []byte) (string, string) {
+	line := bytes.TrimRight(p, "\n")
+	x := bytes.IndexByte(line, '[')
+	if x < 0 {
+		return "", string(line)
+	}
+	y := bytes.IndexByte(line[x:], ']')
+	if y < 0 {
+		return "", string(line)
+	}
+	level := string(line[x+1 : x+y])
+	if levelIndex(level) < 0 {
+		return "", string(line)
+	}
+	return level, string(bytes.TrimLeft(line[x+y+1:], " "))
+}
+
+func levelIndex(level string) int {
+	for i, l := range logLevels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+// newRunLogger returns the logger for the run.
+// If the standard logger writes JSON, the run context is added to each line.
+func newRunLogger(run *runInfo) *log.Logger {
+	if w, ok := log.Writer().(*JSONLogWriter); ok {
+		return log.New(w.withRun(run), "", 0)
+	}
+	return log.Default()
+}
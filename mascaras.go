@@ -9,25 +9,35 @@ import (
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/Songmu/flextime"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/rds"
 	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
-	"github.com/chzyer/readline"
 	"github.com/lestrrat-go/backoff/v2"
 	_ "github.com/lib/pq"
 	"github.com/mashiike/mysqlbatch"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type App struct {
 	rdsSvc       rdsiface.RDSAPI
 	cfg          *Config
 	baseInterval time.Duration
-	newExecuter  func(cfg *Config, dbtype string, host string, port int) (executer, error)
+	newExecuter  func(cfg *Config, dbtype string, database string, host string, port int) (executer, error)
 	stdin        io.ReadCloser
 	stderr       io.Writer
+	logger       *log.Logger
+	run          *runInfo
+	metrics      *runMetrics
+	jobName      string
+
+	notificationSinks []*notificationSink
+	publishSinks      []*publishSink
 }
 
 func New(cfg *Config, cfgs ...*aws.Config) (*App, error) {
@@ -40,13 +50,26 @@ func New(cfg *Config, cfgs ...*aws.Config) (*App, error) {
 	if err != nil {
 		return nil, err
 	}
+	notificationSinks, err := newNotificationSinks(session, cfg.Notifications)
+	if err != nil {
+		return nil, err
+	}
+	publishSinks, err := newPublishSinks(session, cfg.Publish)
+	if err != nil {
+		return nil, err
+	}
+	rdsSvc := rds.New(session, cfgs...)
+	instrumentAWSClient(rdsSvc.Client)
 	return &App{
-		rdsSvc:       rds.New(session, cfgs...),
-		cfg:          cfg,
-		newExecuter:  defaultNewExecuter,
-		baseInterval: time.Minute,
-		stdin:        os.Stdin,
-		stderr:       os.Stderr,
+		rdsSvc:            rdsSvc,
+		cfg:               cfg,
+		newExecuter:       defaultNewExecuter,
+		baseInterval:      time.Minute,
+		stdin:             os.Stdin,
+		stderr:            os.Stderr,
+		logger:            log.Default(),
+		notificationSinks: notificationSinks,
+		publishSinks:      publishSinks,
 	}, err
 }
 
@@ -63,6 +86,34 @@ func readSQL(location string) (string, error) {
 	return string(bs), nil
 }
 
+// maskSQLTarget is SQL files executed on a database of the temporary cluster.
+type maskSQLTarget struct {
+	Database string
+	Files    []maskSQLFile
+	// skipTableStatements is set when tables have been dropped and truncated by a previous step.
+	skipTableStatements bool
+}
+
+type maskSQLFile struct {
+	Location string
+	Content  string
+}
+
+// readMaskSQLTargets reads the contents of SQL files of the targets.
+func readMaskSQLTargets(targets []maskSQLTarget) error {
+	for i := range targets {
+		for j := range targets[i].Files {
+			f := &targets[i].Files[j]
+			content, err := readSQL(f.Location)
+			if err != nil {
+				return err
+			}
+			f.Content = content
+		}
+	}
+	return nil
+}
+
 type cleanupInfo struct {
 	tempDBClusterIdentifier  *string
 	tempDBInstanceIdentifier *string
@@ -76,7 +127,7 @@ type executer interface {
 	Close() error
 }
 
-func defaultNewExecuter(cfg *Config, dbtype string, host string, port int) (executer, error) {
+func defaultNewExecuter(cfg *Config, dbtype string, database string, host string, port int) (executer, error) {
 	switch dbtype {
 	case "mysql":
 		mysqlConfig := &mysqlbatch.Config{
@@ -84,13 +135,13 @@ func defaultNewExecuter(cfg *Config, dbtype string, host string, port int) (exec
 			Host:     host,
 			Password: cfg.DBUserPassword,
 			Port:     port,
-			Database: cfg.Database,
+			Database: database,
 		}
-		executer, err := mysqlbatch.New(mysqlConfig)
+		db, err := sql.Open("mysql", mysqlConfig.GetDSN())
 		if err != nil {
 			return nil, err
 		}
-		return executer, nil
+		return newDBExecuter(db, dbtype), nil
 	case "postgresql":
 		db, err := sql.Open("postgres",
 			fmt.Sprintf(
@@ -99,265 +150,740 @@ func defaultNewExecuter(cfg *Config, dbtype string, host string, port int) (exec
 				host,
 				cfg.DBUserPassword,
 				port,
-				cfg.Database,
+				database,
 				cfg.SSLMode,
 			),
 		)
 		if err != nil {
 			return nil, err
 		}
-		return mysqlbatch.NewWithDB(db), nil
+		return newDBExecuter(db, dbtype), nil
 	}
 	return nil, errors.New("unknown dbtype")
 
 }
 
-func (app *App) Run(ctx context.Context, sourceDBClusterIdentifier string) error {
-	maskSQLFile := app.cfg.SQLFile
-
+func (app *App) Run(ctx context.Context, sourceDBClusterIdentifier string) (report *Report, err error) {
 	if sourceDBClusterIdentifier == "" {
 		sourceDBClusterIdentifier = app.cfg.SourceDBClusterIdentifier
 	}
 	if sourceDBClusterIdentifier == "" {
-		return errors.New("source db cluster is required")
+		return nil, errors.New("source db cluster is required")
 	}
-	var maskSQLExists bool
-	maskSQL := "-- nothing to do\n"
-	if maskSQLFile != "" {
-		var err error
-		maskSQL, err = readSQL(maskSQLFile)
+	run, err := newRunInfo(sourceDBClusterIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	app.run = run
+	app.logger = newRunLogger(run)
+	app.logger.Printf("[info] start run_id=%s source db cluster: %s\n", run.id, sourceDBClusterIdentifier)
+	report = &Report{
+		RunID:                     run.id,
+		SourceDBClusterIdentifier: sourceDBClusterIdentifier,
+		StartedAt:                 run.startedAt,
+	}
+	app.metrics = newRunMetrics(run)
+	if app.cfg.Metrics.Listen != "" {
+		shutdown, err := app.startMetricsServer(app.metrics)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		maskSQLExists = true
+		defer shutdown()
 	}
-	log.Println("[debug] sql:", maskSQL)
-	tempDBClusterIdentifier := app.cfg.TempCluster.DBClusterIdentifier
-	if tempDBClusterIdentifier == "" {
-		rstr, err := randstr(10)
+	ctx, runSpan := tracer().Start(ctx, "mascaras.Run", trace.WithAttributes(
+		attribute.String("mascaras.run_id", run.id),
+		attribute.String("mascaras.source_db_cluster_identifier", sourceDBClusterIdentifier),
+	))
+	defer func() {
+		runSpan.SetAttributes(attribute.String("mascaras.status", report.Status))
+		endSpan(runSpan, err)
+	}()
+	runCtx := ctx
+	ctx, stageSpan := tracer().Start(runCtx, run.currentStage())
+	defer func() {
+		endSpan(stageSpan, err)
+		run.finish()
+		report.Status = ReportStatusSucceeded
 		if err != nil {
-			return err
+			run.setError(err)
+			app.logger.Printf("[error] failed at stage %s: %s\n", run.currentStage(), err)
+			report.Status = ReportStatusFailed
+			report.Error = err.Error()
+			report.FailedStage = run.currentStage()
 		}
-		tempDBClusterIdentifier = app.cfg.TempCluster.DBClusterIdentifierPrefix + "-" + rstr
+		report.Stages = run.stageReports()
+		report.FinishedAt = flextime.Now()
+		if err := app.writeReport(report); err != nil {
+			app.logger.Printf("[error] write report failed: %s\n", err)
+		}
+		app.metrics.finish(err == nil)
+		if app.cfg.Metrics.PushgatewayURL != "" {
+			if err := app.pushMetrics(app.metrics); err != nil {
+				app.logger.Printf("[error] push metrics failed: %s\n", err)
+			}
+		}
+		if err != nil {
+			app.notify(NotificationEventFailure, report.FailedStage, report)
+		} else {
+			app.notify(NotificationEventSuccess, "", report)
+		}
+	}()
+	app.notify(NotificationEventStart, run.currentStage(), report)
+	setStage := func(stage string) {
+		stageSpan.End()
+		ctx, stageSpan = tracer().Start(runCtx, stage)
+		run.setStage(stage)
+		app.notify(NotificationEventStage, stage, report)
 	}
-	restoreOutput, err := app.rdsSvc.RestoreDBClusterToPointInTimeWithContext(ctx, &rds.RestoreDBClusterToPointInTimeInput{
-		SourceDBClusterIdentifier: &sourceDBClusterIdentifier,
-		DBClusterIdentifier:       &tempDBClusterIdentifier,
-		RestoreType:               aws.String("copy-on-write"),
-		UseLatestRestorableTime:   aws.Bool(true),
-		VpcSecurityGroupIds:       aws.StringSlice(app.cfg.TempCluster.securityGroupIDs()),
-	})
+	maskSQLTargets := app.cfg.maskSQLTargets()
+	if err := readMaskSQLTargets(maskSQLTargets); err != nil {
+		return report, err
+	}
+	report.SQLFiles = sqlFileReports(maskSQLTargets)
+	var classification classification
+	if app.cfg.ClassificationFile != "" {
+		if classification, err = readClassification(app.cfg.ClassificationFile); err != nil {
+			return report, err
+		}
+	}
+	for _, t := range maskSQLTargets {
+		for _, f := range t.Files {
+			app.logger.Printf("[debug] sql `%s`: %s\n", f.Location, f.Content)
+		}
+	}
+	tempDBClusterIdentifier, err := app.newTempDBClusterIdentifier()
 	if err != nil {
-		return fmt.Errorf("RestoreDBClusterToPointInTime:%w", err)
+		return report, err
 	}
-	var dbtype string
-	switch *restoreOutput.DBCluster.Engine {
-	case "aurora", "aurora-mysql": // aurora (for MySQL 5.6-compatible Aurora), aurora-mysql (for MySQL 5.7-compatible Aurora)
-		dbtype = "mysql"
-	case "aurora-postgresql":
-		dbtype = "postgresql"
-	default:
-		log.Printf("[warn] unknown engine `%s` mascaras don't know. decided that it was a MySQL type DB.\n", *restoreOutput.DBCluster.Engine)
-		dbtype = "mysql"
+	run.setTempDBClusterIdentifier(tempDBClusterIdentifier)
+	report.TempDBClusterIdentifier = tempDBClusterIdentifier
+	runSpan.SetAttributes(attribute.String("mascaras.temp_db_cluster_identifier", tempDBClusterIdentifier))
+	names, err := app.resourceNames(tempDBClusterIdentifier)
+	if err != nil {
+		return report, err
+	}
+	setStage("restore")
+	report.RestoreTime = app.latestRestorableTime(ctx, sourceDBClusterIdentifier)
+	restoredDBCluster, err := app.restoreDBCluster(ctx, sourceDBClusterIdentifier, tempDBClusterIdentifier, report.RestoreTime)
+	if err != nil {
+		return report, err
 	}
+	report.Engine = *restoredDBCluster.Engine
+	runSpan.SetAttributes(attribute.String("mascaras.engine", report.Engine))
+	dbtype := app.dbType(report.Engine)
 	cleanupInfo := &cleanupInfo{
 		tempDBClusterIdentifier: &tempDBClusterIdentifier,
 	}
 	defer func() {
+		if err != nil {
+			run.setError(err)
+		}
 		if err := app.cleanup(cleanupInfo); err != nil {
-			log.Printf("[error] cleanup failed: %s", err.Error())
+			app.logger.Printf("[error] cleanup failed: %s", err.Error())
 		}
 	}()
-	log.Printf("[info] cloned db cluster: %s\n", *restoreOutput.DBCluster.DBClusterArn)
-	tempDBInstanceIdentifier := tempDBClusterIdentifier + "-instance"
+	app.logger.Printf("[info] cloned db cluster: %s\n", *restoredDBCluster.DBClusterArn)
+	tempDBInstanceIdentifier := tempDBInstanceIdentifierOf(tempDBClusterIdentifier)
+	run.setTempDBInstanceIdentifier(tempDBInstanceIdentifier)
+	report.TempDBInstanceIdentifier = tempDBInstanceIdentifier
+	runSpan.SetAttributes(attribute.String("mascaras.temp_db_instance_identifier", tempDBInstanceIdentifier))
+	setStage("create_instance")
 
-	createInstanceOutput, err := app.rdsSvc.CreateDBInstanceWithContext(ctx, &rds.CreateDBInstanceInput{
-		DBClusterIdentifier:  &tempDBClusterIdentifier,
-		DBInstanceIdentifier: &tempDBInstanceIdentifier,
-		DBInstanceClass:      &app.cfg.TempCluster.DBInstanceClass,
-		Engine:               restoreOutput.DBCluster.Engine,
-		PubliclyAccessible:   &app.cfg.TempCluster.PubliclyAccessible,
-	})
+	createdDBInstance, err := app.createDBInstance(ctx, tempDBClusterIdentifier, tempDBInstanceIdentifier, report.Engine)
 	if err != nil {
-		return err
+		return report, err
 	}
-	log.Printf("[info] create db instance: %s\n", *createInstanceOutput.DBInstance.DBInstanceArn)
+	app.logger.Printf("[info] create db instance: %s\n", *createdDBInstance.DBInstanceArn)
 	cleanupInfo.tempDBInstanceIdentifier = &tempDBInstanceIdentifier
 
+	setStage("wait_available")
 	tempDBCluster, err := app.waitDBClusterAvailable(ctx, tempDBClusterIdentifier)
 	if err != nil {
-		return err
+		return report, err
 	}
 	_, err = app.waitDBInstanceAvailable(ctx, tempDBInstanceIdentifier)
 	if err != nil {
-		return err
+		return report, err
 	}
 	tempDBClusterEndpoint, err := app.waitDBClusterEndpointAvailable(ctx, tempDBClusterIdentifier)
 	if err != nil {
-		return err
+		return report, err
 	}
-	if maskSQLExists || app.cfg.Interactive {
-		maskedTime, err := app.executeSQL(ctx, dbtype, maskSQL, maskSQLFile, *tempDBCluster.DBClusterIdentifier, *tempDBClusterEndpoint.Endpoint, int(*tempDBCluster.Port))
+	if app.cfg.Subset.enabled() {
+		setStage("subset")
+		tables, subsetTime, err := app.subset(ctx, dbtype, *tempDBClusterEndpoint.Endpoint, int(*tempDBCluster.Port))
+		report.SubsetTables = tables
 		if err != nil {
-			return err
+			return report, err
 		}
-		if err := app.waitDBClusterLatestRestorableTime(ctx, tempDBClusterIdentifier, maskedTime); err != nil {
-			return err
+		report.MaskedTime = aws.Time(subsetTime)
+	}
+	if app.cfg.ClassificationFile != "" {
+		setStage("check_classification")
+		report.UnclassifiedColumns, err = app.checkClassification(ctx, classification, dbtype, *tempDBClusterEndpoint.Endpoint, int(*tempDBCluster.Port))
+		if err != nil {
+			return report, err
 		}
 	}
-	snapshotIdentifer := tempDBClusterIdentifier + "-snapshot"
-	log.Println("[info] create snapshot:", snapshotIdentifer)
-	snapshotOutput, err := app.rdsSvc.CreateDBClusterSnapshotWithContext(ctx, &rds.CreateDBClusterSnapshotInput{
-		DBClusterIdentifier:         &tempDBClusterIdentifier,
-		DBClusterSnapshotIdentifier: &snapshotIdentifer,
-	})
+	var result *sqlResult
+	if len(maskSQLTargets) > 0 || app.cfg.Interactive {
+		setStage("execute_sql")
+		if len(maskSQLTargets) == 0 {
+			maskSQLTargets = []maskSQLTarget{{
+				Database: app.cfg.Database,
+				Files:    []maskSQLFile{{Content: "-- nothing to do\n"}},
+			}}
+		}
+		result, err = app.executeSQL(ctx, dbtype, maskSQLTargets, *tempDBCluster.DBClusterIdentifier, *tempDBClusterEndpoint.Endpoint, int(*tempDBCluster.Port))
+		if result != nil {
+			report.Statements = result.Statements
+		}
+		if err != nil {
+			return report, err
+		}
+		app.deleteChunkState()
+		report.MaskedTime = aws.Time(result.LastExecuteTime)
+	}
+	if app.cfg.TempCluster.scaleDownRequired() {
+		// the instance is created with the SQL class, which is used by the subset as well.
+		setStage("scale_down")
+		if err := app.scaleDown(ctx, tempDBClusterIdentifier, tempDBInstanceIdentifier); err != nil {
+			return report, err
+		}
+	}
+	if app.cfg.EnableApproval {
+		setStage("approval")
+		summary := &approvalSummary{
+			RunID:                     report.RunID,
+			SourceDBClusterIdentifier: sourceDBClusterIdentifier,
+			TempDBClusterIdentifier:   tempDBClusterIdentifier,
+			SQLFiles:                  report.SQLFiles,
+		}
+		if report.MaskedTime != nil {
+			summary.MaskedTime = *report.MaskedTime
+		}
+		if result != nil {
+			summary.Statements = result.Statements
+			summary.TotalRowsAffected = result.totalRowsAffected()
+		}
+		if err := app.inspectMaskedData(ctx, summary, dbtype, *tempDBClusterEndpoint.Endpoint, int(*tempDBCluster.Port)); err != nil {
+			return report, err
+		}
+		if err := app.waitApproval(ctx, summary); err != nil {
+			return report, err
+		}
+	}
+	if app.cfg.Dump.enabled() {
+		setStage("dump")
+		tables, err := app.dump(ctx, dbtype, names.DumpLocation, *tempDBClusterEndpoint.Endpoint, int(*tempDBCluster.Port))
+		report.DumpTables = tables
+		if err != nil {
+			return report, err
+		}
+		if app.cfg.Dump.SkipSnapshot {
+			setStage("cleanup")
+			return report, nil
+		}
+	}
+	if report.MaskedTime != nil {
+		setStage("wait_restorable")
+		if err := app.waitDBClusterLatestRestorableTime(ctx, tempDBClusterIdentifier, *report.MaskedTime); err != nil {
+			return report, err
+		}
+	}
+	setStage("create_snapshot")
+	snapshotIdentifer := names.SnapshotIdentifier
+	if names.OriginalSnapshotIdentifier != "" {
+		// the original is copied to the snapshot identifier in the copy_snapshot stage.
+		snapshotIdentifer = names.OriginalSnapshotIdentifier
+	}
+	app.logger.Println("[info] create snapshot:", snapshotIdentifer)
+	report.SnapshotIdentifier = snapshotIdentifer
+	createdSnapshot, err := app.createDBClusterSnapshot(ctx, tempDBClusterIdentifier, snapshotIdentifer)
 	if err != nil {
-		return err
+		return report, err
 	}
-	log.Println("[info] success arn =", *snapshotOutput.DBClusterSnapshot.DBClusterSnapshotArn)
-	if !app.cfg.EnableExportTask {
-		return nil
+	app.logger.Println("[info] success arn =", *createdSnapshot.DBClusterSnapshotArn)
+	report.SnapshotArn = *createdSnapshot.DBClusterSnapshotArn
+	runSpan.SetAttributes(attribute.String("mascaras.snapshot_arn", report.SnapshotArn))
+	setStage("cleanup")
+	if !app.snapshotWaitRequired() {
+		return report, nil
 	}
 	if err := app.cleanup(cleanupInfo); err != nil {
-		return err
+		return report, err
+	}
+	setStage("wait_snapshot")
+	if _, err := app.waitDBClusterSnapshot(ctx, snapshotIdentifer); err != nil {
+		return report, err
+	}
+	if app.cfg.Snapshot.copyRequired() {
+		setStage("copy_snapshot")
+		copiedIdentifier := names.SnapshotIdentifier
+		copied, err := app.copyDBClusterSnapshot(ctx, snapshotIdentifer, copiedIdentifier)
+		if err != nil {
+			return report, err
+		}
+		report.OriginalSnapshotIdentifier = snapshotIdentifer
+		report.OriginalSnapshotArn = report.SnapshotArn
+		report.SnapshotIdentifier = copiedIdentifier
+		report.SnapshotArn = *copied.DBClusterSnapshotArn
+		runSpan.SetAttributes(attribute.String("mascaras.snapshot_arn", report.SnapshotArn))
+		setStage("wait_snapshot_copy")
+		if _, err := app.waitDBClusterSnapshot(ctx, copiedIdentifier); err != nil {
+			return report, err
+		}
+		if app.cfg.Snapshot.DeleteOriginal {
+			if err := app.deleteDBClusterSnapshot(ctx, snapshotIdentifer); err != nil {
+				return report, err
+			}
+		}
+		snapshotIdentifer = copiedIdentifier
+	}
+	if app.cfg.EnableExportTask {
+		app.logger.Println("[info] snapshot export to s3 enable")
+		taskIdentifier := exportTaskIdentifierOf(names.ExportTaskIdentifier, snapshotIdentifer)
+		setStage("export_task")
+		if err := app.startExportTask(ctx, taskIdentifier, report.SnapshotArn); err != nil {
+			return report, err
+		}
+		report.ExportTaskIdentifier = taskIdentifier
+	}
+	if len(app.publishSinks) > 0 {
+		setStage("publish")
+		if err := app.publish(ctx, &SnapshotPublication{
+			SourceDBClusterIdentifier: sourceDBClusterIdentifier,
+			SnapshotIdentifier:        report.SnapshotIdentifier,
+			SnapshotArn:               report.SnapshotArn,
+			RunID:                     report.RunID,
+			Engine:                    report.Engine,
+			MaskedTime:                report.MaskedTime,
+			ExportTaskIdentifier:      report.ExportTaskIdentifier,
+		}, tempDBClusterIdentifier); err != nil {
+			return report, err
+		}
+	}
+	if app.cfg.Target.enabled() {
+		targetNames := targetClusterNamesOf(app.cfg.Target.DBClusterIdentifier, run.id)
+		setStage("restore_target")
+		if err := app.restoreTargetCluster(ctx, targetNames, report.SnapshotIdentifier, report.Engine); err != nil {
+			app.cleanupTargetGreenOnError(targetNames)
+			return report, err
+		}
+		setStage("wait_target")
+		if _, err := app.waitDBClusterAvailable(ctx, targetNames.Green); err != nil {
+			app.cleanupTargetGreenOnError(targetNames)
+			return report, err
+		}
+		if _, err := app.waitDBInstanceAvailable(ctx, tempDBInstanceIdentifierOf(targetNames.Green)); err != nil {
+			app.cleanupTargetGreenOnError(targetNames)
+			return report, err
+		}
+		setStage("swap_target")
+		if err := app.waitTargetClusterSwapped(ctx, targetNames); err != nil {
+			app.cleanupTargetGreenOnError(targetNames)
+			return report, err
+		}
+		report.TargetDBClusterIdentifier = targetNames.Target
+		setStage("delete_old_target")
+		if err := app.deleteDBClusterWithInstances(ctx, targetNames.Old); err != nil {
+			return report, err
+		}
+	}
+	app.logger.Println("[info] all finish.")
+	return report, nil
+}
+
+func (app *App) newTempDBClusterIdentifier() (string, error) {
+	if app.cfg.TempCluster.DBClusterIdentifier != "" {
+		return app.cfg.TempCluster.DBClusterIdentifier, nil
 	}
-	log.Println("[info] snapshot export to s3 enable")
-	snapshot, err := app.waitDBClusterSnapshot(ctx, snapshotIdentifer)
+	rstr, err := randstr(10)
 	if err != nil {
-		return err
+		return "", err
 	}
-	taskIdentifier := app.cfg.ExportTask.TaskIdentifier
-	if taskIdentifier == "" {
-		taskIdentifier = snapshotIdentifer + "-export-task"
+	return app.cfg.TempCluster.DBClusterIdentifierPrefix + "-" + rstr, nil
+}
+
+func tempDBInstanceIdentifierOf(tempDBClusterIdentifier string) string {
+	return tempDBClusterIdentifier + "-instance"
+}
+
+func snapshotIdentifierOf(tempDBClusterIdentifier string) string {
+	return tempDBClusterIdentifier + "-snapshot"
+}
+
+// originalSnapshotIdentifierOf returns the identifier of the original snapshot, which is copied to the snapshot identifier.
+func originalSnapshotIdentifierOf(snapshotIdentifier string) string {
+	return snapshotIdentifier + "-original"
+}
+
+// exportTaskIdentifierOf returns the rendered export task identifier, or the default derived from the snapshot identifier.
+func exportTaskIdentifierOf(exportTaskIdentifier, snapshotIdentifier string) string {
+	return coalesceString(exportTaskIdentifier, snapshotIdentifier+"-export-task")
+}
+
+// dbType returns the executer type for the engine.
+func (app *App) dbType(engine string) string {
+	switch engine {
+	case "aurora", "aurora-mysql": // aurora (for MySQL 5.6-compatible Aurora), aurora-mysql (for MySQL 5.7-compatible Aurora)
+		return "mysql"
+	case "aurora-postgresql":
+		return "postgresql"
 	}
-	log.Printf("[info] start export task, export task identifier=%s\n", taskIdentifier)
-	taskOutput, err := app.rdsSvc.StartExportTaskWithContext(ctx, &rds.StartExportTaskInput{
-		ExportTaskIdentifier: &taskIdentifier,
-		IamRoleArn:           &app.cfg.ExportTask.IAMRoleArn,
-		KmsKeyId:             &app.cfg.ExportTask.KMSKeyId,
-		S3BucketName:         &app.cfg.ExportTask.S3Bucket,
-		S3Prefix:             aws.String(app.cfg.ExportTask.S3Prefix),
-		ExportOnly:           aws.StringSlice(app.cfg.ExportTask.exportOnly()),
-		SourceArn:            snapshot.DBClusterSnapshotArn,
-	})
-	if taskOutput.FailureCause != nil {
-		log.Printf("[warn] failure cause: %s\n", *taskOutput.FailureCause)
+	app.logger.Printf("[warn] unknown engine `%s` mascaras don't know. decided that it was a MySQL type DB.\n", engine)
+	return "mysql"
+}
+
+// resourceTags returns the tags of temporary resources, to find orphans.
+func (app *App) resourceTags() []*rds.Tag {
+	tags := []*rds.Tag{
+		{Key: aws.String(tagKeyRunID), Value: aws.String(app.run.id)},
+		{Key: aws.String(tagKeySourceDBClusterIdentifier), Value: aws.String(app.run.sourceDBClusterIdentifier)},
 	}
-	if taskOutput.WarningMessage != nil {
-		log.Printf("[warn] %s\n", *taskOutput.WarningMessage)
+	if app.jobName != "" {
+		tags = append(tags, &rds.Tag{Key: aws.String(tagKeyJob), Value: aws.String(app.jobName)})
 	}
+	return tags
+}
+
+// tagValue returns the value of the tag of the key, or empty if not found.
+func tagValue(tags []*rds.Tag, key string) string {
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) == key {
+			return aws.StringValue(tag.Value)
+		}
+	}
+	return ""
+}
+
+// restoreDBCluster clones the source cluster at restoreTime, or the latest restorable time if restoreTime is nil.
+func (app *App) restoreDBCluster(ctx context.Context, sourceDBClusterIdentifier, tempDBClusterIdentifier string, restoreTime *time.Time) (*rds.DBCluster, error) {
+	var useLatestRestorableTime *bool
+	if restoreTime == nil {
+		useLatestRestorableTime = aws.Bool(true)
+	}
+	output, err := app.rdsSvc.RestoreDBClusterToPointInTimeWithContext(ctx, &rds.RestoreDBClusterToPointInTimeInput{
+		SourceDBClusterIdentifier:        &sourceDBClusterIdentifier,
+		DBClusterIdentifier:              &tempDBClusterIdentifier,
+		RestoreType:                      aws.String("copy-on-write"),
+		RestoreToTime:                    restoreTime,
+		UseLatestRestorableTime:          useLatestRestorableTime,
+		VpcSecurityGroupIds:              aws.StringSlice(app.cfg.TempCluster.securityGroupIDs()),
+		DBSubnetGroupName:                stringOrNil(app.cfg.TempCluster.DBSubnetGroupName),
+		DBClusterParameterGroupName:      stringOrNil(app.cfg.TempCluster.DBClusterParameterGroupName),
+		KmsKeyId:                         stringOrNil(app.cfg.TempCluster.KmsKeyID),
+		Port:                             app.cfg.TempCluster.port(),
+		EnableIAMDatabaseAuthentication:  app.cfg.TempCluster.enableIAMDatabaseAuthentication(),
+		Tags:                             app.resourceTags(),
+		ServerlessV2ScalingConfiguration: serverlessV2ScalingConfiguration(app.cfg.TempCluster.initialCapacity()),
+	})
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("RestoreDBClusterToPointInTime:%w", err)
 	}
-	log.Println("[info] all finish.")
-	return nil
+	return output.DBCluster, nil
 }
 
-func (app *App) executeSQL(ctx context.Context, dbtype string, maskSQL, maskSQLLoc string, hostID, host string, port int) (time.Time, error) {
-	executer, err := app.newExecuter(app.cfg, dbtype, host, port)
+func (app *App) createDBInstance(ctx context.Context, tempDBClusterIdentifier, tempDBInstanceIdentifier, engine string) (*rds.DBInstance, error) {
+	output, err := app.rdsSvc.CreateDBInstanceWithContext(ctx, &rds.CreateDBInstanceInput{
+		DBClusterIdentifier:  &tempDBClusterIdentifier,
+		DBInstanceIdentifier: &tempDBInstanceIdentifier,
+		DBInstanceClass:      aws.String(app.cfg.TempCluster.initialDBInstanceClass()),
+		Engine:               &engine,
+		PubliclyAccessible:   &app.cfg.TempCluster.PubliclyAccessible,
+		DBParameterGroupName: stringOrNil(app.cfg.TempCluster.DBParameterGroupName),
+		AvailabilityZone:     stringOrNil(app.cfg.TempCluster.AvailabilityZone),
+		Tags:                 app.resourceTags(),
+	})
 	if err != nil {
-		return time.Time{}, err
+		return nil, err
 	}
-	defer executer.Close()
-	executer.SetTableSelectHook(func(query, table string) {
-		log.Printf("[info] Query: %s\n%s\n", query, table)
+	return output.DBInstance, nil
+}
+
+// modifyDBInstanceClass starts modifying the instance class immediately.
+func (app *App) modifyDBInstanceClass(ctx context.Context, dbInstanceIdentifier, dbInstanceClass string) error {
+	app.logger.Printf("[info] modify db instance `%s` class to %s\n", dbInstanceIdentifier, dbInstanceClass)
+	_, err := app.rdsSvc.ModifyDBInstanceWithContext(ctx, &rds.ModifyDBInstanceInput{
+		DBInstanceIdentifier: &dbInstanceIdentifier,
+		DBInstanceClass:      &dbInstanceClass,
+		ApplyImmediately:     aws.Bool(true),
 	})
-	log.Printf("[info] start do sql `%s`\n", maskSQLLoc)
-	if err := executer.ExecuteContext(ctx, strings.NewReader(maskSQL)); err != nil {
-		return executer.LastExecuteTime(), err
+	return err
+}
+
+// serverlessV2ScalingConfiguration returns the Aurora Serverless v2 scaling configuration, or nil if the capacity is not set.
+func serverlessV2ScalingConfiguration(min, max float64) *rds.ServerlessV2ScalingConfiguration {
+	if min == 0 && max == 0 {
+		return nil
+	}
+	return &rds.ServerlessV2ScalingConfiguration{
+		MinCapacity: aws.Float64(min),
+		MaxCapacity: aws.Float64(max),
 	}
-	log.Println("[info] end do sql")
-	if app.cfg.Interactive {
-		log.Println("[info] start interactive")
-		if err := app.executePrompt(ctx, executer, hostID); err != nil {
-			return executer.LastExecuteTime(), err
+}
+
+// modifyDBClusterCapacity starts modifying the Aurora Serverless v2 capacity range immediately.
+func (app *App) modifyDBClusterCapacity(ctx context.Context, dbClusterIdentifier string, min, max float64) error {
+	app.logger.Printf("[info] modify db cluster `%s` capacity to %g-%g ACU\n", dbClusterIdentifier, min, max)
+	_, err := app.rdsSvc.ModifyDBClusterWithContext(ctx, &rds.ModifyDBClusterInput{
+		DBClusterIdentifier:              &dbClusterIdentifier,
+		ServerlessV2ScalingConfiguration: serverlessV2ScalingConfiguration(min, max),
+		ApplyImmediately:                 aws.Bool(true),
+	})
+	return err
+}
+
+// scaleDown modifies the capacity and the instance class for the rest of the run after executing SQL or the subset,
+// and waits for the modifications.
+func (app *App) scaleDown(ctx context.Context, dbClusterIdentifier, dbInstanceIdentifier string) error {
+	cfg := app.cfg.TempCluster
+	if cfg.capacityScaleDownRequired() {
+		if err := app.modifyDBClusterCapacity(ctx, dbClusterIdentifier, cfg.MinCapacity, cfg.MaxCapacity); err != nil {
+			return err
+		}
+		if _, err := app.waitDBClusterCapacityModified(ctx, dbClusterIdentifier, cfg.MinCapacity, cfg.MaxCapacity); err != nil {
+			return err
+		}
+	}
+	if cfg.instanceScaleDownRequired() {
+		if err := app.modifyDBInstanceClass(ctx, dbInstanceIdentifier, cfg.DBInstanceClass); err != nil {
+			return err
+		}
+		if _, err := app.waitDBInstanceModified(ctx, dbInstanceIdentifier, cfg.DBInstanceClass); err != nil {
+			return err
 		}
-		log.Println("[info] end interactive")
 	}
-	return executer.LastExecuteTime(), nil
+	return nil
 }
 
-var completer = readline.NewPrefixCompleter(
-	readline.PcItem("help",
-		readline.PcItem("abort"),
-		readline.PcItem("exit"),
-	),
-	readline.PcItem("abort"),
-	readline.PcItem("exit"),
-)
+func (app *App) createDBClusterSnapshot(ctx context.Context, tempDBClusterIdentifier, snapshotIdentifier string) (*rds.DBClusterSnapshot, error) {
+	output, err := app.rdsSvc.CreateDBClusterSnapshotWithContext(ctx, &rds.CreateDBClusterSnapshotInput{
+		DBClusterIdentifier:         &tempDBClusterIdentifier,
+		DBClusterSnapshotIdentifier: &snapshotIdentifier,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.DBClusterSnapshot, nil
+}
 
-func (app *App) executePrompt(ctx context.Context, executer executer, dbClusterIdentifier string) error {
-	l, err := readline.NewEx(&readline.Config{
-		Prompt:            fmt.Sprintf("aurora[%s]>", dbClusterIdentifier),
-		HistoryFile:       "/tmp/readline.tmp",
-		AutoComplete:      completer,
-		InterruptPrompt:   "^C",
-		EOFPrompt:         "exit",
-		Stdin:             app.stdin,
-		Stderr:            app.stderr,
-		HistorySearchFold: true,
+// copyDBClusterSnapshot copies the snapshot with snapshot.kms_key_id, to re-encrypt it.
+func (app *App) copyDBClusterSnapshot(ctx context.Context, sourceSnapshotIdentifier, targetSnapshotIdentifier string) (*rds.DBClusterSnapshot, error) {
+	app.logger.Printf("[info] copy snapshot `%s` to `%s` with kms key %s\n", sourceSnapshotIdentifier, targetSnapshotIdentifier, app.cfg.Snapshot.KmsKeyID)
+	output, err := app.rdsSvc.CopyDBClusterSnapshotWithContext(ctx, &rds.CopyDBClusterSnapshotInput{
+		SourceDBClusterSnapshotIdentifier: &sourceSnapshotIdentifier,
+		TargetDBClusterSnapshotIdentifier: &targetSnapshotIdentifier,
+		KmsKeyId:                          &app.cfg.Snapshot.KmsKeyID,
 	})
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("CopyDBClusterSnapshot:%w", err)
 	}
-	defer l.Close()
-	executer.SetTableSelectHook(func(_, table string) {
-		fmt.Fprintln(l.Stderr(), "\n"+table)
+	app.logger.Println("[info] success copy arn =", *output.DBClusterSnapshot.DBClusterSnapshotArn)
+	return output.DBClusterSnapshot, nil
+}
+
+func (app *App) deleteDBClusterSnapshot(ctx context.Context, snapshotIdentifier string) error {
+	app.logger.Printf("[info] delete original snapshot `%s`\n", snapshotIdentifier)
+	_, err := app.rdsSvc.DeleteDBClusterSnapshotWithContext(ctx, &rds.DeleteDBClusterSnapshotInput{
+		DBClusterSnapshotIdentifier: &snapshotIdentifier,
 	})
-	executer.SetExecuteHook(func(_ string, rowsAffected int64, lastInsertId int64) {
-		fmt.Fprintf(l.Stderr(), "\nQuery OK, %d rowsAffected\nLast insert id = %d\n", rowsAffected, lastInsertId)
+	if err != nil {
+		return fmt.Errorf("DeleteDBClusterSnapshot:%w", err)
+	}
+	return nil
+}
+
+func (app *App) startExportTask(ctx context.Context, taskIdentifier, snapshotArn string) error {
+	app.logger.Printf("[info] start export task, export task identifier=%s\n", taskIdentifier)
+	output, err := app.rdsSvc.StartExportTaskWithContext(ctx, &rds.StartExportTaskInput{
+		ExportTaskIdentifier: &taskIdentifier,
+		IamRoleArn:           &app.cfg.ExportTask.IAMRoleArn,
+		KmsKeyId:             &app.cfg.ExportTask.KMSKeyId,
+		S3BucketName:         &app.cfg.ExportTask.S3Bucket,
+		S3Prefix:             aws.String(app.cfg.ExportTask.S3Prefix),
+		ExportOnly:           aws.StringSlice(app.cfg.ExportTask.exportOnly()),
+		SourceArn:            &snapshotArn,
+	})
+	if output != nil {
+		if output.FailureCause != nil {
+			app.logger.Printf("[warn] failure cause: %s\n", *output.FailureCause)
+		}
+		if output.WarningMessage != nil {
+			app.logger.Printf("[warn] %s\n", *output.WarningMessage)
+		}
+	}
+	return err
+}
+
+// latestRestorableTime returns LatestRestorableTime of the source db cluster, that is the restore time of the clone.
+func (app *App) latestRestorableTime(ctx context.Context, dbClusterIdentifier string) *time.Time {
+	output, err := app.rdsSvc.DescribeDBClustersWithContext(ctx, &rds.DescribeDBClustersInput{
+		DBClusterIdentifier: &dbClusterIdentifier,
 	})
-	var buf strings.Builder
-	log.Println("[info] ")
-	log.Println("[info] Use the `exit` or` abort` command to escape from Prompt.")
-	log.Println("[info] Enter `help` command for more information.")
-	log.Println("[info] Note: `^C` behaves the same as the `abort` command.")
-	l.SetVimMode(false)
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-		}
-		line, err := l.Readline()
-		if err == readline.ErrInterrupt {
-			if len(line) == 0 {
-				fmt.Fprintln(l.Stderr(), err)
-				return nil
-			} else {
+	if err != nil {
+		app.logger.Printf("[warn] describe source db cluster `%s`: %s\n", dbClusterIdentifier, err)
+		return nil
+	}
+	if len(output.DBClusters) == 0 {
+		return nil
+	}
+	return output.DBClusters[0].LatestRestorableTime
+}
+
+type sqlResult struct {
+	mu              sync.Mutex
+	LastExecuteTime time.Time
+	Statements      []StatementReport
+}
+
+// executed updates LastExecuteTime by the executer, which is the latest of all executers.
+func (r *sqlResult) executed(e executer) {
+	r.executedAt(e.LastExecuteTime())
+}
+
+func (r *sqlResult) executedAt(t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t.After(r.LastExecuteTime) {
+		r.LastExecuteTime = t
+	}
+}
+
+func (r *sqlResult) addStatement(s StatementReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Statements = append(r.Statements, s)
+}
+
+func (r *sqlResult) totalRowsAffected() int64 {
+	var total int64
+	for _, s := range r.Statements {
+		total += s.RowsAffected
+	}
+	return total
+}
+
+// sqlSession executes SQL on a database of the temporary cluster.
+type sqlSession struct {
+	dbtype   string
+	database string
+	result   *sqlResult
+	chunks   *chunkState
+	// open opens another executer of the database, for parallel sections.
+	open func() (executer, error)
+}
+
+// executeSQL executes SQL files of the targets, opening an executer for each database.
+// In the interactive mode, the prompt is started on the database of the first target after all SQL files are executed.
+func (app *App) executeSQL(ctx context.Context, dbtype string, targets []maskSQLTarget, hostID, host string, port int) (*sqlResult, error) {
+	result := &sqlResult{}
+	chunkState, err := loadChunkState(app.cfg.Chunk.StateLocation, app.run.id, hostID)
+	if err != nil {
+		return result, fmt.Errorf("load chunk state: %w", err)
+	}
+	var promptExecuter executer
+	for i, t := range targets {
+		sess := &sqlSession{
+			dbtype:   dbtype,
+			database: t.Database,
+			result:   result,
+			chunks:   chunkState,
+		}
+		sess.open = func() (executer, error) {
+			return app.openExecuter(ctx, result, dbtype, sess.database, host, port)
+		}
+		e, err := sess.open()
+		if err != nil {
+			return result, err
+		}
+		if !t.skipTableStatements {
+			err = app.executeTableStatements(ctx, e, sess)
+		}
+		if err == nil {
+			err = app.executeSQLFiles(ctx, e, t, sess)
+		}
+		result.executed(e)
+		if i == 0 && app.cfg.Interactive {
+			promptExecuter = e
+			defer e.Close()
+		} else {
+			e.Close()
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+	if promptExecuter != nil {
+		app.logger.Println("[info] start interactive")
+		err := app.executePrompt(ctx, promptExecuter, hostID)
+		result.executed(promptExecuter)
+		if err != nil {
+			return result, err
+		}
+		app.logger.Println("[info] end interactive")
+	}
+	return result, nil
+}
+
+// executeSQLFiles executes SQL files of the target on the executer.
+func (app *App) executeSQLFiles(ctx context.Context, e executer, target maskSQLTarget, sess *sqlSession) error {
+	for _, f := range target.Files {
+		if f.Location != "" {
+			app.logger.Printf("[info] start do sql `%s` on database `%s`\n", f.Location, target.Database)
+		}
+		for _, b := range splitSQLBlocks(f.Content) {
+			if b.parallel {
+				if err := app.executeParallel(ctx, b.sections, sess); err != nil {
+					return err
+				}
 				continue
 			}
-		} else if err == io.EOF {
-			return nil
-		}
-		line = strings.TrimSpace(line)
-		switch {
-		case strings.HasPrefix(line, "help"):
-			fmt.Fprintln(l.Stderr(), "commands:")
-			fmt.Fprintln(l.Stderr(), "\tabort:\tExit prompt as abnormal. Does not create a snapshot")
-			fmt.Fprintln(l.Stderr(), "\texit:\tExit prompt as successful, continue creating Snapshot")
-			fmt.Fprintln(l.Stderr(), "")
-		case line == "abort":
-			fmt.Fprintln(l.Stderr(), "abort prompt.")
-			return errors.New("prompt abort")
-		case line == "exit":
-			fmt.Fprintln(l.Stderr(), "exit prompt.")
-			return nil
-		default:
-			buf.WriteString(line)
-			if strings.ContainsRune(line, ';') {
-				func() {
-					if err := executer.ExecuteContext(ctx, strings.NewReader(buf.String())); err != nil {
-						fmt.Fprintln(l.Stderr(), err)
-					}
-					buf.Reset()
-				}()
+			if err := app.executeSQLText(ctx, e, b.sections[0], sess); err != nil {
+				return err
 			}
 		}
+		app.logger.Println("[info] end do sql")
 	}
+	return nil
 }
 
-func (app *App) wait(ctx context.Context, estimateTime time.Duration, action func() bool) error {
+// openExecuter opens an executer for the database, with hooks recording executed statements to the result.
+func (app *App) openExecuter(ctx context.Context, result *sqlResult, dbtype, database, host string, port int) (executer, error) {
+	executer, err := app.newExecuter(app.cfg, dbtype, database, host, port)
+	if err != nil {
+		return nil, err
+	}
+	// hooks are called after each statement, so the duration of a statement is the time since the previous hook.
+	lastHookTime := flextime.Now()
+	executer.SetTableSelectHook(func(query, table string) {
+		now := flextime.Now()
+		app.logger.Printf("[info] Query: %s\n%s\n", query, table)
+		traceSQLStatement(ctx, dbtype, query, -1, lastHookTime, now)
+		lastHookTime = now
+	})
+	executer.SetExecuteHook(func(query string, rowsAffected int64, _ int64) {
+		now := flextime.Now()
+		app.logger.Printf("[debug] Query OK, %d rows affected: %s\n", rowsAffected, query)
+		statement := StatementReport{
+			Database:        database,
+			Query:           query,
+			RowsAffected:    rowsAffected,
+			DurationSeconds: now.Sub(lastHookTime).Seconds(),
+		}
+		result.addStatement(statement)
+		app.metrics.addStatement(statement)
+		traceSQLStatement(ctx, dbtype, query, rowsAffected, lastHookTime, now)
+		lastHookTime = now
+	})
+	return executer, nil
+}
+
+func (app *App) wait(ctx context.Context, target string, estimateTime time.Duration, poll func() bool) error {
+	action := func() bool {
+		app.metrics.waitPolled(target)
+		return poll()
+	}
 	constantPolicy := backoff.NewConstantPolicy(
 		backoff.WithInterval(app.baseInterval),
 		backoff.WithJitterFactor(0.05),
@@ -386,161 +912,278 @@ func (app *App) wait(ctx context.Context, estimateTime time.Duration, action fun
 	return errors.New("failed to wait available, timeout")
 }
 
+func (app *App) checkDBClusterAvailable(ctx context.Context, dbClusterIdentifeier string) (*rds.DBCluster, bool, error) {
+	output, err := app.rdsSvc.DescribeDBClustersWithContext(ctx, &rds.DescribeDBClustersInput{
+		DBClusterIdentifier: &dbClusterIdentifeier,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if len(output.DBClusters) == 0 {
+		return nil, false, fmt.Errorf("db cluster `%s` not found", dbClusterIdentifeier)
+	}
+	dbCluster := output.DBClusters[0]
+	return dbCluster, strings.ToLower(*dbCluster.Status) == "available", nil
+}
+
 func (app *App) waitDBClusterAvailable(ctx context.Context, dbClusterIdentifeier string) (dbCluster *rds.DBCluster, err error) {
-	log.Printf("[info] wait db cluster `%s` status available...\n", dbClusterIdentifeier)
+	app.logger.Printf("[info] wait db cluster `%s` status available...\n", dbClusterIdentifeier)
+	ctx, span, status := startWaitSpan(ctx, "db_cluster", dbClusterIdentifeier)
+	defer func() { endSpan(span, err) }()
 
 	act := func() bool {
-		var output *rds.DescribeDBClustersOutput
-		output, err = app.rdsSvc.DescribeDBClustersWithContext(ctx, &rds.DescribeDBClustersInput{
-			DBClusterIdentifier: &dbClusterIdentifeier,
-		})
+		var available bool
+		dbCluster, available, err = app.checkDBClusterAvailable(ctx, dbClusterIdentifeier)
 		if err != nil {
 			return true
 		}
-		if len(output.DBClusters) == 0 {
-			err = fmt.Errorf("db cluster `%s` not found", dbClusterIdentifeier)
-			return true
-		}
-		if strings.ToLower(*output.DBClusters[0].Status) == "available" {
-			log.Printf("[info] db cluster status is %s!\n", *output.DBClusters[0].Status)
-			err = nil
-			dbCluster = output.DBClusters[0]
+		status.record(*dbCluster.Status)
+		if available {
+			app.logger.Printf("[info] db cluster status is %s!\n", *dbCluster.Status)
 			return true
 		}
-		log.Printf("[info] now db cluster status is %s ...\n", *output.DBClusters[0].Status)
+		app.logger.Printf("[info] now db cluster status is %s ...\n", *dbCluster.Status)
 		return false
 	}
-	err = app.wait(ctx, 5*time.Minute, act)
+	err = app.wait(ctx, "db_cluster", 5*time.Minute, act)
 	return
 }
 
+func (app *App) checkDBInstanceAvailable(ctx context.Context, dbInstanceIdentifeier string) (*rds.DBInstance, bool, error) {
+	output, err := app.rdsSvc.DescribeDBInstancesWithContext(ctx, &rds.DescribeDBInstancesInput{
+		DBInstanceIdentifier: &dbInstanceIdentifeier,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if len(output.DBInstances) == 0 {
+		return nil, false, fmt.Errorf("db instance `%s` not found", dbInstanceIdentifeier)
+	}
+	dbInstance := output.DBInstances[0]
+	return dbInstance, strings.ToLower(*dbInstance.DBInstanceStatus) == "available", nil
+}
+
 func (app *App) waitDBInstanceAvailable(ctx context.Context, dbInstanceIdentifeier string) (dbInstance *rds.DBInstance, err error) {
-	log.Printf("[info] wait db instance `%s` status available...\n", dbInstanceIdentifeier)
+	app.logger.Printf("[info] wait db instance `%s` status available...\n", dbInstanceIdentifeier)
+	ctx, span, status := startWaitSpan(ctx, "db_instance", dbInstanceIdentifeier)
+	defer func() { endSpan(span, err) }()
 	act := func() bool {
-		var output *rds.DescribeDBInstancesOutput
-		output, err = app.rdsSvc.DescribeDBInstancesWithContext(ctx, &rds.DescribeDBInstancesInput{
-			DBInstanceIdentifier: &dbInstanceIdentifeier,
-		})
+		var available bool
+		dbInstance, available, err = app.checkDBInstanceAvailable(ctx, dbInstanceIdentifeier)
 		if err != nil {
 			return true
 		}
-		if len(output.DBInstances) == 0 {
-			err = fmt.Errorf("db instance `%s` not found", dbInstanceIdentifeier)
+		status.record(*dbInstance.DBInstanceStatus)
+		if available {
+			app.logger.Printf("[info] db instance status is %s!\n", *dbInstance.DBInstanceStatus)
 			return true
 		}
-		if strings.ToLower(*output.DBInstances[0].DBInstanceStatus) == "available" {
-			log.Printf("[info] db instance status is %s!\n", *output.DBInstances[0].DBInstanceStatus)
-			dbInstance = output.DBInstances[0]
-			err = nil
+		app.logger.Printf("[info] now db instance status is %s ...\n", *dbInstance.DBInstanceStatus)
+		return false
+	}
+	err = app.wait(ctx, "db_instance", 5*time.Minute, act)
+	return
+}
+
+// checkDBClusterCapacityModified reports whether the cluster is available with the capacity range.
+func (app *App) checkDBClusterCapacityModified(ctx context.Context, dbClusterIdentifeier string, min, max float64) (*rds.DBCluster, bool, error) {
+	dbCluster, available, err := app.checkDBClusterAvailable(ctx, dbClusterIdentifeier)
+	if err != nil {
+		return nil, false, err
+	}
+	c := dbCluster.ServerlessV2ScalingConfiguration
+	modified := c != nil && aws.Float64Value(c.MinCapacity) == min && aws.Float64Value(c.MaxCapacity) == max
+	return dbCluster, available && modified, nil
+}
+
+func (app *App) waitDBClusterCapacityModified(ctx context.Context, dbClusterIdentifeier string, min, max float64) (dbCluster *rds.DBCluster, err error) {
+	app.logger.Printf("[info] wait db cluster `%s` capacity %g-%g ACU...\n", dbClusterIdentifeier, min, max)
+	ctx, span, status := startWaitSpan(ctx, "db_cluster_capacity", dbClusterIdentifeier)
+	defer func() { endSpan(span, err) }()
+	act := func() bool {
+		var modified bool
+		dbCluster, modified, err = app.checkDBClusterCapacityModified(ctx, dbClusterIdentifeier, min, max)
+		if err != nil {
 			return true
 		}
-		log.Printf("[info] now db instance status is %s ...\n", *output.DBInstances[0].DBInstanceStatus)
+		status.record(*dbCluster.Status)
+		if modified {
+			app.logger.Printf("[info] db cluster capacity is %g-%g ACU!\n", min, max)
+			return true
+		}
+		app.logger.Printf("[info] now db cluster status is %s ...\n", *dbCluster.Status)
 		return false
 	}
-	err = app.wait(ctx, 5*time.Minute, act)
+	err = app.wait(ctx, "db_cluster_capacity", 5*time.Minute, act)
 	return
 }
 
-func (app *App) waitDBClusterEndpointAvailable(ctx context.Context, dbClusterIdentifeier string) (dbClusterEndpoint *rds.DBClusterEndpoint, err error) {
-	log.Printf("[info] wait db endpoints `%s` status available...\n", dbClusterIdentifeier)
+// checkDBInstanceModified reports whether the instance is available with the instance class, and no modification is pending.
+func (app *App) checkDBInstanceModified(ctx context.Context, dbInstanceIdentifeier, dbInstanceClass string) (*rds.DBInstance, bool, error) {
+	dbInstance, available, err := app.checkDBInstanceAvailable(ctx, dbInstanceIdentifeier)
+	if err != nil {
+		return nil, false, err
+	}
+	pending := dbInstance.PendingModifiedValues != nil && dbInstance.PendingModifiedValues.DBInstanceClass != nil
+	return dbInstance, available && !pending && aws.StringValue(dbInstance.DBInstanceClass) == dbInstanceClass, nil
+}
+
+func (app *App) waitDBInstanceModified(ctx context.Context, dbInstanceIdentifeier, dbInstanceClass string) (dbInstance *rds.DBInstance, err error) {
+	app.logger.Printf("[info] wait db instance `%s` class %s...\n", dbInstanceIdentifeier, dbInstanceClass)
+	ctx, span, status := startWaitSpan(ctx, "db_instance_modified", dbInstanceIdentifeier)
+	defer func() { endSpan(span, err) }()
 	act := func() bool {
-		var output *rds.DescribeDBClusterEndpointsOutput
-		output, err = app.rdsSvc.DescribeDBClusterEndpointsWithContext(ctx, &rds.DescribeDBClusterEndpointsInput{
-			DBClusterIdentifier: &dbClusterIdentifeier,
-			Filters: []*rds.Filter{
-				{
-					Name:   aws.String("db-cluster-endpoint-type"),
-					Values: []*string{aws.String("WRITER")},
-				},
-			},
-		})
+		var modified bool
+		dbInstance, modified, err = app.checkDBInstanceModified(ctx, dbInstanceIdentifeier, dbInstanceClass)
 		if err != nil {
 			return true
 		}
-		if len(output.DBClusterEndpoints) == 0 {
-			err = fmt.Errorf("db cluster endpoints `%s` not found", dbClusterIdentifeier)
+		status.record(*dbInstance.DBInstanceStatus)
+		if modified {
+			app.logger.Printf("[info] db instance class is %s!\n", dbInstanceClass)
+			return true
+		}
+		app.logger.Printf("[info] now db instance status is %s ...\n", *dbInstance.DBInstanceStatus)
+		return false
+	}
+	err = app.wait(ctx, "db_instance_modified", 10*time.Minute, act)
+	return
+}
+
+func (app *App) checkDBClusterEndpointAvailable(ctx context.Context, dbClusterIdentifeier string) (*rds.DBClusterEndpoint, bool, error) {
+	output, err := app.rdsSvc.DescribeDBClusterEndpointsWithContext(ctx, &rds.DescribeDBClusterEndpointsInput{
+		DBClusterIdentifier: &dbClusterIdentifeier,
+		Filters: []*rds.Filter{
+			{
+				Name:   aws.String("db-cluster-endpoint-type"),
+				Values: []*string{aws.String("WRITER")},
+			},
+		},
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if len(output.DBClusterEndpoints) == 0 {
+		return nil, false, fmt.Errorf("db cluster endpoints `%s` not found", dbClusterIdentifeier)
+	}
+	dbClusterEndpoint := output.DBClusterEndpoints[0]
+	return dbClusterEndpoint, strings.ToLower(*dbClusterEndpoint.Status) == "available", nil
+}
+
+func (app *App) waitDBClusterEndpointAvailable(ctx context.Context, dbClusterIdentifeier string) (dbClusterEndpoint *rds.DBClusterEndpoint, err error) {
+	app.logger.Printf("[info] wait db endpoints `%s` status available...\n", dbClusterIdentifeier)
+	ctx, span, status := startWaitSpan(ctx, "db_cluster_endpoint", dbClusterIdentifeier)
+	defer func() { endSpan(span, err) }()
+	act := func() bool {
+		var available bool
+		dbClusterEndpoint, available, err = app.checkDBClusterEndpointAvailable(ctx, dbClusterIdentifeier)
+		if err != nil {
 			return true
 		}
-		if strings.ToLower(*output.DBClusterEndpoints[0].Status) == "available" {
-			log.Printf("[info] db cluster endpoint status is %s!\n", *output.DBClusterEndpoints[0].Status)
-			dbClusterEndpoint = output.DBClusterEndpoints[0]
-			err = nil
+		status.record(*dbClusterEndpoint.Status)
+		if available {
+			app.logger.Printf("[info] db cluster endpoint status is %s!\n", *dbClusterEndpoint.Status)
 			return true
 		}
-		log.Printf("[info] now db cluster endpoint status is %s ...\n", *output.DBClusterEndpoints[0].Status)
+		app.logger.Printf("[info] now db cluster endpoint status is %s ...\n", *dbClusterEndpoint.Status)
 		return false
 	}
-	err = app.wait(ctx, 5*time.Minute, act)
+	err = app.wait(ctx, "db_cluster_endpoint", 5*time.Minute, act)
 	return
 }
 
+// checkDBClusterLatestRestorableTime reports whether LatestRestorableTime of the db cluster is past the masked time.
+// The returned time is nil if LatestRestorableTime is not available yet.
+func (app *App) checkDBClusterLatestRestorableTime(ctx context.Context, dbClusterIdentifeier string, maskedTime time.Time) (*time.Time, bool, error) {
+	output, err := app.rdsSvc.DescribeDBClustersWithContext(ctx, &rds.DescribeDBClustersInput{
+		DBClusterIdentifier: &dbClusterIdentifeier,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if len(output.DBClusters) == 0 {
+		return nil, false, fmt.Errorf("db cluster `%s` not found", dbClusterIdentifeier)
+	}
+	latestRestorableTime := output.DBClusters[0].LatestRestorableTime
+	if latestRestorableTime == nil {
+		return nil, false, nil
+	}
+	return latestRestorableTime, latestRestorableTime.After(maskedTime), nil
+}
+
 func (app *App) waitDBClusterLatestRestorableTime(ctx context.Context, dbClusterIdentifeier string, maskedTime time.Time) (err error) {
-	log.Printf("[info] wait db cluster `%s` LatestRestorableTime past masked time `%s`...\n", dbClusterIdentifeier, maskedTime.Format(time.RFC3339))
+	app.logger.Printf("[info] wait db cluster `%s` LatestRestorableTime past masked time `%s`...\n", dbClusterIdentifeier, maskedTime.Format(time.RFC3339))
+	ctx, span, status := startWaitSpan(ctx, "latest_restorable_time", dbClusterIdentifeier)
+	defer func() { endSpan(span, err) }()
 	act := func() bool {
-		var output *rds.DescribeDBClustersOutput
-		output, err = app.rdsSvc.DescribeDBClustersWithContext(ctx, &rds.DescribeDBClustersInput{
-			DBClusterIdentifier: &dbClusterIdentifeier,
-		})
+		var latestRestorableTime *time.Time
+		var restorable bool
+		latestRestorableTime, restorable, err = app.checkDBClusterLatestRestorableTime(ctx, dbClusterIdentifeier, maskedTime)
 		if err != nil {
 			return true
 		}
-		if len(output.DBClusters) == 0 {
-			err = fmt.Errorf("db cluster `%s` not found", dbClusterIdentifeier)
-			return true
-		}
-		latestRestorableTime := output.DBClusters[0].LatestRestorableTime
 		if latestRestorableTime == nil {
 			return false
 		}
-		if latestRestorableTime.After(maskedTime) {
-			log.Printf("[info] db cluster LatestRestorableTime=%s, complete!\n", latestRestorableTime.Format(time.RFC3339))
+		status.record(latestRestorableTime.Format(time.RFC3339))
+		if restorable {
+			app.logger.Printf("[info] db cluster LatestRestorableTime=%s, complete!\n", latestRestorableTime.Format(time.RFC3339))
 			return true
 		}
-		log.Printf("[info] now db cluster LatestRestorableTime=%s\n", latestRestorableTime.Format(time.RFC3339))
+		app.logger.Printf("[info] now db cluster LatestRestorableTime=%s\n", latestRestorableTime.Format(time.RFC3339))
 		return false
 	}
-	err = app.wait(ctx, 5*time.Minute, act)
+	err = app.wait(ctx, "latest_restorable_time", 5*time.Minute, act)
 	return
 }
 
+func (app *App) checkDBClusterSnapshotAvailable(ctx context.Context, dbClusterSnapshotIdentifeier string) (*rds.DBClusterSnapshot, bool, error) {
+	output, err := app.rdsSvc.DescribeDBClusterSnapshotsWithContext(ctx, &rds.DescribeDBClusterSnapshotsInput{
+		DBClusterSnapshotIdentifier: &dbClusterSnapshotIdentifeier,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if len(output.DBClusterSnapshots) == 0 {
+		return nil, false, fmt.Errorf("db cluster snapshot `%s` not found", dbClusterSnapshotIdentifeier)
+	}
+	dbClusterSnapshot := output.DBClusterSnapshots[0]
+	return dbClusterSnapshot, strings.ToLower(*dbClusterSnapshot.Status) == "available", nil
+}
+
 func (app *App) waitDBClusterSnapshot(ctx context.Context, dbClusterSnapshotIdentifeier string) (dbClusterSnapshot *rds.DBClusterSnapshot, err error) {
-	log.Printf("[info] wait db cluster snapshot `%s` status available...\n", dbClusterSnapshotIdentifeier)
+	app.logger.Printf("[info] wait db cluster snapshot `%s` status available...\n", dbClusterSnapshotIdentifeier)
+	ctx, span, status := startWaitSpan(ctx, "db_cluster_snapshot", dbClusterSnapshotIdentifeier)
+	defer func() { endSpan(span, err) }()
 
 	act := func() bool {
-		var output *rds.DescribeDBClusterSnapshotsOutput
-		output, err = app.rdsSvc.DescribeDBClusterSnapshotsWithContext(ctx, &rds.DescribeDBClusterSnapshotsInput{
-			DBClusterSnapshotIdentifier: &dbClusterSnapshotIdentifeier,
-		})
+		var available bool
+		dbClusterSnapshot, available, err = app.checkDBClusterSnapshotAvailable(ctx, dbClusterSnapshotIdentifeier)
 		if err != nil {
 			return true
 		}
-		if len(output.DBClusterSnapshots) == 0 {
-			err = fmt.Errorf("db cluster snapshot `%s` not found", dbClusterSnapshotIdentifeier)
-			return true
-		}
-		if strings.ToLower(*output.DBClusterSnapshots[0].Status) == "available" {
-			log.Printf(
+		status.record(*dbClusterSnapshot.Status)
+		if available {
+			app.logger.Printf(
 				"[info] db cluster snapshot status is %s! progress=%d%%\n",
-				*output.DBClusterSnapshots[0].Status,
-				*output.DBClusterSnapshots[0].PercentProgress,
+				*dbClusterSnapshot.Status,
+				*dbClusterSnapshot.PercentProgress,
 			)
-			err = nil
-			dbClusterSnapshot = output.DBClusterSnapshots[0]
 			return true
 		}
-		log.Printf(
+		app.logger.Printf(
 			"[info] db cluster status snapshot is %s... progress=%d%%\n",
-			*output.DBClusterSnapshots[0].Status,
-			*output.DBClusterSnapshots[0].PercentProgress,
+			*dbClusterSnapshot.Status,
+			*dbClusterSnapshot.PercentProgress,
 		)
 		return false
 	}
-	err = app.wait(ctx, 5*time.Minute, act)
+	err = app.wait(ctx, "db_cluster_snapshot", 5*time.Minute, act)
 	return
 }
 
 func (app *App) cleanup(info *cleanupInfo) error {
-	log.Println("[info] start cleanup ...")
+	app.logger.Println("[info] start cleanup ...")
 	if info.tempDBInstanceIdentifier != nil {
 		output, err := app.rdsSvc.DeleteDBInstance(&rds.DeleteDBInstanceInput{
 			DBInstanceIdentifier: info.tempDBInstanceIdentifier,
@@ -549,7 +1192,7 @@ func (app *App) cleanup(info *cleanupInfo) error {
 		if err != nil {
 			return err
 		}
-		log.Printf("[info] delete temp db instance:%s\n", *output.DBInstance.DBInstanceArn)
+		app.logger.Printf("[info] delete temp db instance:%s\n", *output.DBInstance.DBInstanceArn)
 		info.tempDBInstanceIdentifier = nil
 	}
 
@@ -561,9 +1204,9 @@ func (app *App) cleanup(info *cleanupInfo) error {
 		if err != nil {
 			return err
 		}
-		log.Printf("[info] delete temp db cluster:%s\n", *output.DBCluster.DBClusterArn)
+		app.logger.Printf("[info] delete temp db cluster:%s\n", *output.DBCluster.DBClusterArn)
 		info.tempDBClusterIdentifier = nil
 	}
-	log.Println("[info] finish cleanup")
+	app.logger.Println("[info] finish cleanup")
 	return nil
 }
@@ -2,16 +2,34 @@ package mascaras
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
 	"io"
 	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/chzyer/readline"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func TestAppRun(t *testing.T) {
@@ -25,6 +43,8 @@ func TestAppRun(t *testing.T) {
 		expectedSQL       string
 		noMask            bool
 		stdin             string
+		approvalSignal    string
+		staleSignal       string
 	}{
 		{
 			clusterIdentifier: MockSuccessDBClusterIdentifier,
@@ -100,54 +120,1857 @@ func TestAppRun(t *testing.T) {
 			},
 			stdin: "SELECT * FROM users LIMIT 5;\nexit\n",
 		},
+		{
+			casetag:           "approved",
+			clusterIdentifier: MockSuccessDBClusterIdentifier,
+			expectedSQL:       expectedSQLbase,
+			cfg: &Config{
+				TempCluster: TempDBClusterConfig{
+					DBInstanceClass: "db.t3.small",
+				},
+				EnableApproval: true,
+				Approval: ApprovalConfig{
+					Assertions: []ApprovalAssertionConfig{
+						{Name: "no real emails", Query: "SELECT COUNT(*) AS n FROM users WHERE email NOT LIKE '%@example.com'", Expected: "0"},
+						{Query: "SELECT error", Expected: "0"},
+					},
+				},
+			},
+			approvalSignal: "approve",
+		},
+		{
+			casetag:           "approved without SQL",
+			clusterIdentifier: MockSuccessDBClusterIdentifier,
+			expectedSQL:       "",
+			noMask:            true,
+			cfg: &Config{
+				TempCluster: TempDBClusterConfig{
+					DBInstanceClass: "db.t3.small",
+				},
+				EnableApproval: true,
+			},
+			approvalSignal: "approve",
+		},
+		{
+			casetag:           "rejected",
+			clusterIdentifier: MockSuccessDBClusterIdentifier,
+			expectedSQL:       expectedSQLbase,
+			cfg: &Config{
+				TempCluster: TempDBClusterConfig{
+					DBInstanceClass: "db.t3.small",
+				},
+				EnableApproval: true,
+			},
+			approvalSignal: "reject",
+			errMsg:         "approval rejected",
+		},
+		{
+			casetag:           "signal of the previous run",
+			clusterIdentifier: MockSuccessDBClusterIdentifier,
+			expectedSQL:       expectedSQLbase,
+			cfg: &Config{
+				TempCluster: TempDBClusterConfig{
+					DBInstanceClass: "db.t3.small",
+				},
+				EnableApproval: true,
+				Approval: ApprovalConfig{
+					Timeout: "100ms",
+				},
+			},
+			staleSignal: "approve 0123456789abcdef",
+			errMsg:      "approval timeout",
+		},
 	}
 	for _, c := range cases {
 		t.Run(c.casetag+c.clusterIdentifier, func(t *testing.T) {
-			cleanup := setLogOutput(t)
-			defer cleanup()
-			svc := &mockRDSService{}
-			e := &mockExecuter{}
-			app := &App{
-				rdsSvc:       svc,
-				baseInterval: time.Millisecond,
-				newExecuter: func(_ *Config, dbtype, host string, _ int) (executer, error) {
-					e.host = host
-					return e, nil
-				},
-				stdin: io.NopCloser(strings.NewReader(c.stdin)),
-			}
-			if c.cfg == nil {
-				app.cfg = DefaultConfig()
-			} else {
+			app := newTestApp(t)
+			app.stdin = io.NopCloser(strings.NewReader(c.stdin))
+			if c.cfg != nil {
 				app.cfg = c.cfg
 			}
 			app.cfg.TempCluster.DBClusterIdentifier = c.clusterIdentifier
-			if !c.noMask {
+			app.cfg.Prompt.HistoryFile = filepath.Join(t.TempDir(), "history")
+			if c.noMask {
+				app.cfg.SQLFile = ""
+			} else {
 				app.cfg.SQLFile = "testdata/mask.sql"
 			}
+			if c.approvalSignal != "" || c.staleSignal != "" {
+				dir := t.TempDir()
+				app.cfg.Approval.SummaryLocation = filepath.Join(dir, "summary.json")
+				app.cfg.Approval.SignalLocation = filepath.Join(dir, "signal")
+				if c.staleSignal != "" {
+					require.NoError(t, os.WriteFile(app.cfg.Approval.SignalLocation, []byte(c.staleSignal), 0644))
+				}
+			}
+			if c.approvalSignal != "" {
+				// signal the run after the summary is written.
+				go func() {
+					for {
+						bs, err := os.ReadFile(app.cfg.Approval.SummaryLocation)
+						if err == nil {
+							var summary approvalSummary
+							if json.Unmarshal(bs, &summary) == nil {
+								os.WriteFile(app.cfg.Approval.SignalLocation, []byte(c.approvalSignal+" "+summary.RunID+"\n"), 0644)
+								return
+							}
+						}
+						time.Sleep(time.Millisecond)
+					}
+				}()
+			}
 			require.NoError(t, app.cfg.Validate(), "config validate no error")
 			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 			defer cancel()
-			err := app.Run(ctx, "mascaras-test")
+			report, err := app.Run(ctx, "mascaras-test")
 			if c.errMsg == "" {
 				require.NoError(t, err, "run no error")
+				require.EqualValues(t, ReportStatusSucceeded, report.Status)
 			} else {
 				require.EqualError(t, err, c.errMsg, "run expected error")
+				require.EqualValues(t, ReportStatusFailed, report.Status)
+				require.EqualValues(t, c.errMsg, report.Error)
 			}
-			require.EqualValues(t, c.expectedSQL, e.executeSQL.String(), "sql check")
-			if svc.isCreateCluster {
-				require.True(t, svc.isDeleteCluster)
+			require.EqualValues(t, c.clusterIdentifier, report.TempDBClusterIdentifier)
+			require.EqualValues(t, c.expectedSQL, app.executedSQL(), "sql check")
+			if c.approvalSignal != "" {
+				require.NoFileExists(t, app.cfg.Approval.SignalLocation, "consumed signal is deleted")
+				bs, err := os.ReadFile(app.cfg.Approval.SummaryLocation)
+				require.NoError(t, err)
+				var summary approvalSummary
+				require.NoError(t, json.Unmarshal(bs, &summary))
+				require.EqualValues(t, report.RunID, summary.RunID)
+				require.Len(t, summary.Tables, 4)
+				require.EqualValues(t, approvalTable{Table: "access_log", Rows: 2}, summary.Tables[0])
+				if len(c.cfg.Approval.Assertions) > 0 {
+					require.Len(t, summary.Assertions, 2)
+					require.True(t, summary.Assertions[0].Passed)
+					require.Equal(t, "no real emails", summary.Assertions[0].Name)
+					require.False(t, summary.Assertions[1].Passed)
+					require.Equal(t, "SELECT error", summary.Assertions[1].Name)
+					require.Equal(t, "query error", summary.Assertions[1].Error)
+					require.Equal(t, 1, summary.FailedAssertions)
+				}
 			}
-			if svc.isCreateInstance {
-				require.True(t, svc.isDeleteInstance)
+			if app.svc.isCreateCluster {
+				require.True(t, app.svc.isDeleteCluster)
+			}
+			if app.svc.isCreateInstance {
+				require.True(t, app.svc.isDeleteInstance)
 			}
 		})
 	}
 }
 
+func TestReadApprovalSignal(t *testing.T) {
+	loc := filepath.Join(t.TempDir(), "signal")
+	found, _, err := readApprovalSignal(loc, "run1")
+	require.NoError(t, err)
+	require.False(t, found)
+	cases := []struct {
+		content  string
+		found    bool
+		rejected bool
+	}{
+		{content: "approve run1\n", found: true},
+		{content: "Reject run1", found: true, rejected: true},
+		{content: "abort run1", found: true, rejected: true},
+		{content: "approve run0"},
+		{content: "approve"},
+		{content: ""},
+		{content: "aprove run1"},
+	}
+	for _, c := range cases {
+		require.NoError(t, os.WriteFile(loc, []byte(c.content), 0644))
+		found, rejected, err := readApprovalSignal(loc, "run1")
+		require.Equal(t, c.found, found, c.content)
+		require.Equal(t, c.rejected, rejected, c.content)
+		if !c.found {
+			require.ErrorIs(t, err, errApprovalSignalIgnored, c.content)
+		}
+	}
+}
+
+func TestDBExecuterDumpTableTimeZone(t *testing.T) {
+	c := &mockConnector{}
+	e := newDBExecuter(sql.OpenDB(c), "mysql")
+	defer e.Close()
+	var buf bytes.Buffer
+	n, err := e.dumpTable(context.Background(), "users", &buf)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, n)
+	require.EqualValues(t, "SET NAMES utf8mb4;\nSET time_zone = '+00:00';\nSET FOREIGN_KEY_CHECKS = 0;\nDROP TABLE IF EXISTS `users`;\n"+
+		"CREATE TABLE `users` (`id` int NOT NULL, `created_at` timestamp NOT NULL);\n\n"+
+		"INSERT INTO `users` (`id`, `created_at`) VALUES\n(1, '2021-06-01 00:00:00');\n", buf.String())
+	// the rows are read in UTC, and the time zone is restored for the pool.
+	require.EqualValues(t, []string{
+		"SET @mascaras_time_zone = @@session.time_zone, time_zone = '+00:00'",
+		"SET time_zone = @mascaras_time_zone",
+	}, c.execs)
+}
+
+func TestDBExecuterExecuteHook(t *testing.T) {
+	for _, dbtype := range []string{"mysql", "postgresql"} {
+		t.Run(dbtype, func(t *testing.T) {
+			// LastInsertId is supported by the MySQL driver only.
+			c := &mockConnector{lastInsertID: dbtype == "mysql"}
+			e := newDBExecuter(sql.OpenDB(c), dbtype)
+			defer e.Close()
+			var queries []string
+			var rows, lastInsertID int64
+			e.SetExecuteHook(func(query string, rowsAffected int64, id int64) {
+				queries = append(queries, query)
+				rows += rowsAffected
+				lastInsertID = id
+			})
+			err := e.ExecuteContext(context.Background(), strings.NewReader("UPDATE users SET email = 'x';\nDELETE FROM sessions;\n"))
+			require.NoError(t, err)
+			require.EqualValues(t, []string{"UPDATE users SET email = 'x'", "DELETE FROM sessions"}, queries)
+			require.EqualValues(t, 6, rows)
+			require.EqualValues(t, queries, c.execs)
+			if dbtype == "mysql" {
+				require.EqualValues(t, 7, lastInsertID)
+			} else {
+				require.Zero(t, lastInsertID)
+			}
+			require.False(t, e.LastExecuteTime().IsZero())
+		})
+	}
+}
+
+func TestAppRunReport(t *testing.T) {
+	app := newTestApp(t)
+	app.cfg.ReportLocation = filepath.Join(t.TempDir(), "report.json")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	report, err := app.Run(ctx, "mascaras-test")
+	require.NoError(t, err)
+
+	bs, err := os.ReadFile(app.cfg.ReportLocation)
+	require.NoError(t, err)
+	var written Report
+	require.NoError(t, json.Unmarshal(bs, &written))
+	require.EqualValues(t, report.RunID, written.RunID)
+	require.EqualValues(t, ReportStatusSucceeded, written.Status)
+	require.EqualValues(t, "aurora-test", written.Engine)
+	require.NotNil(t, report.RestoreTime)
+	require.EqualValues(t, report.RestoreTime, app.svc.restoreInput.RestoreToTime, "restored at the reported time")
+	require.Nil(t, app.svc.restoreInput.UseLatestRestorableTime)
+	require.EqualValues(t, dbClusterSnapshotARNPrefix+MockSuccessDBClusterIdentifier+"-snapshot", written.SnapshotArn)
+	require.Len(t, written.SQLFiles, 1)
+	require.EqualValues(t, "testdata/mask.sql", written.SQLFiles[0].Location)
+	require.Len(t, written.SQLFiles[0].SHA256, 64)
+	require.Len(t, written.Statements, 1)
+	require.EqualValues(t, 1, written.Statements[0].RowsAffected)
+	require.EqualValues(t, []string{"prepare", "restore", "create_instance", "wait_available", "execute_sql", "wait_restorable", "create_snapshot", "cleanup"}, stageNames(&written))
+}
+
+func TestAppRunDatabases(t *testing.T) {
+	app := newTestApp(t)
+	cfg, err := LoadConfig("testdata/databases.yml")
+	require.NoError(t, err)
+	require.EqualValues(t, map[string]SQLFiles{
+		"db01": {"testdata/mask.sql"},
+		"db02": {"testdata/mask.sql", "testdata/mask.sql"},
+	}, cfg.Databases)
+	require.NoError(t, cfg.Validate())
+	cfg.TempCluster.DBClusterIdentifier = MockSuccessDBClusterIdentifier
+	app.cfg = cfg
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	report, err := app.Run(ctx, "mascaras-test")
+	require.NoError(t, err)
+	expectedSQLbase, err := readSQL("testdata/mask.sql")
+	require.NoError(t, err)
+	require.EqualValues(t, []string{"db01", "db02"}, app.databases)
+	require.EqualValues(t, expectedSQLbase, app.executers[0].executeSQL.String())
+	require.EqualValues(t, expectedSQLbase+expectedSQLbase, app.executers[1].executeSQL.String())
+	require.EqualValues(t, app.executers[1].lastExecuteTime, *report.MaskedTime)
+
+	databases := make([]string, 0, len(report.SQLFiles))
+	for _, f := range report.SQLFiles {
+		databases = append(databases, f.Database)
+	}
+	require.EqualValues(t, []string{"db01", "db02", "db02"}, databases)
+	require.Len(t, report.Statements, 3)
+	require.EqualValues(t, "db01", report.Statements[0].Database)
+
+	cfg.MergeIn(&Config{SQLFile: "testdata/mask.sql"})
+	require.Empty(t, cfg.Databases)
+	require.Len(t, cfg.maskSQLTargets(), 1)
+}
+
+func TestSplitSQLBlocks(t *testing.T) {
+	cases := []struct {
+		sql      string
+		expected []sqlBlock
+	}{
+		{
+			sql:      "UPDATE users SET name = md5(name);",
+			expected: []sqlBlock{{sections: []string{"UPDATE users SET name = md5(name);"}}},
+		},
+		{
+			sql: "SET a = 1;\n-- mascaras:parallel\nUPDATE t1 SET c = 1;\n  -- mascaras:parallel  \nUPDATE t2 SET c = 1;\n-- mascaras:sequential\nDELETE FROM t3;\n-- mascaras:parallel\nUPDATE t4 SET c = 1;\n",
+			expected: []sqlBlock{
+				{sections: []string{"SET a = 1;\n"}},
+				{parallel: true, sections: []string{"UPDATE t1 SET c = 1;\n", "UPDATE t2 SET c = 1;\n"}},
+				{sections: []string{"DELETE FROM t3;\n"}},
+				{parallel: true, sections: []string{"UPDATE t4 SET c = 1;\n"}},
+			},
+		},
+		{
+			sql: "-- mascaras:parallel\n\n-- mascaras:parallel\nUPDATE t1 SET c = 1;\n-- mascaras:parallel\n",
+			expected: []sqlBlock{
+				{parallel: true, sections: []string{"UPDATE t1 SET c = 1;\n"}},
+			},
+		},
+	}
+	for _, c := range cases {
+		require.EqualValues(t, c.expected, splitSQLBlocks(c.sql))
+	}
+}
+
+func TestAppRunParallel(t *testing.T) {
+	app := newTestApp(t)
+	app.cfg.SQLFile = "testdata/parallel.sql"
+	app.cfg.SQLConcurrency = 2
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	report, err := app.Run(ctx, "mascaras-test")
+	require.NoError(t, err)
+	// the main executer and 2 connections for 3 parallel sections
+	executers := app.executers
+	require.Len(t, executers, 3)
+	require.EqualValues(t, "SET SESSION foreign_key_checks = 0;\nDELETE FROM sessions;\n", executers[0].executeSQL.String())
+	var parallelSQL string
+	var lastExecuteTime time.Time
+	for _, e := range executers {
+		if e != executers[0] {
+			parallelSQL += e.executeSQL.String()
+		}
+		if e.lastExecuteTime.After(lastExecuteTime) {
+			lastExecuteTime = e.lastExecuteTime
+		}
+	}
+	require.Contains(t, parallelSQL, "UPDATE users SET name = md5(name);")
+	require.Contains(t, parallelSQL, "UPDATE orders SET address = md5(address);")
+	require.Contains(t, parallelSQL, "UPDATE payments SET card_number = NULL;")
+	require.EqualValues(t, lastExecuteTime, *report.MaskedTime)
+	require.Len(t, report.Statements, 5)
+
+	app.cfg.TempCluster.DBClusterIdentifier = MockFailureExecuteSQLDBClusterIdentifier
+	_, err = app.Run(ctx, "mascaras-test")
+	require.Error(t, err)
+}
+
+func TestSplitSQLParts(t *testing.T) {
+	parts, err := splitSQLParts("SET a = 1;\n-- mascaras:chunk table=users key=user_id size=100\nUPDATE users SET name = ''\n WHERE user_id BETWEEN :chunk_start AND :chunk_end;\nDELETE FROM t1;\n")
+	require.NoError(t, err)
+	require.EqualValues(t, []sqlPart{
+		{text: "SET a = 1;\n"},
+		{
+			text:  "UPDATE users SET name = ''\n WHERE user_id BETWEEN :chunk_start AND :chunk_end;\n",
+			chunk: &chunkSpec{Table: "users", Key: "user_id", Size: 100},
+		},
+		{text: "DELETE FROM t1;\n"},
+	}, parts)
+
+	for _, sql := range []string{
+		"-- mascaras:chunk table=users\nUPDATE users SET name = '';\n",
+		"-- mascaras:chunk table=users\nUPDATE users SET name = '' WHERE id BETWEEN :chunk_start AND :chunk_end\n",
+		"-- mascaras:chunk\nUPDATE users SET name = '' WHERE id BETWEEN :chunk_start AND :chunk_end;\n",
+		"-- mascaras:chunk table=users; DROP TABLE users\nUPDATE users SET name = '' WHERE id BETWEEN :chunk_start AND :chunk_end;\n",
+		"-- mascaras:chunk table=users size=0\nUPDATE users SET name = '' WHERE id BETWEEN :chunk_start AND :chunk_end;\n",
+	} {
+		_, err := splitSQLParts(sql)
+		require.Error(t, err, sql)
+	}
+}
+
+func TestAppRunChunk(t *testing.T) {
+	app := newTestApp(t)
+	app.cfg.SQLFile = "testdata/chunk.sql"
+	app.cfg.Chunk.StateLocation = filepath.Join(t.TempDir(), "chunk.json")
+	statement := "UPDATE users SET name = md5(name)\n  WHERE id BETWEEN :chunk_start AND :chunk_end;\n"
+	id := chunkStatementID("", statement)
+	writeState := func(runID string) {
+		bs, err := json.Marshal(map[string]interface{}{
+			"run_id":                     runID,
+			"temp_db_cluster_identifier": MockSuccessDBClusterIdentifier,
+			"completed":                  map[string]int64{id: 10},
+		})
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(app.cfg.Chunk.StateLocation, bs, 0644))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// the state of the previous run on the temporary cluster with the same fixed identifier is discarded,
+	// and the state is deleted after executing SQL.
+	writeState("previous")
+	report, err := app.Run(ctx, "mascaras-test")
+	require.NoError(t, err)
+	executed := app.executedSQL()
+	require.Contains(t, executed, "BETWEEN 1 AND 10")
+	require.Contains(t, executed, "BETWEEN 11 AND 20")
+	require.Contains(t, executed, "BETWEEN 21 AND 25")
+	require.Contains(t, executed, "UPDATE config SET value = '';")
+	require.Len(t, report.Statements, 3)
+	require.EqualValues(t, statement, report.Statements[1].Query)
+	require.EqualValues(t, 30, report.Statements[1].RowsAffected)
+	require.NoFileExists(t, app.cfg.Chunk.StateLocation)
+
+	// the next run executes all chunks again, even if the state of the last run is left.
+	writeState(report.RunID)
+	app.resetExecuters()
+	app.resetRDSService()
+	_, err = app.Run(ctx, "mascaras-test")
+	require.NoError(t, err)
+	require.Contains(t, app.executedSQL(), "BETWEEN 1 AND 10")
+
+	// a retried step of the same run resumes from the next chunk.
+	writeState("0123456789abcdef")
+	app.resetExecuters()
+	state, err := app.Step(ctx, &State{
+		RunID:                     "0123456789abcdef",
+		Step:                      StepExecuteSQL,
+		SourceDBClusterIdentifier: "mascaras-src",
+		TempDBClusterIdentifier:   MockSuccessDBClusterIdentifier,
+		Engine:                    "aurora-mysql",
+		Endpoint:                  MockSuccessDBClusterIdentifier + dbClusterEndpointSuffix,
+		Port:                      3306,
+	})
+	require.NoError(t, err)
+	require.NotEqual(t, StepExecuteSQL, state.Step)
+	executed = app.executedSQL()
+	require.NotContains(t, executed, "BETWEEN 1 AND 10")
+	require.Contains(t, executed, "BETWEEN 11 AND 20")
+	require.NoFileExists(t, app.cfg.Chunk.StateLocation)
+
+	writeState("0123456789abcdef")
+	loaded, err := loadChunkState(app.cfg.Chunk.StateLocation, "0123456789abcdef", MockSuccessDBClusterIdentifier)
+	require.NoError(t, err)
+	require.EqualValues(t, map[string]int64{id: 10}, loaded.Completed)
+	loaded, err = loadChunkState(app.cfg.Chunk.StateLocation, "0123456789abcdef", "other")
+	require.NoError(t, err)
+	require.Empty(t, loaded.Completed)
+}
+
+func TestSNSNotifier(t *testing.T) {
+	svc := &mockSNSService{}
+	n := &snsNotifier{svc: svc, topicArn: "arn:aws:sns:ap-northeast-1:000000000000:mascaras"}
+	notification := &Notification{
+		Event:                     NotificationEventFailure,
+		RunID:                     "0123456789abcdef",
+		SourceDBClusterIdentifier: "mascaras-src",
+		Stage:                     "create_instance",
+		Error:                     "CreateDBInstance:InvalidParameterCombination: RDS does not support creating a DB instance\n\tstatus code: 400, request id: 00000000",
+	}
+	require.NoError(t, n.Notify(context.Background(), notification))
+	require.Len(t, svc.published, 1)
+	require.EqualValues(t, "mascaras failure create_instance: mascaras-src", *svc.published[0].Subject)
+	require.Contains(t, *svc.published[0].Message, "status code: 400")
+
+	notification = &Notification{
+		Event:                     NotificationEventSuccess,
+		SourceDBClusterIdentifier: "mascaras-" + strings.Repeat("ソース", 40),
+		SnapshotArn:               dbClusterSnapshotARNPrefix + "mascaras-src-snapshot",
+	}
+	subject := notification.subject()
+	require.LessOrEqual(t, len(subject), 99)
+	require.EqualValues(t, "mascaras success: mascaras-", subject)
+}
+
+func TestAppRunNotification(t *testing.T) {
+	var mu sync.Mutex
+	var notifications []Notification
+	var slackMessages []slackMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/webhook":
+			var n Notification
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&n))
+			notifications = append(notifications, n)
+		case "/slack":
+			var m slackMessage
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&m))
+			slackMessages = append(slackMessages, m)
+		}
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		casetag           string
+		clusterIdentifier string
+		expectedEvents    []string
+		expectedColor     string
+	}{
+		{
+			casetag:           "success",
+			clusterIdentifier: MockSuccessDBClusterIdentifier,
+			expectedEvents:    []string{NotificationEventStart, NotificationEventSuccess},
+			expectedColor:     "good",
+		},
+		{
+			casetag:           "failure",
+			clusterIdentifier: MockFailureCreateInstanceDBClusterIdentifier,
+			expectedEvents:    []string{NotificationEventStart, NotificationEventFailure},
+			expectedColor:     "danger",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.casetag, func(t *testing.T) {
+			notifications, slackMessages = nil, nil
+			app := newTestApp(t)
+			app.cfg.TempCluster.DBClusterIdentifier = c.clusterIdentifier
+			app.cfg.SQLFile = ""
+			app.cfg.Notifications = []NotificationConfig{
+				{Type: "webhook", URL: server.URL + "/webhook"},
+				{Type: "slack", URL: server.URL + "/slack", Events: []string{NotificationEventFailure, NotificationEventSuccess}},
+			}
+			require.NoError(t, app.cfg.Validate())
+			sinks, err := newNotificationSinks(nil, app.cfg.Notifications)
+			require.NoError(t, err)
+			app.notificationSinks = sinks
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			report, _ := app.Run(ctx, "mascaras-test")
+
+			mu.Lock()
+			defer mu.Unlock()
+			events := make([]string, 0, len(notifications))
+			for _, n := range notifications {
+				require.EqualValues(t, report.RunID, n.RunID)
+				events = append(events, n.Event)
+			}
+			require.EqualValues(t, c.expectedEvents, events)
+			last := notifications[len(notifications)-1]
+			switch last.Event {
+			case NotificationEventSuccess:
+				require.EqualValues(t, report.SnapshotArn, last.SnapshotArn)
+			case NotificationEventFailure:
+				require.EqualValues(t, "create_instance", last.Stage)
+				require.NotEmpty(t, last.Error)
+			}
+			require.Len(t, slackMessages, 1)
+			require.EqualValues(t, c.expectedColor, slackMessages[0].Attachments[0].Color)
+		})
+	}
+}
+
+func TestAppRunMetrics(t *testing.T) {
+	app := newTestApp(t)
+	var method, path, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bs, _ := io.ReadAll(r.Body)
+		method, path, body = r.Method, r.URL.Path, string(bs)
+	}))
+	defer server.Close()
+	app.cfg.Metrics.PushgatewayURL = server.URL + "/"
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := app.Run(ctx, "mascaras-src")
+	require.NoError(t, err)
+
+	require.EqualValues(t, http.MethodPut, method)
+	require.EqualValues(t, "/metrics/job/mascaras/source_db_cluster_identifier/mascaras-src", path)
+	for _, expected := range []string{
+		`mascaras_run_success{source_db_cluster_identifier="mascaras-src"} 1`,
+		`mascaras_statements_executed_total{source_db_cluster_identifier="mascaras-src"} 1`,
+		`mascaras_rows_affected_total{source_db_cluster_identifier="mascaras-src"} 1`,
+		`mascaras_stage_duration_seconds{source_db_cluster_identifier="mascaras-src",stage="create_snapshot"} `,
+		`mascaras_wait_polls_total{source_db_cluster_identifier="mascaras-src",target="db_cluster"} `,
+	} {
+		require.Contains(t, body, expected)
+	}
+}
+
+func TestOpenExecuterMetrics(t *testing.T) {
+	app := newTestApp(t)
+	run, err := newRunInfo("mascaras-src")
+	require.NoError(t, err)
+	app.metrics = newRunMetrics(run)
+	e, err := app.openExecuter(context.Background(), &sqlResult{}, "mysql", "db01", MockSuccessDBClusterIdentifier, 3306)
+	require.NoError(t, err)
+	require.NoError(t, e.ExecuteContext(context.Background(), strings.NewReader("UPDATE users SET email = 'x';")))
+	// recorded by the hook, before executeSQL returns.
+	var buf bytes.Buffer
+	_, err = app.metrics.WriteTo(&buf)
+	require.NoError(t, err)
+	require.Contains(t, buf.String(), `mascaras_statements_executed_total{source_db_cluster_identifier="mascaras-src"} 1`)
+
+	app.metrics = nil
+	require.NoError(t, e.ExecuteContext(context.Background(), strings.NewReader("UPDATE users SET email = 'x';")), "no metrics in step execution")
+}
+
+func TestAppRunTracing(t *testing.T) {
+	app := newTestApp(t)
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := app.Run(ctx, "mascaras-src")
+	require.NoError(t, err)
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	for _, name := range []string{"mascaras.Run", "restore", "wait_available", "wait db_cluster", "wait db_instance", "execute_sql", "sql", "wait latest_restorable_time", "create_snapshot"} {
+		require.Contains(t, spans, name)
+	}
+	root := spans["mascaras.Run"]
+	require.EqualValues(t, root.SpanContext().TraceID(), spans["sql"].SpanContext().TraceID())
+	require.EqualValues(t, spans["wait_available"].SpanContext().SpanID(), spans["wait db_cluster"].Parent().SpanID())
+	require.EqualValues(t, spans["execute_sql"].SpanContext().SpanID(), spans["sql"].Parent().SpanID())
+	require.Contains(t, spans["sql"].Attributes(), attribute.Int64("db.rows_affected", 1))
+	require.Contains(t, root.Attributes(), attribute.String("mascaras.status", ReportStatusSucceeded))
+}
+
+func TestAppStep(t *testing.T) {
+	app := newTestApp(t)
+	app.cfg.EnableExportTask = true
+	state, steps := app.runSteps(t, &State{SourceDBClusterIdentifier: "mascaras-src"})
+	require.EqualValues(t, []string{"", "create_instance", "wait_available", "execute_sql", "wait_restorable", "create_snapshot", "cleanup", "wait_snapshot", "export_task"}, steps)
+	require.NotEmpty(t, state.RunID)
+	require.EqualValues(t, MockSuccessDBClusterIdentifier+"-instance", state.TempDBInstanceIdentifier)
+	require.EqualValues(t, dbClusterSnapshotARNPrefix+MockSuccessDBClusterIdentifier+"-snapshot", state.SnapshotArn)
+	require.EqualValues(t, MockSuccessDBClusterIdentifier+"-snapshot-export-task", state.ExportTaskIdentifier)
+	require.True(t, app.svc.isDeleteInstance)
+	require.True(t, app.svc.isDeleteCluster)
+
+	app.resetRDSService()
+	app.cfg.TempCluster.DBClusterIdentifier = MockFailureCreateInstanceDBClusterIdentifier
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	state, err := app.Step(ctx, &State{SourceDBClusterIdentifier: "mascaras-src"})
+	require.NoError(t, err)
+	_, err = app.Step(ctx, state)
+	require.Error(t, err)
+	state.Step = StepAbort
+	state, err = app.Step(ctx, state)
+	require.NoError(t, err)
+	require.True(t, state.Done)
+	require.True(t, app.svc.isDeleteCluster)
+}
+
+func TestAppStepAlreadyExists(t *testing.T) {
+	app := newTestApp(t)
+	app.svc.alreadyExists = true
+	app.svc.restoreTags = []*rds.Tag{{Key: aws.String(tagKeyRunID), Value: aws.String("0123456789abcdef")}}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// the cluster restored by the previous attempt of the run
+	state, err := app.Step(ctx, &State{RunID: "0123456789abcdef", SourceDBClusterIdentifier: "mascaras-src"})
+	require.NoError(t, err)
+	require.EqualValues(t, StepCreateInstance, state.Step)
+	_, err = app.Step(ctx, &State{RunID: "fedcba9876543210", SourceDBClusterIdentifier: "mascaras-src"})
+	require.EqualError(t, err, "db cluster `mascaras-test` already exists and is not restored by run fedcba9876543210")
+
+	// the snapshot created by the previous attempt
+	app.svc.snapshotDBClusterIdentifier = MockSuccessDBClusterIdentifier
+	snapshotState := &State{
+		RunID:                     "0123456789abcdef",
+		Step:                      StepCreateSnapshot,
+		SourceDBClusterIdentifier: "mascaras-src",
+		TempDBClusterIdentifier:   MockSuccessDBClusterIdentifier,
+		SnapshotIdentifier:        MockSuccessDBClusterIdentifier + "-snapshot",
+	}
+	state, err = app.Step(ctx, snapshotState)
+	require.NoError(t, err)
+	require.EqualValues(t, StepCleanup, state.Step)
+	app.svc.snapshotDBClusterIdentifier = "mascaras-other"
+	_, err = app.Step(ctx, snapshotState)
+	require.EqualError(t, err, "db cluster snapshot `mascaras-test-snapshot` already exists and is not a snapshot of `mascaras-test`")
+}
+
+func TestAppStepExecuteSQL(t *testing.T) {
+	app := newTestApp(t)
+	app.cfg.SQLFile = ""
+	app.cfg.Databases = map[string]SQLFiles{
+		"db01": {"testdata/mask.sql", "testdata/mask.sql"},
+		"db02": {"testdata/mask.sql"},
+	}
+	app.cfg.TruncateTables = []string{"access_log"}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	state := &State{
+		RunID:                     "0123456789abcdef",
+		Step:                      StepExecuteSQL,
+		SourceDBClusterIdentifier: "mascaras-src",
+		TempDBClusterIdentifier:   MockSuccessDBClusterIdentifier,
+		Engine:                    "aurora-mysql",
+		Endpoint:                  MockSuccessDBClusterIdentifier + dbClusterEndpointSuffix,
+		Port:                      3306,
+	}
+	invocations := 0
+	for state.Step == StepExecuteSQL {
+		var err error
+		state, err = app.Step(ctx, state)
+		require.NoError(t, err)
+		invocations++
+	}
+	require.Equal(t, 3, invocations, "a SQL file per invocation")
+	require.EqualValues(t, StepWaitRestorable, state.Step)
+	require.EqualValues(t, []string{"db01", "db01", "db02"}, app.databases)
+	for i, e := range app.executers {
+		require.Contains(t, e.executeSQL.String(), "update users")
+		// tables are truncated with the first file of the database.
+		require.Equal(t, i != 1, strings.Contains(e.executeSQL.String(), "TRUNCATE TABLE `access_log`"), app.databases[i])
+	}
+	require.EqualValues(t, 5, state.SQLRowsAffected)
+	require.NotNil(t, state.MaskedTime)
+}
+
+func TestAppStepApprovalWithoutSQL(t *testing.T) {
+	app := newTestApp(t)
+	app.cfg.SQLFile = ""
+	app.cfg.EnableApproval = true
+	dir := t.TempDir()
+	app.cfg.Approval.SummaryLocation = filepath.Join(dir, "summary.json")
+	app.cfg.Approval.SignalLocation = filepath.Join(dir, "signal")
+	require.NoError(t, app.cfg.Validate())
+	require.NoError(t, os.WriteFile(app.cfg.Approval.SignalLocation, []byte("approve 0123456789abcdef\n"), 0644))
+
+	_, steps := app.runSteps(t, &State{RunID: "0123456789abcdef", SourceDBClusterIdentifier: "mascaras-src"})
+	require.EqualValues(t, []string{"", "create_instance", "wait_available", "approval", "create_snapshot", "cleanup"}, steps)
+	bs, err := os.ReadFile(app.cfg.Approval.SummaryLocation)
+	require.NoError(t, err)
+	var summary approvalSummary
+	require.NoError(t, json.Unmarshal(bs, &summary))
+	require.EqualValues(t, "0123456789abcdef", summary.RunID)
+	require.Len(t, summary.Tables, 4)
+	require.NoFileExists(t, app.cfg.Approval.SignalLocation, "consumed signal is deleted")
+}
+
+func TestAppScaleDown(t *testing.T) {
+	app := newTestApp(t)
+	app.cfg.TempCluster.SQLDBInstanceClass = "db.r5.4xlarge"
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	report, err := app.Run(ctx, "mascaras-test")
+	require.NoError(t, err)
+	require.EqualValues(t, []string{"db.t3.small"}, app.svc.modifiedClasses)
+	require.EqualValues(t, "db.t3.small", app.svc.dbInstanceClass)
+	require.EqualValues(t, []string{"prepare", "restore", "create_instance", "wait_available", "execute_sql", "scale_down", "wait_restorable", "create_snapshot", "cleanup"}, stageNames(report))
+
+	app.resetRDSService()
+	_, steps := app.runSteps(t, &State{SourceDBClusterIdentifier: "mascaras-src"})
+	require.EqualValues(t, []string{"", "create_instance", "wait_available", "execute_sql", "scale_down", "wait_restorable", "create_snapshot", "cleanup"}, steps)
+	require.EqualValues(t, []string{"db.t3.small"}, app.svc.modifiedClasses)
+
+	// scaled down after the subset without SQL
+	app.cfg.SQLFile = ""
+	app.cfg.Subset = SubsetConfig{
+		Roots: []SubsetRootConfig{{Table: "users", Percent: 10}},
+	}
+	app.resetRDSService()
+	report, err = app.Run(ctx, "mascaras-test")
+	require.NoError(t, err)
+	require.EqualValues(t, []string{"prepare", "restore", "create_instance", "wait_available", "subset", "scale_down", "wait_restorable", "create_snapshot", "cleanup"}, stageNames(report))
+	require.EqualValues(t, []string{"db.t3.small"}, app.svc.modifiedClasses)
+
+	app.resetRDSService()
+	_, steps = app.runSteps(t, &State{SourceDBClusterIdentifier: "mascaras-src"})
+	require.EqualValues(t, []string{"", "create_instance", "wait_available", "subset", "scale_down", "wait_restorable", "create_snapshot", "cleanup"}, steps)
+	require.EqualValues(t, []string{"db.t3.small"}, app.svc.modifiedClasses)
+}
+
+func TestAppServerless(t *testing.T) {
+	app := newTestApp(t)
+	app.cfg.TempCluster.DBInstanceClass = "db.serverless"
+	app.cfg.TempCluster.MinCapacity = 0.5
+	app.cfg.TempCluster.MaxCapacity = 2
+	app.cfg.TempCluster.SQLMinCapacity = 8
+	app.cfg.TempCluster.SQLMaxCapacity = 64
+	require.NoError(t, app.cfg.Validate())
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := app.Run(ctx, "mascaras-test")
+	require.NoError(t, err)
+	require.EqualValues(t, "db.serverless", app.svc.dbInstanceClass)
+	require.Empty(t, app.svc.modifiedClasses)
+	require.EqualValues(t, []*rds.ServerlessV2ScalingConfiguration{
+		{MinCapacity: aws.Float64(0.5), MaxCapacity: aws.Float64(2)},
+	}, app.svc.modifiedScalings)
+
+	app.resetRDSService()
+	state := &State{SourceDBClusterIdentifier: "mascaras-src"}
+	for !state.Done {
+		input := *state
+		state, err = app.Step(ctx, &input)
+		require.NoError(t, err)
+		if input.Step == StepCreateInstance {
+			require.EqualValues(t, &rds.ServerlessV2ScalingConfiguration{MinCapacity: aws.Float64(8), MaxCapacity: aws.Float64(64)}, app.svc.scaling)
+		}
+		if state.Wait {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	require.Len(t, app.svc.modifiedScalings, 1)
+}
+
+func TestAppRunNetworkAndParameters(t *testing.T) {
+	app := newTestApp(t)
+	app.cfg.TempCluster.DBSubnetGroupName = "masking-subnet"
+	app.cfg.TempCluster.DBClusterParameterGroupName = "masking-cluster-params"
+	app.cfg.TempCluster.DBParameterGroupName = "masking-instance-params"
+	app.cfg.TempCluster.AvailabilityZone = "ap-northeast-1a"
+	app.cfg.TempCluster.KmsKeyID = "alias/masking"
+	app.cfg.TempCluster.Port = 13306
+	app.cfg.TempCluster.EnableIAMDatabaseAuthentication = true
+	require.NoError(t, app.cfg.Validate())
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := app.Run(ctx, "mascaras-test")
+	require.NoError(t, err)
+
+	restore := app.svc.restoreInput
+	require.EqualValues(t, "masking-subnet", aws.StringValue(restore.DBSubnetGroupName))
+	require.EqualValues(t, "masking-cluster-params", aws.StringValue(restore.DBClusterParameterGroupName))
+	require.EqualValues(t, "alias/masking", aws.StringValue(restore.KmsKeyId))
+	require.EqualValues(t, 13306, aws.Int64Value(restore.Port))
+	require.True(t, aws.BoolValue(restore.EnableIAMDatabaseAuthentication))
+	instance := app.svc.createInstanceInput
+	require.EqualValues(t, "masking-instance-params", aws.StringValue(instance.DBParameterGroupName))
+	require.EqualValues(t, "ap-northeast-1a", aws.StringValue(instance.AvailabilityZone))
+	require.EqualValues(t, []int{13306}, app.ports)
+
+	app.resetRDSService()
+	app.cfg = DefaultConfig()
+	app.cfg.TempCluster.DBClusterIdentifier = MockSuccessDBClusterIdentifier
+	app.cfg.SQLFile = "testdata/mask.sql"
+	_, err = app.Run(ctx, "mascaras-test")
+	require.NoError(t, err)
+	require.Nil(t, app.svc.restoreInput.DBSubnetGroupName, "unset parameters are not passed")
+	require.Nil(t, app.svc.restoreInput.Port)
+	require.Nil(t, app.svc.restoreInput.EnableIAMDatabaseAuthentication)
+	require.Nil(t, app.svc.createInstanceInput.AvailabilityZone)
+}
+
+func TestAppCopySnapshot(t *testing.T) {
+	app := newTestApp(t)
+	app.cfg.Snapshot.KmsKeyID = "alias/developer"
+	app.cfg.Snapshot.DeleteOriginal = true
+	require.NoError(t, app.cfg.Validate())
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	report, err := app.Run(ctx, "mascaras-src")
+	require.NoError(t, err)
+	copied := MockSuccessDBClusterIdentifier + "-snapshot"
+	original := copied + "-original"
+	require.EqualValues(t, copied, report.SnapshotIdentifier)
+	require.EqualValues(t, dbClusterSnapshotARNPrefix+copied, report.SnapshotArn)
+	require.EqualValues(t, original, report.OriginalSnapshotIdentifier)
+	require.EqualValues(t, dbClusterSnapshotARNPrefix+original, report.OriginalSnapshotArn)
+	require.EqualValues(t, original, *app.svc.copySnapshotInput.SourceDBClusterSnapshotIdentifier)
+	require.EqualValues(t, "alias/developer", *app.svc.copySnapshotInput.KmsKeyId)
+	require.EqualValues(t, []string{original}, app.svc.deletedSnapshots)
+	require.True(t, app.svc.isDeleteCluster)
+
+	app.resetRDSService()
+	app.cfg.Snapshot.DeleteOriginal = false
+	app.cfg.EnableExportTask = true
+	state, steps := app.runSteps(t, &State{SourceDBClusterIdentifier: "mascaras-src"})
+	require.EqualValues(t, []string{"", "create_instance", "wait_available", "execute_sql", "wait_restorable", "create_snapshot", "cleanup", "wait_snapshot", "copy_snapshot", "wait_snapshot_copy", "export_task"}, steps)
+	require.EqualValues(t, copied, state.SnapshotIdentifier)
+	require.EqualValues(t, original, state.OriginalSnapshotIdentifier)
+	require.EqualValues(t, dbClusterSnapshotARNPrefix+copied, app.svc.exportSourceArn)
+	require.Empty(t, app.svc.deletedSnapshots)
+
+	cfg := DefaultConfig()
+	cfg.TempCluster.DBClusterIdentifier = MockSuccessDBClusterIdentifier
+	cfg.Snapshot.DeleteOriginal = true
+	require.EqualError(t, cfg.Validate(), "snapshot-delete-original requires snapshot-kms-key-id")
+}
+
+func TestAppRunNameTemplates(t *testing.T) {
+	flextime.Fix(time.Date(2022, 10, 01, 9, 0, 0, 0, time.UTC))
+	defer flextime.Restore()
+	app := newTestApp(t)
+	app.cfg.Snapshot.Identifier = `masked-${ .SourceDBClusterIdentifier }-${ now.Format "20060102" }`
+	app.cfg.EnableExportTask = true
+	app.cfg.ExportTask.IAMRoleArn = "arn:aws:iam::000000000000:role/export-role"
+	app.cfg.ExportTask.KMSKeyId = "alias/export"
+	app.cfg.ExportTask.S3Bucket = "export-bucket"
+	app.cfg.ExportTask.TaskIdentifier = `export-${ .RunID }`
+	require.NoError(t, app.cfg.Validate())
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	report, err := app.Run(ctx, "mascaras-src")
+	require.NoError(t, err)
+	require.EqualValues(t, "masked-mascaras-src-20221001", report.SnapshotIdentifier)
+	require.EqualValues(t, dbClusterSnapshotARNPrefix+"masked-mascaras-src-20221001", report.SnapshotArn)
+	require.EqualValues(t, "export-"+report.RunID, report.ExportTaskIdentifier)
+
+	app.resetRDSService()
+	state, _ := app.runSteps(t, &State{SourceDBClusterIdentifier: "mascaras-src"})
+	require.EqualValues(t, "masked-mascaras-src-20221001", state.SnapshotIdentifier)
+	require.EqualValues(t, "export-"+state.RunID, state.ExportTaskIdentifier)
+
+	// the re-encrypted copy has the templated identifier, and the original is deleted.
+	app.resetRDSService()
+	app.cfg.EnableExportTask = false
+	app.cfg.Snapshot.KmsKeyID = "alias/developer"
+	app.cfg.Snapshot.DeleteOriginal = true
+	report, err = app.Run(ctx, "mascaras-src")
+	require.NoError(t, err)
+	require.EqualValues(t, "masked-mascaras-src-20221001", report.SnapshotIdentifier)
+	require.EqualValues(t, "masked-mascaras-src-20221001-original", report.OriginalSnapshotIdentifier)
+	require.EqualValues(t, "masked-mascaras-src-20221001", *app.svc.copySnapshotInput.TargetDBClusterSnapshotIdentifier)
+	require.EqualValues(t, []string{"masked-mascaras-src-20221001-original"}, app.svc.deletedSnapshots)
+	app.cfg.Snapshot.KmsKeyID = ""
+	app.cfg.Snapshot.DeleteOriginal = false
+
+	_, err = app.Run(ctx, "mascaras--src")
+	require.EqualError(t, err, "snapshot identifier `masked-mascaras--src-20221001` can't end with a hyphen or contain two consecutive hyphens")
+}
+
+func TestConfigValidateNameTemplates(t *testing.T) {
+	cases := []struct {
+		snapshot   string
+		exportTask string
+		errMsg     string
+	}{
+		{snapshot: `masked-${ .SourceDBClusterIdentifier }-${ now.Format "2006-01-02" }`},
+		{exportTask: `${ .JobName }-${ .RunID }`},
+		{
+			snapshot: `masked-${ .Source }`,
+			errMsg:   `template: snapshot-identifier:1:10: executing "snapshot-identifier" at <.Source>: can't evaluate field Source in type mascaras.nameTemplateData`,
+		},
+		{
+			snapshot: `masked-${ .SourceDBClusterIdentifier`,
+			errMsg:   `template: snapshot-identifier:1: unclosed action`,
+		},
+		{
+			snapshot: `${ now.Format "2006" }-masked`,
+			errMsg:   "snapshot identifier `2022-masked` must start with a letter and contain only letters, digits and hyphens",
+		},
+		{
+			snapshot: `masked_${ .RunID }`,
+			errMsg:   "snapshot identifier `masked_abcdefghij012345` must start with a letter and contain only letters, digits and hyphens",
+		},
+		{
+			exportTask: `export-${ .SourceDBClusterIdentifier }-${ .TempDBClusterIdentifier }-${ .RunID }-${ .JobName }-at-${ now.Unix }`,
+			errMsg:     "export task identifier `export-source-cluster-mascaras-test-abcdefghij012345-job-at-1664614800` must be 1 to 60 characters",
+		},
+	}
+	flextime.Fix(time.Date(2022, 10, 01, 9, 0, 0, 0, time.UTC))
+	defer flextime.Restore()
+	for _, c := range cases {
+		cfg := DefaultConfig()
+		cfg.TempCluster.DBClusterIdentifier = MockSuccessDBClusterIdentifier
+		cfg.Snapshot.Identifier = c.snapshot
+		cfg.ExportTask.TaskIdentifier = c.exportTask
+		err := cfg.Validate()
+		if c.errMsg == "" {
+			require.NoError(t, err)
+		} else {
+			require.EqualError(t, err, c.errMsg)
+		}
+	}
+}
+
+func TestAppPublish(t *testing.T) {
+	dir := t.TempDir()
+	ssmSvc := &mockSSMService{}
+	app := newTestApp(t)
+	app.publishSinks = []*publishSink{
+		{publisher: &ssmPublisher{svc: ssmSvc}, name: "ssm", target: "/mascaras/latest/${ .SourceDBClusterIdentifier }"},
+		{publisher: locationPublisher{}, name: "file", target: filepath.Join(dir, "${ .SourceDBClusterIdentifier }.json")},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	report, err := app.Run(ctx, "mascaras-src")
+	require.NoError(t, err)
+	require.EqualValues(t, []string{"prepare", "restore", "create_instance", "wait_available", "execute_sql", "wait_restorable", "create_snapshot", "cleanup", "wait_snapshot", "publish"}, stageNames(report))
+
+	var published SnapshotPublication
+	require.NoError(t, json.Unmarshal([]byte(ssmSvc.parameters["/mascaras/latest/mascaras-src"]), &published))
+	require.EqualValues(t, "mascaras-src", published.SourceDBClusterIdentifier)
+	require.EqualValues(t, MockSuccessDBClusterIdentifier+"-snapshot", published.SnapshotIdentifier)
+	require.EqualValues(t, report.SnapshotArn, published.SnapshotArn)
+	require.EqualValues(t, report.RunID, published.RunID)
+	require.NotNil(t, published.MaskedTime)
+	bs, err := os.ReadFile(filepath.Join(dir, "mascaras-src.json"))
+	require.NoError(t, err)
+	require.JSONEq(t, ssmSvc.parameters["/mascaras/latest/mascaras-src"], string(bs))
+
+	app.resetRDSService()
+	ssmSvc.parameters = nil
+	state, steps := app.runSteps(t, &State{SourceDBClusterIdentifier: "mascaras-src"})
+	require.EqualValues(t, []string{"", "create_instance", "wait_available", "execute_sql", "wait_restorable", "create_snapshot", "cleanup", "wait_snapshot", "publish"}, steps)
+	require.Contains(t, ssmSvc.parameters["/mascaras/latest/mascaras-src"], state.RunID)
+}
+
+func TestPublishConfigValidate(t *testing.T) {
+	cases := []struct {
+		cfg    PublishConfig
+		errMsg string
+	}{
+		{cfg: PublishConfig{Type: "ssm", Name: "/mascaras/latest/${ .SourceDBClusterIdentifier }"}},
+		{cfg: PublishConfig{Type: "s3", Location: "s3://bucket/latest.json"}},
+		{cfg: PublishConfig{Type: "file", Location: "latest.json"}},
+		{cfg: PublishConfig{Type: "ssm"}, errMsg: "name is required for ssm publish"},
+		{cfg: PublishConfig{Type: "s3", Location: "latest.json"}, errMsg: "location s3://bucket/key is required for s3 publish"},
+		{cfg: PublishConfig{Type: "file", Location: "s3://bucket/latest.json"}, errMsg: "location file path is required for file publish"},
+		{cfg: PublishConfig{Type: "ssm", Name: "/mascaras/${ .Source }"}, errMsg: `template: ssm publish target:1:13: executing "ssm publish target" at <.Source>: can't evaluate field Source in type mascaras.nameTemplateData`},
+		{cfg: PublishConfig{Type: "dynamodb"}, errMsg: "unknown publish type `dynamodb`. ssm, s3 or file"},
+	}
+	for _, c := range cases {
+		err := c.cfg.Validate()
+		if c.errMsg == "" {
+			require.NoError(t, err)
+		} else {
+			require.EqualError(t, err, c.errMsg)
+		}
+	}
+}
+
+func TestAppRunTarget(t *testing.T) {
+	newTargetClusters := func() map[string]*rds.DBCluster {
+		return map[string]*rds.DBCluster{
+			MockTargetDBClusterIdentifier: {
+				DBClusterIdentifier: aws.String(MockTargetDBClusterIdentifier),
+				DbClusterResourceId: aws.String("cluster-old"),
+				Status:              aws.String("available"),
+				DBClusterMembers: []*rds.DBClusterMember{
+					{DBInstanceIdentifier: aws.String(MockTargetDBClusterIdentifier + "-instance")},
+				},
+			},
+		}
+	}
+	app := newTestApp(t)
+	app.svc.targetClusters = newTargetClusters()
+	app.cfg.Target.DBClusterIdentifier = MockTargetDBClusterIdentifier
+	app.cfg.Target.DBInstanceClass = "db.r6g.large"
+	app.cfg.Target.DeletionProtection = true
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	report, err := app.Run(ctx, "mascaras-src")
+	require.NoError(t, err)
+	require.EqualValues(t, []string{"prepare", "restore", "create_instance", "wait_available", "execute_sql", "wait_restorable", "create_snapshot", "cleanup", "wait_snapshot", "restore_target", "wait_target", "swap_target", "delete_old_target"}, stageNames(report))
+	require.EqualValues(t, MockTargetDBClusterIdentifier, report.TargetDBClusterIdentifier)
+	require.EqualValues(t, "8.0.mysql_aurora.3.02.0", aws.StringValue(app.svc.targetInput.EngineVersion), "restored with the engine version of the snapshot")
+
+	names := targetClusterNamesOf(MockTargetDBClusterIdentifier, report.RunID)
+	require.EqualValues(t, []string{
+		names.Target + "->" + names.Old,
+		names.Green + "->" + names.Target,
+	}, app.svc.renamedClusters)
+	require.EqualValues(t, []string{names.Target + "-instance", names.Old}, app.svc.deletedTargets)
+	require.Len(t, app.svc.targetClusters, 1)
+	target := app.svc.targetClusters[MockTargetDBClusterIdentifier]
+	require.EqualValues(t, "cluster-"+names.Green, *target.DbClusterResourceId)
+	require.True(t, *target.DeletionProtection)
+
+	// the first refresh, without the old target.
+	app.resetRDSService().targetClusters = map[string]*rds.DBCluster{}
+	state, steps := app.runSteps(t, &State{SourceDBClusterIdentifier: "mascaras-src"})
+	require.EqualValues(t, []string{"", "create_instance", "wait_available", "execute_sql", "wait_restorable", "create_snapshot", "cleanup", "wait_snapshot", "restore_target", "wait_target", "swap_target", "delete_old_target"}, steps)
+	names = targetClusterNamesOf(MockTargetDBClusterIdentifier, state.RunID)
+	require.EqualValues(t, []string{names.Green + "->" + names.Target}, app.svc.renamedClusters)
+	require.Empty(t, app.svc.deletedTargets)
+	require.Contains(t, app.svc.targetClusters, MockTargetDBClusterIdentifier)
+}
+
+func TestTargetClusterConfigValidate(t *testing.T) {
+	cases := []struct {
+		cfg    TargetClusterConfig
+		errMsg string
+	}{
+		{cfg: TargetClusterConfig{}},
+		{cfg: TargetClusterConfig{DBClusterIdentifier: "staging", DBInstanceClass: "db.r6g.large"}},
+		{cfg: TargetClusterConfig{DBClusterIdentifier: "staging"}, errMsg: "target-db-instance-class is required if target-db-cluster-identifier is set"},
+		{cfg: TargetClusterConfig{DBClusterIdentifier: "staging_db", DBInstanceClass: "db.r6g.large"}, errMsg: "target db cluster identifier `staging_db` must start with a letter and contain only letters, digits and hyphens"},
+		{cfg: TargetClusterConfig{DBClusterIdentifier: strings.Repeat("a", 51), DBInstanceClass: "db.r6g.large"}, errMsg: "target db cluster identifier `" + strings.Repeat("a", 51) + "` must be 1 to 50 characters"},
+	}
+	for _, c := range cases {
+		err := c.cfg.Validate()
+		if c.errMsg == "" {
+			require.NoError(t, err)
+		} else {
+			require.EqualError(t, err, c.errMsg)
+		}
+	}
+}
+
+func TestAppRunDump(t *testing.T) {
+	dir := t.TempDir()
+	app := newTestApp(t)
+	app.cfg.Database = "db01"
+	app.cfg.Dump.Location = filepath.Join(dir, "${ .SourceDBClusterIdentifier }")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	report, err := app.Run(ctx, "mascaras-src")
+	require.NoError(t, err)
+	require.EqualValues(t, []string{"prepare", "restore", "create_instance", "wait_available", "execute_sql", "dump", "wait_restorable", "create_snapshot", "cleanup"}, stageNames(report))
+	require.Len(t, report.DumpTables, 4)
+	for i, table := range []string{"access_log", "oauth_tokens", "roles", "users"} {
+		loc := filepath.Join(dir, "mascaras-src", "db01", table+".sql.gz")
+		require.EqualValues(t, "db01", report.DumpTables[i].Database)
+		require.EqualValues(t, table, report.DumpTables[i].Table)
+		require.EqualValues(t, loc, report.DumpTables[i].Location)
+		require.EqualValues(t, 2, report.DumpTables[i].Rows)
+		f, err := os.Open(loc)
+		require.NoError(t, err)
+		r, err := gzip.NewReader(f)
+		require.NoError(t, err)
+		bs, err := io.ReadAll(r)
+		f.Close()
+		require.NoError(t, err)
+		require.Contains(t, string(bs), "INSERT INTO `"+table+"`")
+	}
+
+	// dump only, without the snapshot.
+	app.cfg.Dump.SkipSnapshot = true
+	require.NoError(t, os.RemoveAll(dir))
+	app.resetRDSService()
+	report, err = app.Run(ctx, "mascaras-src")
+	require.NoError(t, err)
+	require.EqualValues(t, []string{"prepare", "restore", "create_instance", "wait_available", "execute_sql", "dump", "cleanup"}, stageNames(report))
+	require.Empty(t, report.SnapshotIdentifier)
+	require.FileExists(t, filepath.Join(dir, "mascaras-src", "db01", "users.sql.gz"))
+
+	require.NoError(t, os.RemoveAll(dir))
+	app.resetRDSService()
+	state, steps := app.runSteps(t, &State{SourceDBClusterIdentifier: "mascaras-src"})
+	require.EqualValues(t, []string{"", "create_instance", "wait_available", "execute_sql", "dump", "cleanup"}, steps)
+	require.Empty(t, state.SnapshotArn)
+	require.FileExists(t, filepath.Join(dir, "mascaras-src", "db01", "roles.sql.gz"))
+}
+
+func TestDumpLiteral(t *testing.T) {
+	cases := []struct {
+		dbtype string
+		value  interface{}
+		binary bool
+		expect string
+	}{
+		{dbtype: "mysql", value: nil, expect: "NULL"},
+		{dbtype: "mysql", value: []byte("it's\n\\"), expect: `'it\'s\n\\'`},
+		{dbtype: "mysql", value: []byte{0xde, 0xad}, binary: true, expect: "X'dead'"},
+		{dbtype: "mysql", value: int64(-42), expect: "-42"},
+		{dbtype: "mysql", value: 1.5, expect: "1.5"},
+		{dbtype: "mysql", value: time.Date(2022, 10, 1, 9, 12, 34, 500000000, time.UTC), expect: "'2022-10-01 09:12:34.5'"},
+		{dbtype: "postgresql", value: []byte("it's\n\\"), expect: "'it''s\n\\'"},
+		{dbtype: "postgresql", value: []byte{0xde, 0xad}, binary: true, expect: `'\xdead'`},
+		{dbtype: "postgresql", value: true, expect: "TRUE"},
+		{dbtype: "postgresql", value: math.Inf(-1), expect: "'-Infinity'"},
+		{dbtype: "postgresql", value: time.Date(2022, 10, 1, 9, 12, 34, 0, time.UTC), expect: "'2022-10-01T09:12:34Z'"},
+	}
+	for _, c := range cases {
+		require.EqualValues(t, c.expect, dumpLiteral(c.dbtype, c.value, c.binary), "%s %#v", c.dbtype, c.value)
+	}
+	require.EqualValues(t, "`a``b`", quoteIdentifier("mysql", "a`b"))
+	require.EqualValues(t, `"a""b"`, quoteIdentifier("postgresql", `a"b`))
+}
+
+func TestPostgreSQLDumpSchema(t *testing.T) {
+	require.EqualValues(t, `"id" bigint GENERATED ALWAYS AS IDENTITY (INCREMENT BY 1 MINVALUE 1 MAXVALUE 9223372036854775807 START WITH 1 CACHE 1 NO CYCLE) NOT NULL`,
+		pgColumnDefinition(
+			pgColumn{name: "id", typ: "bigint", notNull: true, identity: "a"},
+			pgSequence{name: "users_id_seq", increment: 1, min: 1, max: 9223372036854775807, start: 1, cache: 1},
+		))
+	require.EqualValues(t, `"name" text COLLATE "C" DEFAULT ''::text NOT NULL`,
+		pgColumnDefinition(pgColumn{name: "name", typ: "text", notNull: true, def: "''::text", collation: `"C"`}, pgSequence{}))
+	require.EqualValues(t, `"total" integer GENERATED ALWAYS AS ((price * quantity)) STORED`,
+		pgColumnDefinition(pgColumn{name: "total", typ: "integer", def: "(price * quantity)", generated: "s"}, pgSequence{}))
+
+	seq := pgSequence{name: "orders_id_seq", typ: "integer", increment: 1, min: 1, max: 2147483647, start: 1, cache: 1, column: "id", deptype: "a", lastValue: 42, isCalled: true}
+	require.EqualValues(t, "CREATE SEQUENCE IF NOT EXISTS orders_id_seq AS integer INCREMENT BY 1 MINVALUE 1 MAXVALUE 2147483647 START WITH 1 CACHE 1 NO CYCLE", pgCreateSequenceStatement(seq))
+	require.EqualValues(t, "SELECT pg_catalog.setval('orders_id_seq', 42, true)", pgSetvalStatement(`"orders"`, seq))
+	seq.deptype = "i"
+	require.EqualValues(t, `SELECT pg_catalog.setval(pg_catalog.pg_get_serial_sequence('"orders"', 'id'), 42, true)`, pgSetvalStatement(`"orders"`, seq))
+
+	require.EqualValues(t, "DO $mascaras$ BEGIN\n  CREATE TYPE mood AS ENUM ('sad', 'it''s ok');\nEXCEPTION WHEN duplicate_object THEN NULL;\nEND $mascaras$",
+		pgCreateTypeStatement(pgType{name: "mood", typtype: "e", labels: []string{"sad", "it's ok"}}))
+	require.EqualValues(t, "DO $mascaras$ BEGIN\n  CREATE DOMAIN price AS numeric(10,2) DEFAULT 0 NOT NULL CONSTRAINT price_check CHECK ((VALUE >= (0)::numeric));\nEXCEPTION WHEN duplicate_object THEN NULL;\nEND $mascaras$",
+		pgCreateTypeStatement(pgType{name: "price", typtype: "d", base: "numeric(10,2)", def: "0", notNull: true, checks: [][2]string{{"price_check", "CHECK ((VALUE >= (0)::numeric))"}}}))
+}
+
+func TestAppDumpForeignKeys(t *testing.T) {
+	app := newTestApp(t)
+	dir := t.TempDir()
+	app.cfg.Database = "db01"
+	reports, err := app.dump(context.Background(), "postgresql", dir, "localhost", 5432)
+	require.NoError(t, err)
+	require.Len(t, reports, 4)
+	f, err := os.Open(filepath.Join(dir, "db01.foreign_keys.sql.gz"))
+	require.NoError(t, err)
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	bs, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.EqualValues(t, "ALTER TABLE users ADD CONSTRAINT users_role_id_fkey FOREIGN KEY (role_id) REFERENCES roles(id);\n", string(bs))
+
+	// MySQL tables include the foreign keys.
+	dir = t.TempDir()
+	_, err = app.dump(context.Background(), "mysql", dir, "localhost", 3306)
+	require.NoError(t, err)
+	require.NoFileExists(t, filepath.Join(dir, "db01.foreign_keys.sql.gz"))
+}
+
+func TestConfigValidateDump(t *testing.T) {
+	cases := []struct {
+		modify func(cfg *Config)
+		errMsg string
+	}{
+		{modify: func(cfg *Config) { cfg.Dump.Location = "s3://bucket/dump" }},
+		{modify: func(cfg *Config) { cfg.Dump.Location = "./dump"; cfg.Dump.SkipSnapshot = true }},
+		{modify: func(cfg *Config) { cfg.Dump.SkipSnapshot = true }, errMsg: "dump-skip-snapshot requires dump-location"},
+		{modify: func(cfg *Config) {
+			cfg.Dump.Location = "./dump"
+			cfg.Dump.SkipSnapshot = true
+			cfg.Publish = []PublishConfig{{Type: "file", Location: "latest.json"}}
+		}, errMsg: "dump-skip-snapshot can not be used with publish"},
+		{modify: func(cfg *Config) { cfg.Dump.Location = "./dump/${ .Source }" }, errMsg: `template: dump-location:1:10: executing "dump-location" at <.Source>: can't evaluate field Source in type mascaras.nameTemplateData`},
+	}
+	for _, c := range cases {
+		cfg := DefaultConfig()
+		cfg.TempCluster.DBClusterIdentifier = "mascaras-temp"
+		c.modify(cfg)
+		err := cfg.Validate()
+		if c.errMsg == "" {
+			require.NoError(t, err)
+		} else {
+			require.EqualError(t, err, c.errMsg)
+		}
+	}
+}
+
+func TestAppRunSubset(t *testing.T) {
+	app := newTestApp(t)
+	app.cfg.Database = "db01"
+	app.cfg.Subset.Roots = []SubsetRootConfig{
+		{Table: "users", Where: "created_at > NOW() - INTERVAL 30 DAY", Percent: 10},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	report, err := app.Run(ctx, "mascaras-src")
+	require.NoError(t, err)
+	require.EqualValues(t, []string{"prepare", "restore", "create_instance", "wait_available", "subset", "execute_sql", "wait_restorable", "create_snapshot", "cleanup"}, stageNames(report))
+	require.EqualValues(t, []string{
+		"DELETE FROM `users` WHERE NOT COALESCE((created_at > NOW() - INTERVAL 30 DAY), FALSE) OR RAND() * 100 >= 10",
+		"DELETE c FROM `comments` AS c LEFT JOIN `users` AS p ON p.`id` = c.`user_id` WHERE c.`user_id` IS NOT NULL AND p.`id` IS NULL",
+		"DELETE c FROM `orders` AS c LEFT JOIN `users` AS p ON p.`id` = c.`user_id` WHERE c.`user_id` IS NOT NULL AND p.`id` IS NULL",
+		"DELETE c FROM `comments` AS c LEFT JOIN `comments` AS p ON p.`id` = c.`parent_id` WHERE c.`parent_id` IS NOT NULL AND p.`id` IS NULL",
+		"DELETE c FROM `order_items` AS c LEFT JOIN `orders` AS p ON p.`id` = c.`order_id` WHERE c.`order_id` IS NOT NULL AND p.`id` IS NULL",
+		"DELETE c FROM `comments` AS c LEFT JOIN `comments` AS p ON p.`id` = c.`parent_id` WHERE c.`parent_id` IS NOT NULL AND p.`id` IS NULL",
+	}, app.executers[0].subsetQueries)
+	require.EqualValues(t, []SubsetTableReport{
+		{Database: "db01", Table: "users", RowsDeleted: 10},
+		{Database: "db01", Table: "comments", RowsDeleted: 20},
+		{Database: "db01", Table: "orders", RowsDeleted: 10},
+		{Database: "db01", Table: "order_items", RowsDeleted: 10},
+	}, report.SubsetTables)
+
+	// subset without SQL waits for the deletion to be restorable.
+	app.cfg.SQLFile = ""
+	app.resetRDSService()
+	state, steps := app.runSteps(t, &State{SourceDBClusterIdentifier: "mascaras-src"})
+	require.EqualValues(t, []string{"", "create_instance", "wait_available", "subset", "wait_restorable", "create_snapshot", "cleanup"}, steps)
+	require.NotNil(t, state.MaskedTime)
+}
+
+func TestSubsetQuery(t *testing.T) {
+	fk := foreignKey{
+		Name:       "fk_order_items_order",
+		Table:      "order_items",
+		Columns:    []string{"shop_id", "order_id"},
+		RefTable:   "orders",
+		RefColumns: []string{"shop_id", "id"},
+	}
+	require.EqualValues(t,
+		"DELETE c FROM `order_items` AS c LEFT JOIN `orders` AS p ON p.`shop_id` = c.`shop_id` AND p.`id` = c.`order_id` WHERE c.`shop_id` IS NOT NULL AND c.`order_id` IS NOT NULL AND p.`shop_id` IS NULL",
+		subsetOrphanQuery("mysql", fk),
+	)
+	require.EqualValues(t,
+		`DELETE FROM "order_items" AS c WHERE c."shop_id" IS NOT NULL AND c."order_id" IS NOT NULL AND NOT EXISTS (SELECT 1 FROM "orders" AS p WHERE p."shop_id" = c."shop_id" AND p."id" = c."order_id")`,
+		subsetOrphanQuery("postgresql", fk),
+	)
+	require.EqualValues(t,
+		`DELETE FROM "users" WHERE random() * 100 >= 2.5`,
+		subsetRootQuery("postgresql", SubsetRootConfig{Table: "users", Percent: 2.5}),
+	)
+}
+
+func TestSubsetConfigValidate(t *testing.T) {
+	cases := []struct {
+		cfg    SubsetConfig
+		errMsg string
+	}{
+		{cfg: SubsetConfig{}},
+		{cfg: SubsetConfig{Roots: []SubsetRootConfig{{Table: "users", Where: "id < 1000"}, {Table: "shops", Percent: 10}}}},
+		{cfg: SubsetConfig{Roots: []SubsetRootConfig{{Where: "id < 1000"}}}, errMsg: "subset.roots[0]: table is required"},
+		{cfg: SubsetConfig{Roots: []SubsetRootConfig{{Table: "users", Percent: 10}, {Table: "users", Percent: 20}}}, errMsg: "subset.roots[1]: table `users` is duplicated"},
+		{cfg: SubsetConfig{Roots: []SubsetRootConfig{{Table: "users"}}}, errMsg: "subset.roots[0]: where or percent is required"},
+		{cfg: SubsetConfig{Roots: []SubsetRootConfig{{Table: "users", Percent: 120}}}, errMsg: "subset.roots[0]: percent must be between 0 and 100, got 120"},
+	}
+	for _, c := range cases {
+		err := c.cfg.Validate()
+		if c.errMsg == "" {
+			require.NoError(t, err)
+		} else {
+			require.EqualError(t, err, c.errMsg)
+		}
+	}
+}
+
+func TestAppRunTableStatements(t *testing.T) {
+	app := newTestApp(t)
+	app.cfg.TruncateTables = []string{"*_log", "oauth_*", "sessions"}
+	app.cfg.DropTables = []string{"oauth_*"}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := app.Run(ctx, "mascaras-src")
+	require.NoError(t, err)
+	require.Len(t, app.executers, 1)
+	expected := "SET FOREIGN_KEY_CHECKS = 0;\nDROP TABLE IF EXISTS `oauth_tokens`;\nTRUNCATE TABLE `access_log`;\nSET FOREIGN_KEY_CHECKS = 1;\n"
+	require.True(t, strings.HasPrefix(app.executers[0].executeSQL.String(), expected), app.executers[0].executeSQL.String())
+	require.Contains(t, app.executers[0].executeSQL.String(), "update users")
+
+	// tables are truncated without SQL files.
+	app.resetExecuters()
+	app.cfg.SQLFile = ""
+	app.rdsSvc = &mockRDSService{}
+	report, err := app.Run(ctx, "mascaras-src")
+	require.NoError(t, err)
+	require.EqualValues(t, []string{"prepare", "restore", "create_instance", "wait_available", "execute_sql", "wait_restorable", "create_snapshot", "cleanup"}, stageNames(report))
+	require.EqualValues(t, expected, app.executers[0].executeSQL.String())
+}
+
+func TestTableStatements(t *testing.T) {
+	matched, unmatched := matchTables([]string{"access_log", "error_log", "oauth_tokens", "users"}, []string{"*_log", "sessions"})
+	require.EqualValues(t, []string{"access_log", "error_log"}, matched)
+	require.EqualValues(t, []string{"sessions"}, unmatched)
+	require.EqualValues(t,
+		"DROP TABLE IF EXISTS \"tmp\" CASCADE;\nTRUNCATE TABLE \"access_log\", \"error_log\";\n",
+		tableStatements("postgresql", []string{"tmp"}, []string{"access_log", "error_log"}),
+	)
+	require.EqualError(t,
+		validateTablePatterns("truncate_tables", []string{"logs_[0-9"}),
+		"truncate_tables: pattern `logs_[0-9`: syntax error in pattern",
+	)
+}
+
+func TestAppRunClassification(t *testing.T) {
+	app := newTestApp(t)
+	app.cfg.Database = "mascaras"
+	app.cfg.ClassificationFile = "testdata/classification.yml"
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	report, err := app.Run(ctx, "mascaras-src")
+	require.EqualError(t, err, "2 columns are not classified in testdata/classification.yml")
+	require.Equal(t, "check_classification", report.FailedStage)
+	require.EqualValues(t, []string{"mascaras.oauth_tokens.id", "mascaras.oauth_tokens.token"}, report.UnclassifiedColumns)
+	require.Len(t, app.executers, 1)
+	require.Empty(t, app.executers[0].executeSQL.String(), "SQL must not be executed")
+
+	// dropped tables need no classification.
+	app.resetExecuters()
+	app.cfg.DropTables = []string{"oauth_*"}
+	app.rdsSvc = &mockRDSService{}
+	report, err = app.Run(ctx, "mascaras-src")
+	require.NoError(t, err)
+	require.Empty(t, report.UnclassifiedColumns)
+	require.EqualValues(t, []string{"prepare", "restore", "create_instance", "wait_available", "check_classification", "execute_sql", "wait_restorable", "create_snapshot", "cleanup"}, stageNames(report))
+	require.Len(t, app.executers, 2)
+	require.Contains(t, app.executers[1].executeSQL.String(), "update users")
+}
+
+func TestClassification(t *testing.T) {
+	c, err := readClassification("testdata/classification.yml")
+	require.NoError(t, err)
+	require.True(t, c.classified("mascaras", "users", "email"))
+	require.False(t, c.classified("mascaras", "oauth_tokens", "token"))
+	require.EqualValues(t, []string{"users.deleted_column"}, staleClassifications(c["mascaras"], map[string]map[string]bool{
+		"access_log": {"id": true, "path": true},
+		"roles":      {"id": true, "name": true},
+		"users":      {"id": true, "email": true, "on": true},
+	}))
+	for key, expected := range map[string]string{
+		"users":      "users",
+		"created_at": "created_at",
+		"on":         `"on"`,
+		"No":         `"No"`,
+		"2fa_secret": `"2fa_secret"`,
+		"user name":  `"user name"`,
+	} {
+		require.Equal(t, expected, yamlKey(key), key)
+	}
+}
+
+func TestTempDBClusterConfigValidate(t *testing.T) {
+	cases := []struct {
+		cfg    TempDBClusterConfig
+		errMsg string
+	}{
+		{
+			cfg: TempDBClusterConfig{DBClusterIdentifierPrefix: "mascaras-", DBInstanceClass: "db.t3.small"},
+		},
+		{
+			cfg: TempDBClusterConfig{DBClusterIdentifierPrefix: "mascaras-", DBInstanceClass: "db.serverless", MinCapacity: 0.5, MaxCapacity: 4},
+		},
+		{
+			cfg: TempDBClusterConfig{DBClusterIdentifierPrefix: "mascaras-", DBInstanceClass: "db.t3.medium", SQLDBInstanceClass: "db.serverless", MinCapacity: 0.5, MaxCapacity: 4},
+		},
+		{
+			cfg:    TempDBClusterConfig{DBClusterIdentifierPrefix: "mascaras-"},
+			errMsg: "db-instance-class is required",
+		},
+		{
+			cfg:    TempDBClusterConfig{DBClusterIdentifierPrefix: "mascaras-", DBInstanceClass: "db.serverless"},
+			errMsg: "min-capacity and max-capacity are required for db.serverless",
+		},
+		{
+			cfg:    TempDBClusterConfig{DBClusterIdentifierPrefix: "mascaras-", DBInstanceClass: "db.t3.small", MinCapacity: 0.5, MaxCapacity: 4},
+			errMsg: "min-capacity and max-capacity are available only for db.serverless",
+		},
+		{
+			cfg:    TempDBClusterConfig{DBClusterIdentifierPrefix: "mascaras-", DBInstanceClass: "db.serverless", MinCapacity: 0.5},
+			errMsg: "both min-capacity and max-capacity are required",
+		},
+		{
+			cfg:    TempDBClusterConfig{DBClusterIdentifierPrefix: "mascaras-", DBInstanceClass: "db.serverless", MinCapacity: 0.5, MaxCapacity: 4.2},
+			errMsg: "capacity must be between 0.5 and 128 in half-step increments, got 4.2",
+		},
+		{
+			cfg:    TempDBClusterConfig{DBClusterIdentifierPrefix: "mascaras-", DBInstanceClass: "db.serverless", MinCapacity: 8, MaxCapacity: 4},
+			errMsg: "min-capacity 8 is greater than max-capacity 4",
+		},
+		{
+			cfg:    TempDBClusterConfig{DBClusterIdentifierPrefix: "mascaras-", DBInstanceClass: "db.serverless", MinCapacity: 0.5, MaxCapacity: 4, SQLMaxCapacity: 200},
+			errMsg: "both sql-min-capacity and sql-max-capacity are required",
+		},
+		{
+			cfg:    TempDBClusterConfig{DBClusterIdentifierPrefix: "mascaras-", DBInstanceClass: "db.t3.small", Port: 80},
+			errMsg: "port must be between 1150 and 65535, got 80",
+		},
+	}
+	for _, c := range cases {
+		err := c.cfg.Validate()
+		if c.errMsg == "" {
+			require.NoError(t, err)
+		} else {
+			require.EqualError(t, err, c.errMsg)
+		}
+	}
+	cfg := &Config{TempCluster: TempDBClusterConfig{DBInstanceClass: "db.t3.small"}}
+	require.Error(t, cfg.Validate(), "Config.Validate returns the error of TempCluster")
+}
+
+func TestServer(t *testing.T) {
+	cleanup := setLogOutput(t)
+	defer cleanup()
+	svc := &mockRDSService{
+		clusters: []*rds.DBCluster{
+			{
+				DBClusterIdentifier: aws.String("mascaras-orphan"),
+				Status:              aws.String("available"),
+				DBClusterMembers: []*rds.DBClusterMember{
+					{DBInstanceIdentifier: aws.String("mascaras-orphan-instance")},
+					{DBInstanceIdentifier: aws.String("mascaras-orphan-instance-2")},
+				},
+				TagList:           []*rds.Tag{{Key: aws.String(tagKeyJob), Value: aws.String("job1")}},
+				ClusterCreateTime: aws.Time(time.Now().Add(-time.Hour)),
+			},
+			{
+				DBClusterIdentifier: aws.String("mascaras-other"),
+				Status:              aws.String("available"),
+				TagList:             []*rds.Tag{{Key: aws.String(tagKeyJob), Value: aws.String("other")}},
+				ClusterCreateTime:   aws.Time(time.Now().Add(-time.Hour)),
+			},
+			{
+				// created by a run of this server
+				DBClusterIdentifier: aws.String("mascaras-running"),
+				Status:              aws.String("available"),
+				TagList:             []*rds.Tag{{Key: aws.String(tagKeyJob), Value: aws.String("job1")}},
+				ClusterCreateTime:   aws.Time(time.Now().Add(time.Hour)),
+			},
+			{
+				DBClusterIdentifier: aws.String("production"),
+				Status:              aws.String("available"),
+			},
+		},
+	}
+	cfg := &JobsConfig{
+		Jobs: []*JobConfig{
+			{Name: "job1", Schedule: "0 3 * * *", SourceDBClusterIdentifier: "mascaras-src"},
+		},
+	}
+	require.NoError(t, cfg.Validate())
+	s := newServer(cfg, svc, func(c *Config) (*App, error) {
+		c.TempCluster.DBClusterIdentifier = MockSuccessDBClusterIdentifier
+		return &App{
+			rdsSvc:       svc,
+			cfg:          c,
+			baseInterval: time.Millisecond,
+			newExecuter: func(_ *Config, _, _, host string, _ int) (executer, error) {
+				return &mockExecuter{host: host}, nil
+			},
+		}, nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	require.NoError(t, s.cleanupOrphans(ctx))
+	require.EqualValues(t, []string{"mascaras-orphan-instance", "mascaras-orphan-instance-2", "mascaras-orphan"}, svc.deletedTargets, "all members are deleted")
+
+	j := s.jobs[0]
+	s.runJob(ctx, j)
+	require.Contains(t, svc.restoreTags, &rds.Tag{Key: aws.String(tagKeyJob), Value: aws.String("job1")})
+
+	j.running = true
+	s.runJob(ctx, j)
+	j.running = false
+
+	server := httptest.NewServer(s.handler())
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/jobs/job1")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var status JobStatus
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	require.EqualValues(t, "job1", status.Name)
+	require.False(t, status.Running)
+	require.EqualValues(t, 1, status.SkippedRuns)
+	require.EqualValues(t, ReportStatusSucceeded, status.LastRun.Status)
+
+	resp, err = http.Get(server.URL + "/jobs/unknown")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.EqualValues(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestServerRunAll(t *testing.T) {
+	cleanup := setLogOutput(t)
+	defer cleanup()
+	cfg := &JobsConfig{
+		Concurrency: 2,
+		Jobs: []*JobConfig{
+			{Name: "success", SourceDBClusterIdentifier: MockSuccessDBClusterIdentifier},
+			{Name: "failure", SourceDBClusterIdentifier: MockFailureCreateInstanceDBClusterIdentifier},
+		},
+	}
+	require.NoError(t, cfg.Validate())
+	s := newServer(cfg, &mockRDSService{}, func(c *Config) (*App, error) {
+		c.TempCluster.DBClusterIdentifier = c.SourceDBClusterIdentifier
+		return &App{
+			rdsSvc:       &mockRDSService{},
+			cfg:          c,
+			baseInterval: time.Millisecond,
+			newExecuter: func(_ *Config, _, _, host string, _ int) (executer, error) {
+				return &mockExecuter{host: host}, nil
+			},
+		}, nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	report := s.RunAll(ctx)
+	require.EqualValues(t, ReportStatusFailed, report.Status)
+	require.EqualValues(t, 1, report.Succeeded)
+	require.EqualValues(t, 1, report.Failed)
+	require.Len(t, report.Jobs, 2)
+	require.EqualValues(t, "success", report.Jobs[0].Name)
+	require.EqualValues(t, ReportStatusSucceeded, report.Jobs[0].Report.Status)
+	require.EqualValues(t, "failure", report.Jobs[1].Name)
+	require.EqualValues(t, ReportStatusFailed, report.Jobs[1].Report.Status)
+}
+
+func TestJobsConfigSharedResources(t *testing.T) {
+	dir := t.TempDir()
+	shared := filepath.Join(dir, "shared.yaml")
+	require.NoError(t, os.WriteFile(shared, []byte("temp_cluster:\n  db_cluster_identifier: mascaras-fixed\nmetrics:\n  listen: 127.0.0.1:9100\n"), 0644))
+	own := filepath.Join(dir, "own.yaml")
+	require.NoError(t, os.WriteFile(own, []byte("approval:\n  listen: 127.0.0.1:9100\n  signal_location: s3://example/signal\n"), 0644))
+	fixed := filepath.Join(dir, "fixed.yaml")
+	require.NoError(t, os.WriteFile(fixed, []byte("temp_cluster:\n  db_cluster_identifier: mascaras-fixed\n"), 0644))
+	cases := []struct {
+		jobs   []*JobConfig
+		errMsg string
+	}{
+		{
+			jobs: []*JobConfig{
+				{Name: "db01", SourceDBClusterIdentifier: "db01", Config: fixed},
+				{Name: "db02", SourceDBClusterIdentifier: "db02", Config: fixed},
+			},
+			errMsg: "jobs[1]: temp_cluster.db_cluster_identifier `mascaras-fixed` is shared with job `db01`, which can not run concurrently",
+		},
+		{
+			jobs: []*JobConfig{
+				{Name: "db01", SourceDBClusterIdentifier: "db01", Config: shared},
+				{Name: "db02", SourceDBClusterIdentifier: "db02", Config: shared},
+			},
+			errMsg: "jobs[1]: metrics.listen `127.0.0.1:9100` is shared with job `db01`, which can not run concurrently",
+		},
+		{
+			jobs: []*JobConfig{
+				{Name: "db01", SourceDBClusterIdentifier: "db01", Config: shared},
+				{Name: "db02", SourceDBClusterIdentifier: "db02", Config: own},
+			},
+			errMsg: "jobs[1]: approval.listen `127.0.0.1:9100` is shared with job `db01`, which can not run concurrently",
+		},
+		{
+			jobs: []*JobConfig{
+				{Name: "db01", SourceDBClusterIdentifier: "db01", Config: shared},
+				{Name: "db02", SourceDBClusterIdentifier: "db02"},
+			},
+		},
+	}
+	for _, c := range cases {
+		cfg := &JobsConfig{Concurrency: 2, Jobs: c.jobs}
+		if c.errMsg == "" {
+			require.NoError(t, cfg.Validate())
+		} else {
+			require.EqualError(t, cfg.Validate(), c.errMsg)
+		}
+		cfg.Concurrency = 1
+		require.NoError(t, cfg.Validate(), "jobs run one by one")
+	}
+}
+
+func TestHistoryRedactor(t *testing.T) {
+	r, err := newHistoryRedactor([]string{`@`, `^\d{3}-\d{4}$`})
+	require.NoError(t, err)
+	cases := []struct {
+		line     string
+		expected string
+	}{
+		{
+			line:     "SELECT * FROM users WHERE email = 'foo@example.com';",
+			expected: "SELECT * FROM users WHERE email = '***';",
+		},
+		{
+			line:     `SELECT * FROM users WHERE tel = "090-1234" AND name = 'bob';`,
+			expected: `SELECT * FROM users WHERE tel = "***" AND name = 'bob';`,
+		},
+		{
+			line:     "SELECT * FROM users WHERE name = 'o''reilly@example.com' LIMIT 1;",
+			expected: "SELECT * FROM users WHERE name = '***' LIMIT 1;",
+		},
+		{
+			line:     "SELECT * FROM users LIMIT 5;",
+			expected: "SELECT * FROM users LIMIT 5;",
+		},
+	}
+	for _, c := range cases {
+		require.EqualValues(t, c.expected, r.Redact(c.line))
+	}
+	_, err = newHistoryRedactor([]string{`(`})
+	require.Error(t, err)
+
+	require.EqualValues(t, "SELECT * FROM users WHERE name = '***' AND id = 1;", redactStringLiterals("SELECT * FROM users WHERE name = 'bob' AND id = 1;"))
+}
+
+func TestPrepareHistoryFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mascaras", "history")
+	require.NoError(t, prepareHistoryFile(path, 10))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.EqualValues(t, os.FileMode(0600), info.Mode().Perm())
+	info, err = os.Stat(filepath.Dir(path))
+	require.NoError(t, err)
+	require.EqualValues(t, os.FileMode(0700), info.Mode().Perm())
+
+	// over the limit, readline rewrites the file unless it is compacted.
+	var history strings.Builder
+	for i := 0; i < 15; i++ {
+		fmt.Fprintf(&history, "SELECT %d;\n\n", i)
+	}
+	require.NoError(t, os.WriteFile(path, []byte(history.String()), 0600))
+	require.NoError(t, prepareHistoryFile(path, 10))
+	l, err := readline.NewEx(&readline.Config{
+		HistoryFile:  path,
+		HistoryLimit: 10,
+		Stdin:        io.NopCloser(strings.NewReader("")),
+		Stdout:       io.Discard,
+		Stderr:       io.Discard,
+	})
+	require.NoError(t, err)
+	_, err = l.Readline()
+	require.ErrorIs(t, err, io.EOF)
+	require.NoError(t, l.SaveHistory("SELECT 15;"))
+	require.NoError(t, l.Close())
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	require.EqualValues(t, os.FileMode(0600), info.Mode().Perm())
+	bs, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(bs)), "\n")
+	require.Len(t, lines, 11)
+	require.EqualValues(t, "SELECT 5;", lines[0])
+	require.EqualValues(t, "SELECT 15;", lines[10])
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "no temporary files are left")
+}
+
+func TestRemoteConsole(t *testing.T) {
+	cleanup := setLogOutput(t)
+	defer cleanup()
+	e := &mockExecuter{}
+	c := &remoteConsole{
+		executer: e,
+		token:    "secret",
+		logger:   log.Default(),
+		done:     make(chan error, 1),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server := httptest.NewServer(c.handler(ctx, MockSuccessDBClusterIdentifier))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL+"?token=invalid", nil)
+	require.Error(t, err)
+	require.EqualValues(t, http.StatusUnauthorized, resp.StatusCode)
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Authorization": []string{"Bearer secret"}})
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("SELECT * FROM users LIMIT 5;")))
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("abort")))
+	select {
+	case err := <-c.done:
+		require.ErrorIs(t, err, errPromptAbort)
+	case <-ctx.Done():
+		t.Fatal("remote console not finished")
+	}
+	for {
+		// wait for the server to close the connection
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	require.EqualValues(t, "SELECT * FROM users LIMIT 5;", e.executeSQL.String())
+
+	cfg := RemoteConsoleConfig{Listen: "127.0.0.1:8080"}
+	require.EqualError(t, cfg.Validate(), "remote-console-token is required if remote-console-listen is set")
+	cfg.Token = "secret"
+	require.NoError(t, cfg.Validate())
+}
+
+// blockingExecuter blocks ExecuteContext until the context is canceled.
+type blockingExecuter struct {
+	*mockExecuter
+	started  chan struct{}
+	finished bool
+}
+
+func (e *blockingExecuter) ExecuteContext(ctx context.Context, _ io.Reader) error {
+	close(e.started)
+	<-ctx.Done()
+	time.Sleep(10 * time.Millisecond)
+	e.finished = true
+	return ctx.Err()
+}
+
+func TestRemoteConsoleCloseWaitsForStatement(t *testing.T) {
+	cleanup := setLogOutput(t)
+	defer cleanup()
+	e := &blockingExecuter{mockExecuter: &mockExecuter{}, started: make(chan struct{})}
+	c := &remoteConsole{
+		executer: e,
+		token:    "secret",
+		logger:   log.Default(),
+		done:     make(chan error, 1),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := httptest.NewServer(c.handler(ctx, MockSuccessDBClusterIdentifier))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?token=secret"
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("SELECT SLEEP(3600);")))
+	select {
+	case <-e.started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("statement not started")
+	}
+	cancel()
+	c.close()
+	require.True(t, e.finished, "close returned while the statement is running")
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	require.Error(t, err)
+	require.EqualValues(t, http.StatusConflict, resp.StatusCode)
+}
+
+func TestJSONLogWriter(t *testing.T) {
+	flextime.Fix(time.Date(2021, 06, 01, 0, 0, 0, 0, time.UTC))
+	defer flextime.Restore()
+	var buf bytes.Buffer
+	w := NewJSONLogWriter(&buf, "info")
+	run, err := newRunInfo("mascaras-src")
+	require.NoError(t, err)
+	run.setTempDBClusterIdentifier("mascaras-test")
+	run.setStage("execute_sql")
+	logger := log.New(w.withRun(run), "", 0)
+	logger.Println("[debug] hidden")
+	logger.Println("[info] start do sql")
+	log.New(w, "", 0).Println("[warn] without run")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	require.EqualValues(t, map[string]interface{}{
+		"time":                         "2021-06-01T00:00:00Z",
+		"level":                        "info",
+		"message":                      "start do sql",
+		"run_id":                       run.id,
+		"stage":                        "execute_sql",
+		"source_db_cluster_identifier": "mascaras-src",
+		"temp_db_cluster_identifier":   "mascaras-test",
+		"elapsed":                      0.0,
+	}, entry)
+	entry = nil
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &entry))
+	require.EqualValues(t, map[string]interface{}{
+		"time":    "2021-06-01T00:00:00Z",
+		"level":   "warn",
+		"message": "without run",
+	}, entry)
+}
+
+// syncBuffer is a bytes.Buffer safe for logging from multiple goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
 func setLogOutput(t *testing.T) func() {
 	t.Helper()
-	var buf bytes.Buffer
+	var buf syncBuffer
 	log.SetOutput(&buf)
 	return func() {
 		t.Log(buf.String())
@@ -155,6 +1978,102 @@ func setLogOutput(t *testing.T) func() {
 	}
 }
 
+// testApp is the App running with the mocks. It records the executers opened by the app.
+type testApp struct {
+	*App
+	svc *mockRDSService
+
+	mu        sync.Mutex
+	executers []*mockExecuter
+	databases []string
+	ports     []int
+}
+
+// newTestApp returns the app with the mock RDS service and executers, the default config, the temporary cluster
+// which succeeds and testdata/mask.sql. The log is written to the test log at the end of the test.
+func newTestApp(t *testing.T) *testApp {
+	t.Helper()
+	t.Cleanup(setLogOutput(t))
+	ta := &testApp{}
+	ta.App = &App{
+		baseInterval: time.Millisecond,
+		newExecuter:  ta.newExecuter,
+		cfg:          DefaultConfig(),
+		logger:       log.Default(),
+	}
+	ta.resetRDSService()
+	ta.cfg.TempCluster.DBClusterIdentifier = MockSuccessDBClusterIdentifier
+	ta.cfg.SQLFile = "testdata/mask.sql"
+	return ta
+}
+
+func (ta *testApp) newExecuter(_ *Config, _, database, host string, port int) (executer, error) {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	e := &mockExecuter{host: host}
+	ta.executers = append(ta.executers, e)
+	ta.databases = append(ta.databases, database)
+	ta.ports = append(ta.ports, port)
+	return e, nil
+}
+
+// resetRDSService replaces the mock RDS service, to run the app again.
+func (ta *testApp) resetRDSService() *mockRDSService {
+	ta.svc = &mockRDSService{}
+	ta.rdsSvc = ta.svc
+	return ta.svc
+}
+
+// resetExecuters forgets the recorded executers.
+func (ta *testApp) resetExecuters() {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	ta.executers, ta.databases, ta.ports = nil, nil, nil
+}
+
+// executedSQL returns SQL executed by all executers in the order they were opened.
+func (ta *testApp) executedSQL() string {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	var b strings.Builder
+	for _, e := range ta.executers {
+		b.WriteString(e.executeSQL.String())
+	}
+	return b.String()
+}
+
+// runSteps invokes App.Step until the run is done, passing the state through JSON as Step Functions, and
+// returns the last state and the executed steps.
+func (ta *testApp) runSteps(t *testing.T, state *State) (*State, []string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var steps []string
+	for !state.Done {
+		bs, err := json.Marshal(state)
+		require.NoError(t, err)
+		var input State
+		require.NoError(t, json.Unmarshal(bs, &input))
+		state, err = ta.Step(ctx, &input)
+		require.NoError(t, err)
+		if len(steps) == 0 || steps[len(steps)-1] != input.Step {
+			steps = append(steps, input.Step)
+		}
+		if state.Wait {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return state, steps
+}
+
+func stageNames(report *Report) []string {
+	stages := make([]string, 0, len(report.Stages))
+	for _, s := range report.Stages {
+		stages = append(stages, s.Name)
+	}
+	return stages
+}
+
 func TestConfigMergeIn(t *testing.T) {
 	flextime.Set(time.Date(2021, 06, 01, 0, 0, 0, 0, time.UTC))
 	os.Setenv("PASSWORD", "super_password")
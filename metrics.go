@@ -0,0 +1,187 @@
+package mascaras
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Songmu/flextime"
+)
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// runMetrics collects the metrics of a run, rendered in the Prometheus text exposition format.
+type runMetrics struct {
+	mu           sync.Mutex
+	run          *runInfo
+	waitPolls    map[string]int64
+	statements   int64
+	rowsAffected int64
+	finished     bool
+	succeeded    bool
+	finishedAt   time.Time
+}
+
+func newRunMetrics(run *runInfo) *runMetrics {
+	return &runMetrics{
+		run:       run,
+		waitPolls: make(map[string]int64),
+	}
+}
+
+func (m *runMetrics) waitPolled(target string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.waitPolls[target]++
+}
+
+// addStatement records an executed statement as soon as it is executed, so a running run exposes the progress.
+// m is nil in step execution, which has no metrics.
+func (m *runMetrics) addStatement(s StatementReport) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.statements++
+	m.rowsAffected += s.RowsAffected
+}
+
+func (m *runMetrics) finish(succeeded bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.finished = true
+	m.succeeded = succeeded
+	m.finishedAt = flextime.Now()
+}
+
+func (m *runMetrics) WriteTo(w io.Writer) (int64, error) {
+	stages := m.run.stageReports()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var buf bytes.Buffer
+	source := fmt.Sprintf(`source_db_cluster_identifier="%s"`, escapeLabelValue(m.run.sourceDBClusterIdentifier))
+
+	now := flextime.Now()
+	if m.finished {
+		now = m.finishedAt
+	}
+	writeMetricHeader(&buf, "mascaras_run_duration_seconds", "gauge", "Elapsed time of the run.")
+	fmt.Fprintf(&buf, "mascaras_run_duration_seconds{%s} %g\n", source, now.Sub(m.run.startedAt).Seconds())
+	writeMetricHeader(&buf, "mascaras_run_start_timestamp_seconds", "gauge", "Start time of the run since unix epoch in seconds.")
+	fmt.Fprintf(&buf, "mascaras_run_start_timestamp_seconds{%s} %d\n", source, m.run.startedAt.Unix())
+	if m.finished {
+		success := 0
+		if m.succeeded {
+			success = 1
+		}
+		writeMetricHeader(&buf, "mascaras_run_success", "gauge", "Whether the run succeeded (1) or failed (0).")
+		fmt.Fprintf(&buf, "mascaras_run_success{%s} %d\n", source, success)
+		writeMetricHeader(&buf, "mascaras_run_finish_timestamp_seconds", "gauge", "Finish time of the run since unix epoch in seconds.")
+		fmt.Fprintf(&buf, "mascaras_run_finish_timestamp_seconds{%s} %d\n", source, m.finishedAt.Unix())
+	}
+
+	writeMetricHeader(&buf, "mascaras_stage_duration_seconds", "gauge", "Elapsed time of each stage.")
+	for _, s := range stages {
+		finishedAt := s.FinishedAt
+		if finishedAt.IsZero() {
+			finishedAt = now
+		}
+		fmt.Fprintf(&buf, "mascaras_stage_duration_seconds{%s,stage=\"%s\"} %g\n", source, escapeLabelValue(s.Name), finishedAt.Sub(s.StartedAt).Seconds())
+	}
+
+	writeMetricHeader(&buf, "mascaras_wait_polls_total", "counter", "Number of status polls while waiting for AWS resources.")
+	targets := make([]string, 0, len(m.waitPolls))
+	for target := range m.waitPolls {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	for _, target := range targets {
+		fmt.Fprintf(&buf, "mascaras_wait_polls_total{%s,target=\"%s\"} %d\n", source, escapeLabelValue(target), m.waitPolls[target])
+	}
+
+	writeMetricHeader(&buf, "mascaras_statements_executed_total", "counter", "Number of executed SQL statements.")
+	fmt.Fprintf(&buf, "mascaras_statements_executed_total{%s} %d\n", source, m.statements)
+	writeMetricHeader(&buf, "mascaras_rows_affected_total", "counter", "Number of rows affected by executed SQL statements.")
+	fmt.Fprintf(&buf, "mascaras_rows_affected_total{%s} %d\n", source, m.rowsAffected)
+
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+func writeMetricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueReplacer.Replace(v)
+}
+
+func (app *App) startMetricsServer(metrics *runMetrics) (func(), error) {
+	listener, err := net.Listen("tcp", app.cfg.Metrics.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("metrics listen: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", metricsContentType)
+		metrics.WriteTo(w)
+	})
+	server := &http.Server{
+		Handler: mux,
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			app.logger.Printf("[error] metrics server: %s\n", err)
+		}
+	}()
+	app.logger.Printf("[info] metrics listening on http://%s/metrics\n", listener.Addr())
+	return func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			app.logger.Printf("[warn] metrics server shutdown: %s\n", err)
+		}
+	}, nil
+}
+
+// pushMetrics replaces the metrics of the group job/source_db_cluster_identifier in the Pushgateway.
+func (app *App) pushMetrics(metrics *runMetrics) error {
+	cfg := app.cfg.Metrics
+	u := fmt.Sprintf("%s/metrics/job/%s/source_db_cluster_identifier/%s",
+		strings.TrimRight(cfg.PushgatewayURL, "/"),
+		url.PathEscape(coalesceString(cfg.Job, "mascaras")),
+		url.PathEscape(metrics.run.sourceDBClusterIdentifier),
+	)
+	var buf bytes.Buffer
+	if _, err := metrics.WriteTo(&buf); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", metricsContentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("PUT %s: unexpected status %s", u, resp.Status)
+	}
+	app.logger.Printf("[info] metrics pushed to %s\n", u)
+	return nil
+}
@@ -2,15 +2,23 @@ package mascaras
 
 import (
 	"context"
+	"database/sql/driver"
 	"errors"
+	"fmt"
 	"io"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/rds"
 	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 )
 
 const (
@@ -20,6 +28,7 @@ const (
 	MockFailureExecuteSQLDBClusterIdentifier     = "mascaras-failure-exec-sql-test"
 	MockFailureCreateSnapshotDBClusterIdentifier = "mascaras-failure-create-snapshot-test"
 	MockFailureExportTaskIdentifier              = "mascaras-failure-export-task-test"
+	MockTargetDBClusterIdentifier                = "mascaras-target"
 )
 
 type mockRDSService struct {
@@ -31,6 +40,28 @@ type mockRDSService struct {
 	isCreateInstance     bool
 	isDeleteCluster      bool
 	isDeleteInstance     bool
+	restoreTags          []*rds.Tag
+	restoreInput         *rds.RestoreDBClusterToPointInTimeInput
+	createInstanceInput  *rds.CreateDBInstanceInput
+	dbInstanceClass      string
+	pendingInstanceClass string
+	dbInstanceModifyTime time.Time
+	modifiedClasses      []string
+	scaling              *rds.ServerlessV2ScalingConfiguration
+	modifiedScalings     []*rds.ServerlessV2ScalingConfiguration
+	deletedDBClusters    []string
+	copySnapshotInput    *rds.CopyDBClusterSnapshotInput
+	deletedSnapshots     []string
+	exportSourceArn      string
+	// clusters of MockTargetDBClusterIdentifier, found by their identifiers.
+	targetClusters  map[string]*rds.DBCluster
+	renamedClusters []string
+	deletedTargets  []string
+	targetInput     *rds.RestoreDBClusterFromSnapshotInput
+	clusters        []*rds.DBCluster
+	// alreadyExists makes the restore and the snapshot fail as they already exist.
+	alreadyExists               bool
+	snapshotDBClusterIdentifier string
 }
 
 const (
@@ -48,12 +79,22 @@ func (svc *mockRDSService) RestoreDBClusterToPointInTimeWithContext(
 	if *input.DBClusterIdentifier == MockFailureRestoreDBClusterIdentifier {
 		return nil, errors.New("failure RestoreDBClusterToPointInTimeWithContext")
 	}
+	if svc.alreadyExists {
+		return nil, awserr.New(rds.ErrCodeDBClusterAlreadyExistsFault, "DBCluster already exists", nil)
+	}
 	svc.dbClusterCreateTime = time.Now()
 	svc.isCreateCluster = true
+	svc.restoreTags = input.Tags
+	svc.scaling = input.ServerlessV2ScalingConfiguration
+	svc.restoreInput = input
+	port := int64(3306)
+	if input.Port != nil {
+		port = *input.Port
+	}
 	output := &rds.RestoreDBClusterToPointInTimeOutput{
 		DBCluster: &rds.DBCluster{
 			DBClusterArn: aws.String(dbClusterARNPrefix + *input.DBClusterIdentifier),
-			Port:         aws.Int64(3306),
+			Port:         aws.Int64(port),
 			Engine:       aws.String("aurora-test"),
 		},
 	}
@@ -70,6 +111,8 @@ func (svc *mockRDSService) CreateDBInstanceWithContext(
 	}
 	svc.dbInstanceCreateTime = time.Now()
 	svc.isCreateInstance = true
+	svc.dbInstanceClass = *input.DBInstanceClass
+	svc.createInstanceInput = input
 	output := &rds.CreateDBInstanceOutput{
 		DBInstance: &rds.DBInstance{
 			DBClusterIdentifier: input.DBClusterIdentifier,
@@ -87,7 +130,11 @@ func (svc *mockRDSService) CreateDBClusterSnapshotWithContext(
 	if *input.DBClusterIdentifier == MockFailureCreateSnapshotDBClusterIdentifier {
 		return nil, errors.New("failure CreateDBClusterSnapshotWithContext")
 	}
+	if svc.alreadyExists {
+		return nil, awserr.New(rds.ErrCodeDBClusterSnapshotAlreadyExistsFault, "DBClusterSnapshot already exists", nil)
+	}
 	svc.snapshotCreateTime = time.Now()
+	svc.snapshotDBClusterIdentifier = *input.DBClusterIdentifier
 	output := &rds.CreateDBClusterSnapshotOutput{
 		DBClusterSnapshot: &rds.DBClusterSnapshot{
 			DBClusterSnapshotArn: aws.String(dbClusterSnapshotARNPrefix + *input.DBClusterSnapshotIdentifier),
@@ -106,9 +153,34 @@ func (svc *mockRDSService) StartExportTaskWithContext(
 		output.FailureCause = aws.String("task identifer is invalid")
 		return output, errors.New("failure StartExportTaskWithContext")
 	}
+	svc.exportSourceArn = *input.SourceArn
+	return output, nil
+}
+
+func (svc *mockRDSService) CopyDBClusterSnapshotWithContext(
+	ctx context.Context,
+	input *rds.CopyDBClusterSnapshotInput,
+	_ ...request.Option,
+) (*rds.CopyDBClusterSnapshotOutput, error) {
+	svc.snapshotCreateTime = time.Now()
+	svc.copySnapshotInput = input
+	output := &rds.CopyDBClusterSnapshotOutput{
+		DBClusterSnapshot: &rds.DBClusterSnapshot{
+			DBClusterSnapshotArn: aws.String(dbClusterSnapshotARNPrefix + *input.TargetDBClusterSnapshotIdentifier),
+		},
+	}
 	return output, nil
 }
 
+func (svc *mockRDSService) DeleteDBClusterSnapshotWithContext(
+	ctx context.Context,
+	input *rds.DeleteDBClusterSnapshotInput,
+	_ ...request.Option,
+) (*rds.DeleteDBClusterSnapshotOutput, error) {
+	svc.deletedSnapshots = append(svc.deletedSnapshots, *input.DBClusterSnapshotIdentifier)
+	return &rds.DeleteDBClusterSnapshotOutput{}, nil
+}
+
 func (svc *mockRDSService) DescribeDBInstancesWithContext(
 	ctx context.Context,
 	input *rds.DescribeDBInstancesInput,
@@ -118,40 +190,122 @@ func (svc *mockRDSService) DescribeDBInstancesWithContext(
 	if time.Since(svc.dbInstanceCreateTime) > 8*time.Millisecond {
 		status = "available"
 	}
+	var pending *rds.PendingModifiedValues
+	if svc.pendingInstanceClass != "" {
+		if time.Since(svc.dbInstanceModifyTime) > 8*time.Millisecond {
+			svc.dbInstanceClass = svc.pendingInstanceClass
+			svc.pendingInstanceClass = ""
+		} else {
+			status = "modifying"
+			pending = &rds.PendingModifiedValues{DBInstanceClass: aws.String(svc.pendingInstanceClass)}
+		}
+	}
 	output := &rds.DescribeDBInstancesOutput{
 		DBInstances: []*rds.DBInstance{
 			{
-				DBInstanceIdentifier: input.DBInstanceIdentifier,
-				DBInstanceStatus:     aws.String(status),
+				DBInstanceIdentifier:  input.DBInstanceIdentifier,
+				DBInstanceStatus:      aws.String(status),
+				DBInstanceClass:       aws.String(svc.dbInstanceClass),
+				PendingModifiedValues: pending,
 			},
 		},
 	}
 	return output, nil
 }
 
+func (svc *mockRDSService) ModifyDBInstanceWithContext(
+	ctx context.Context,
+	input *rds.ModifyDBInstanceInput,
+	_ ...request.Option,
+) (*rds.ModifyDBInstanceOutput, error) {
+	svc.pendingInstanceClass = *input.DBInstanceClass
+	svc.dbInstanceModifyTime = time.Now()
+	svc.modifiedClasses = append(svc.modifiedClasses, *input.DBInstanceClass)
+	return &rds.ModifyDBInstanceOutput{
+		DBInstance: &rds.DBInstance{
+			DBInstanceIdentifier: input.DBInstanceIdentifier,
+		},
+	}, nil
+}
+
 func (svc *mockRDSService) DescribeDBClustersWithContext(
 	ctx context.Context,
 	input *rds.DescribeDBClustersInput,
 	_ ...request.Option,
 ) (*rds.DescribeDBClustersOutput, error) {
+	if svc.targetClusters != nil && strings.HasPrefix(*input.DBClusterIdentifier, MockTargetDBClusterIdentifier) {
+		c, ok := svc.targetClusters[*input.DBClusterIdentifier]
+		if !ok {
+			return nil, awserr.New(rds.ErrCodeDBClusterNotFoundFault, "DBCluster not found", nil)
+		}
+		return &rds.DescribeDBClustersOutput{DBClusters: []*rds.DBCluster{c}}, nil
+	}
 	status := "creating"
 	if time.Since(svc.dbClusterCreateTime) > 5*time.Millisecond {
 		status = "available"
 	}
 	latestRestorableTime := time.Now().Add(-5 * time.Millisecond).UTC()
+	var scaling *rds.ServerlessV2ScalingConfigurationInfo
+	if svc.scaling != nil {
+		scaling = &rds.ServerlessV2ScalingConfigurationInfo{
+			MinCapacity: svc.scaling.MinCapacity,
+			MaxCapacity: svc.scaling.MaxCapacity,
+		}
+	}
+	port := int64(3306)
+	if svc.restoreInput != nil && svc.restoreInput.Port != nil {
+		port = *svc.restoreInput.Port
+	}
 	output := &rds.DescribeDBClustersOutput{
 		DBClusters: []*rds.DBCluster{
 			{
-				DBClusterIdentifier:  input.DBClusterIdentifier,
-				Status:               aws.String(status),
-				Port:                 aws.Int64(3306),
-				LatestRestorableTime: aws.Time(latestRestorableTime),
+				DBClusterIdentifier:              input.DBClusterIdentifier,
+				DBClusterArn:                     aws.String(dbClusterARNPrefix + *input.DBClusterIdentifier),
+				Engine:                           aws.String("aurora-test"),
+				Status:                           aws.String(status),
+				Port:                             aws.Int64(port),
+				LatestRestorableTime:             aws.Time(latestRestorableTime),
+				ServerlessV2ScalingConfiguration: scaling,
+				TagList:                          svc.restoreTags,
 			},
 		},
 	}
 	return output, nil
 }
 
+func (svc *mockRDSService) ModifyDBClusterWithContext(
+	ctx context.Context,
+	input *rds.ModifyDBClusterInput,
+	_ ...request.Option,
+) (*rds.ModifyDBClusterOutput, error) {
+	if input.NewDBClusterIdentifier != nil {
+		c := svc.targetClusters[*input.DBClusterIdentifier]
+		delete(svc.targetClusters, *input.DBClusterIdentifier)
+		c.DBClusterIdentifier = input.NewDBClusterIdentifier
+		c.DeletionProtection = input.DeletionProtection
+		svc.targetClusters[*input.NewDBClusterIdentifier] = c
+		svc.renamedClusters = append(svc.renamedClusters, *input.DBClusterIdentifier+"->"+*input.NewDBClusterIdentifier)
+		return &rds.ModifyDBClusterOutput{DBCluster: c}, nil
+	}
+	svc.scaling = input.ServerlessV2ScalingConfiguration
+	svc.modifiedScalings = append(svc.modifiedScalings, input.ServerlessV2ScalingConfiguration)
+	return &rds.ModifyDBClusterOutput{
+		DBCluster: &rds.DBCluster{
+			DBClusterIdentifier: input.DBClusterIdentifier,
+		},
+	}, nil
+}
+
+func (svc *mockRDSService) DescribeDBClustersPagesWithContext(
+	ctx context.Context,
+	input *rds.DescribeDBClustersInput,
+	fn func(*rds.DescribeDBClustersOutput, bool) bool,
+	_ ...request.Option,
+) error {
+	fn(&rds.DescribeDBClustersOutput{DBClusters: svc.clusters}, true)
+	return nil
+}
+
 func (svc *mockRDSService) DescribeDBClusterEndpointsWithContext(
 	ctx context.Context,
 	input *rds.DescribeDBClusterEndpointsInput,
@@ -190,8 +344,11 @@ func (svc *mockRDSService) DescribeDBClusterSnapshotsWithContext(
 	output := &rds.DescribeDBClusterSnapshotsOutput{
 		DBClusterSnapshots: []*rds.DBClusterSnapshot{
 			{
-				PercentProgress: aws.Int64(int64(percent)),
-				Status:          aws.String(status),
+				DBClusterIdentifier:  aws.String(svc.snapshotDBClusterIdentifier),
+				DBClusterSnapshotArn: aws.String(dbClusterSnapshotARNPrefix + aws.StringValue(input.DBClusterSnapshotIdentifier)),
+				EngineVersion:        aws.String("8.0.mysql_aurora.3.02.0"),
+				PercentProgress:      aws.Int64(int64(percent)),
+				Status:               aws.String(status),
 			},
 		},
 	}
@@ -202,6 +359,7 @@ func (svc *mockRDSService) DeleteDBCluster(
 	input *rds.DeleteDBClusterInput,
 ) (*rds.DeleteDBClusterOutput, error) {
 	svc.isDeleteCluster = true
+	svc.deletedDBClusters = append(svc.deletedDBClusters, *input.DBClusterIdentifier)
 	return &rds.DeleteDBClusterOutput{
 		DBCluster: &rds.DBCluster{
 			DBClusterArn: aws.String(dbClusterARNPrefix + *input.DBClusterIdentifier),
@@ -220,10 +378,83 @@ func (svc *mockRDSService) DeleteDBInstance(
 	}, nil
 }
 
+func (svc *mockRDSService) RestoreDBClusterFromSnapshotWithContext(
+	ctx context.Context,
+	input *rds.RestoreDBClusterFromSnapshotInput,
+	_ ...request.Option,
+) (*rds.RestoreDBClusterFromSnapshotOutput, error) {
+	svc.targetInput = input
+	if _, ok := svc.targetClusters[*input.DBClusterIdentifier]; ok {
+		return nil, awserr.New(rds.ErrCodeDBClusterAlreadyExistsFault, "DBCluster already exists", nil)
+	}
+	c := &rds.DBCluster{
+		DBClusterIdentifier: input.DBClusterIdentifier,
+		DbClusterResourceId: aws.String("cluster-" + *input.DBClusterIdentifier),
+		Status:              aws.String("available"),
+		DBClusterMembers: []*rds.DBClusterMember{
+			{DBInstanceIdentifier: aws.String(*input.DBClusterIdentifier + "-instance")},
+		},
+	}
+	svc.targetClusters[*input.DBClusterIdentifier] = c
+	return &rds.RestoreDBClusterFromSnapshotOutput{DBCluster: c}, nil
+}
+
+func (svc *mockRDSService) DeleteDBInstanceWithContext(
+	ctx context.Context,
+	input *rds.DeleteDBInstanceInput,
+	_ ...request.Option,
+) (*rds.DeleteDBInstanceOutput, error) {
+	svc.deletedTargets = append(svc.deletedTargets, *input.DBInstanceIdentifier)
+	return &rds.DeleteDBInstanceOutput{}, nil
+}
+
+func (svc *mockRDSService) DeleteDBClusterWithContext(
+	ctx context.Context,
+	input *rds.DeleteDBClusterInput,
+	_ ...request.Option,
+) (*rds.DeleteDBClusterOutput, error) {
+	delete(svc.targetClusters, *input.DBClusterIdentifier)
+	svc.deletedTargets = append(svc.deletedTargets, *input.DBClusterIdentifier)
+	return &rds.DeleteDBClusterOutput{}, nil
+}
+
+type mockSSMService struct {
+	ssmiface.SSMAPI
+	parameters map[string]string
+}
+
+func (svc *mockSSMService) PutParameterWithContext(
+	ctx context.Context,
+	input *ssm.PutParameterInput,
+	_ ...request.Option,
+) (*ssm.PutParameterOutput, error) {
+	if svc.parameters == nil {
+		svc.parameters = make(map[string]string)
+	}
+	svc.parameters[*input.Name] = *input.Value
+	return &ssm.PutParameterOutput{Version: aws.Int64(1)}, nil
+}
+
+type mockSNSService struct {
+	snsiface.SNSAPI
+	published []*sns.PublishInput
+}
+
+func (svc *mockSNSService) PublishWithContext(
+	ctx context.Context,
+	input *sns.PublishInput,
+	_ ...request.Option,
+) (*sns.PublishOutput, error) {
+	svc.published = append(svc.published, input)
+	return &sns.PublishOutput{MessageId: aws.String("00000000-0000-0000-0000-000000000000")}, nil
+}
+
 type mockExecuter struct {
 	host            string
 	executeSQL      strings.Builder
 	lastExecuteTime time.Time
+	executeHook     func(string, int64, int64)
+	subsetQueries   []string
 }
 
 func (e *mockExecuter) ExecuteContext(_ context.Context, reader io.Reader) error {
@@ -236,15 +467,188 @@ func (e *mockExecuter) ExecuteContext(_ context.Context, reader io.Reader) error
 	}
 	e.executeSQL.WriteString(string(bs))
 	e.lastExecuteTime = time.Now().UTC()
+	if e.executeHook != nil {
+		e.executeHook(string(bs), 1, 0)
+	}
 	return nil
 }
 func (e *mockExecuter) LastExecuteTime() time.Time {
 	return e.lastExecuteTime
 }
 
-func (e *mockExecuter) SetTableSelectHook(func(string, string))   {}
-func (e *mockExecuter) SetExecuteHook(func(string, int64, int64)) {}
+func (e *mockExecuter) SetTableSelectHook(func(string, string)) {}
+func (e *mockExecuter) SetExecuteHook(hook func(string, int64, int64)) {
+	e.executeHook = hook
+}
 
 func (e *mockExecuter) Close() error {
 	return nil
 }
+
+func (e *mockExecuter) keyRange(_ context.Context, _, _ string) (int64, int64, bool, error) {
+	return 1, 25, true, nil
+}
+
+func (e *mockExecuter) execChunk(_ context.Context, query string) (int64, error) {
+	e.executeSQL.WriteString(query)
+	e.lastExecuteTime = time.Now().UTC()
+	return 10, nil
+}
+
+func (e *mockExecuter) now(_ context.Context) (time.Time, error) {
+	return time.Now().UTC(), nil
+}
+
+func (e *mockExecuter) foreignKeys(_ context.Context) ([]foreignKey, error) {
+	return []foreignKey{
+		{Name: "fk_comments_parent", Table: "comments", Columns: []string{"parent_id"}, RefTable: "comments", RefColumns: []string{"id"}},
+		{Name: "fk_comments_user", Table: "comments", Columns: []string{"user_id"}, RefTable: "users", RefColumns: []string{"id"}},
+		{Name: "fk_order_items_order", Table: "order_items", Columns: []string{"order_id"}, RefTable: "orders", RefColumns: []string{"id"}},
+		{Name: "fk_orders_user", Table: "orders", Columns: []string{"user_id"}, RefTable: "users", RefColumns: []string{"id"}},
+	}, nil
+}
+
+// withoutForeignKeyChecks deletes 10 rows by a query at the first time, and no rows after that.
+func (e *mockExecuter) withoutForeignKeyChecks(_ context.Context, fn func(exec func(string) (int64, error)) error) error {
+	return fn(func(query string) (int64, error) {
+		for _, q := range e.subsetQueries {
+			if q == query {
+				e.subsetQueries = append(e.subsetQueries, query)
+				return 0, nil
+			}
+		}
+		e.subsetQueries = append(e.subsetQueries, query)
+		return 10, nil
+	})
+}
+
+func (e *mockExecuter) tables(_ context.Context) ([]string, error) {
+	return []string{"access_log", "oauth_tokens", "roles", "users"}, nil
+}
+
+func (e *mockExecuter) columns(_ context.Context) ([]tableColumn, error) {
+	return []tableColumn{
+		{Table: "access_log", Column: "id"},
+		{Table: "access_log", Column: "path"},
+		{Table: "oauth_tokens", Column: "id"},
+		{Table: "oauth_tokens", Column: "token"},
+		{Table: "roles", Column: "id"},
+		{Table: "roles", Column: "name"},
+		{Table: "users", Column: "id"},
+		{Table: "users", Column: "email"},
+		{Table: "users", Column: "on"},
+	}, nil
+}
+
+func (e *mockExecuter) queryValue(_ context.Context, query string) (string, error) {
+	switch {
+	case strings.HasPrefix(query, "SELECT COUNT(*) FROM "):
+		return "2", nil
+	case strings.Contains(query, "error"):
+		return "", errors.New("query error")
+	}
+	return "0", nil
+}
+
+func (e *mockExecuter) dumpTable(_ context.Context, table string, w io.Writer) (int64, error) {
+	_, err := fmt.Fprintf(w, "CREATE TABLE `%s` (`id` int);\nINSERT INTO `%s` (`id`) VALUES\n(1),\n(2);\n", table, table)
+	return 2, err
+}
+
+func (e *mockExecuter) foreignKeyStatements(_ context.Context) ([]string, error) {
+	return []string{"ALTER TABLE users ADD CONSTRAINT users_role_id_fkey FOREIGN KEY (role_id) REFERENCES roles(id)"}, nil
+}
+
+// mockConnector is a database/sql connector recording executed statements. Queries return a table `users`
+// for the dump, or the current time.
+// Its results support LastInsertId as the MySQL driver if lastInsertID is set, otherwise they do not as lib/pq.
+type mockConnector struct {
+	mu           sync.Mutex
+	execs        []string
+	lastInsertID bool
+}
+
+func (c *mockConnector) Connect(context.Context) (driver.Conn, error) {
+	return &mockConn{c: c}, nil
+}
+
+func (c *mockConnector) Driver() driver.Driver {
+	return nil
+}
+
+type mockConn struct {
+	c *mockConnector
+}
+
+func (conn *mockConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepare is not supported")
+}
+
+func (conn *mockConn) Close() error {
+	return nil
+}
+
+func (conn *mockConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transaction is not supported")
+}
+
+func (conn *mockConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	conn.c.mu.Lock()
+	defer conn.c.mu.Unlock()
+	conn.c.execs = append(conn.c.execs, query)
+	if conn.c.lastInsertID {
+		return mockResult{}, nil
+	}
+	return driver.RowsAffected(3), nil
+}
+
+type mockResult struct{}
+
+func (mockResult) LastInsertId() (int64, error) {
+	return 7, nil
+}
+
+func (mockResult) RowsAffected() (int64, error) {
+	return 3, nil
+}
+
+func (conn *mockConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	switch {
+	case strings.HasPrefix(query, "SHOW CREATE TABLE "):
+		return &mockRows{
+			columns: []string{"Table", "Create Table"},
+			values:  [][]driver.Value{{"users", "CREATE TABLE `users` (`id` int NOT NULL, `created_at` timestamp NOT NULL)"}},
+		}, nil
+	case strings.HasPrefix(query, "SELECT * FROM "):
+		return &mockRows{
+			columns: []string{"id", "created_at"},
+			values:  [][]driver.Value{{int64(1), time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)}},
+		}, nil
+	}
+	return &mockRows{
+		columns: []string{"now"},
+		values:  [][]driver.Value{{time.Now().UTC()}},
+	}, nil
+}
+
+type mockRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *mockRows) Columns() []string {
+	return r.columns
+}
+
+func (r *mockRows) Close() error {
+	return nil
+}
+
+func (r *mockRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
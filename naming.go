@@ -0,0 +1,139 @@
+package mascaras
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Songmu/flextime"
+)
+
+// Name templates use ${ } as delimiters, because {{ }} is evaluated by go-config when the config file is loaded.
+//
+//	masked-${ .SourceDBClusterIdentifier }-${ now.Format "20060102" }
+const (
+	nameTemplateLeftDelim  = "${"
+	nameTemplateRightDelim = "}"
+
+	maxSnapshotIdentifierLength   = 255
+	maxExportTaskIdentifierLength = 60
+)
+
+// rdsIdentifierRegexp matches identifiers which start with a letter and contain only letters, digits and hyphens.
+var rdsIdentifierRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9-]*$`)
+
+// nameTemplateData is the data of the name templates.
+type nameTemplateData struct {
+	SourceDBClusterIdentifier string
+	TempDBClusterIdentifier   string
+	RunID                     string
+	JobName                   string
+}
+
+// resourceNames are the names of the snapshot, the export task and the dump location, rendered at the start of the run.
+// An empty ExportTaskIdentifier means the default derived from the snapshot identifier.
+// OriginalSnapshotIdentifier is set when the snapshot is copied with another KMS key:
+// the snapshot is created as the original and copied to SnapshotIdentifier.
+type resourceNames struct {
+	SnapshotIdentifier         string
+	OriginalSnapshotIdentifier string
+	ExportTaskIdentifier       string
+	DumpLocation               string
+}
+
+func renderName(name, text string, data nameTemplateData, now time.Time) (string, error) {
+	tmpl, err := template.New(name).
+		Delims(nameTemplateLeftDelim, nameTemplateRightDelim).
+		Option("missingkey=error").
+		Funcs(template.FuncMap{
+			"now": func() time.Time { return now },
+		}).
+		Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// validateRDSIdentifier validates the identifier by the naming rules of RDS.
+func validateRDSIdentifier(name, identifier string, maxLength int) error {
+	if len(identifier) == 0 || len(identifier) > maxLength {
+		return fmt.Errorf("%s `%s` must be 1 to %d characters", name, identifier, maxLength)
+	}
+	if !rdsIdentifierRegexp.MatchString(identifier) {
+		return fmt.Errorf("%s `%s` must start with a letter and contain only letters, digits and hyphens", name, identifier)
+	}
+	if strings.HasSuffix(identifier, "-") || strings.Contains(identifier, "--") {
+		return fmt.Errorf("%s `%s` can't end with a hyphen or contain two consecutive hyphens", name, identifier)
+	}
+	return nil
+}
+
+// resourceNames renders the names of the snapshot, the export task and the dump location, and validates them.
+func (cfg *Config) resourceNames(data nameTemplateData, now time.Time) (*resourceNames, error) {
+	names := &resourceNames{
+		SnapshotIdentifier: snapshotIdentifierOf(data.TempDBClusterIdentifier),
+	}
+	if cfg.Snapshot.Identifier != "" {
+		id, err := renderName("snapshot-identifier", cfg.Snapshot.Identifier, data, now)
+		if err != nil {
+			return nil, err
+		}
+		names.SnapshotIdentifier = id
+	}
+	if err := validateRDSIdentifier("snapshot identifier", names.SnapshotIdentifier, maxSnapshotIdentifierLength); err != nil {
+		return nil, err
+	}
+	if cfg.Snapshot.copyRequired() {
+		original := originalSnapshotIdentifierOf(names.SnapshotIdentifier)
+		if err := validateRDSIdentifier("original snapshot identifier", original, maxSnapshotIdentifierLength); err != nil {
+			return nil, err
+		}
+		names.OriginalSnapshotIdentifier = original
+	}
+	if cfg.ExportTask.TaskIdentifier != "" {
+		id, err := renderName("export-task-identifier", cfg.ExportTask.TaskIdentifier, data, now)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateRDSIdentifier("export task identifier", id, maxExportTaskIdentifierLength); err != nil {
+			return nil, err
+		}
+		names.ExportTaskIdentifier = id
+	}
+	if cfg.Dump.enabled() {
+		loc, err := renderName("dump-location", cfg.Dump.Location, data, now)
+		if err != nil {
+			return nil, err
+		}
+		names.DumpLocation = loc
+	}
+	return names, nil
+}
+
+// validateNameTemplates renders the name templates with sample data, to find errors before the run starts.
+func (cfg *Config) validateNameTemplates() error {
+	sample := nameTemplateData{
+		SourceDBClusterIdentifier: coalesceString(cfg.SourceDBClusterIdentifier, "source-cluster"),
+		TempDBClusterIdentifier:   coalesceString(cfg.TempCluster.DBClusterIdentifier, cfg.TempCluster.DBClusterIdentifierPrefix+"abcdefghij"),
+		RunID:                     "abcdefghij012345",
+		JobName:                   "job",
+	}
+	_, err := cfg.resourceNames(sample, flextime.Now())
+	return err
+}
+
+func (app *App) resourceNames(tempDBClusterIdentifier string) (*resourceNames, error) {
+	return app.cfg.resourceNames(nameTemplateData{
+		SourceDBClusterIdentifier: app.run.sourceDBClusterIdentifier,
+		TempDBClusterIdentifier:   tempDBClusterIdentifier,
+		RunID:                     app.run.id,
+		JobName:                   app.jobName,
+	}, flextime.Now())
+}
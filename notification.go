@@ -0,0 +1,284 @@
+package mascaras
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/eventbridge/eventbridgeiface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+)
+
+const (
+	NotificationEventStart   = "start"
+	NotificationEventSuccess = "success"
+	NotificationEventFailure = "failure"
+	NotificationEventStage   = "stage"
+)
+
+var defaultNotificationEvents = []string{
+	NotificationEventStart,
+	NotificationEventSuccess,
+	NotificationEventFailure,
+}
+
+const notificationTimeout = 30 * time.Second
+
+// Notification is the payload sent to notification sinks.
+type Notification struct {
+	Event                     string    `json:"event"`
+	RunID                     string    `json:"run_id"`
+	SourceDBClusterIdentifier string    `json:"source_db_cluster_identifier"`
+	TempDBClusterIdentifier   string    `json:"temp_db_cluster_identifier,omitempty"`
+	Stage                     string    `json:"stage,omitempty"`
+	SnapshotArn               string    `json:"snapshot_arn,omitempty"`
+	Error                     string    `json:"error,omitempty"`
+	Time                      time.Time `json:"time"`
+}
+
+func (n *Notification) summary() string {
+	switch n.Event {
+	case NotificationEventStart:
+		return fmt.Sprintf("mascaras run %s started: %s", n.RunID, n.SourceDBClusterIdentifier)
+	case NotificationEventSuccess:
+		return fmt.Sprintf("mascaras run %s succeeded: %s, snapshot %s", n.RunID, n.SourceDBClusterIdentifier, n.SnapshotArn)
+	case NotificationEventFailure:
+		return fmt.Sprintf("mascaras run %s failed at stage %s: %s, %s", n.RunID, n.Stage, n.SourceDBClusterIdentifier, n.Error)
+	}
+	return fmt.Sprintf("mascaras run %s stage %s: %s", n.RunID, n.Stage, n.SourceDBClusterIdentifier)
+}
+
+// subject is the short summary for SNS, without the error and the snapshot ARN which are in the message.
+// SNS subjects must be ASCII without line breaks, and less than 100 characters.
+func (n *Notification) subject() string {
+	subject := fmt.Sprintf("mascaras %s: %s", n.Event, n.SourceDBClusterIdentifier)
+	if n.Event == NotificationEventStage || n.Event == NotificationEventFailure {
+		subject = fmt.Sprintf("mascaras %s %s: %s", n.Event, n.Stage, n.SourceDBClusterIdentifier)
+	}
+	b := make([]byte, 0, len(subject))
+	for i := 0; i < len(subject) && len(b) < 99; i++ {
+		if c := subject[i]; c >= 0x20 && c < 0x7f {
+			b = append(b, c)
+		}
+	}
+	return string(b)
+}
+
+type notifier interface {
+	Notify(ctx context.Context, n *Notification) error
+}
+
+type notificationSink struct {
+	notifier
+	name   string
+	events map[string]bool
+}
+
+func newNotificationSinks(sess *session.Session, cfgs []NotificationConfig) ([]*notificationSink, error) {
+	sinks := make([]*notificationSink, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		var n notifier
+		switch cfg.Type {
+		case "webhook":
+			n = &webhookNotifier{url: cfg.URL, client: http.DefaultClient}
+		case "slack":
+			n = &slackNotifier{url: cfg.URL, client: http.DefaultClient}
+		case "sns":
+			n = &snsNotifier{svc: sns.New(sess), topicArn: cfg.TopicArn}
+		case "eventbridge":
+			n = &eventBridgeNotifier{
+				svc:          eventbridge.New(sess),
+				eventBusName: cfg.EventBusName,
+				source:       coalesceString(cfg.Source, "mascaras"),
+				detailType:   coalesceString(cfg.DetailType, "mascaras run"),
+			}
+		default:
+			return nil, fmt.Errorf("unknown notification type `%s`", cfg.Type)
+		}
+		events := cfg.Events
+		if len(events) == 0 {
+			events = defaultNotificationEvents
+		}
+		sink := &notificationSink{
+			notifier: n,
+			name:     cfg.Type,
+			events:   make(map[string]bool, len(events)),
+		}
+		for _, e := range events {
+			sink.events[e] = true
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// notify sends the event to all sinks subscribing it. Failures are logged and do not fail the run.
+func (app *App) notify(event string, stage string, report *Report) {
+	n := &Notification{
+		Event:                     event,
+		RunID:                     report.RunID,
+		SourceDBClusterIdentifier: report.SourceDBClusterIdentifier,
+		TempDBClusterIdentifier:   report.TempDBClusterIdentifier,
+		Stage:                     stage,
+		SnapshotArn:               report.SnapshotArn,
+		Error:                     report.Error,
+		Time:                      flextime.Now(),
+	}
+	for _, sink := range app.notificationSinks {
+		if !sink.events[event] {
+			continue
+		}
+		// the run context may be already canceled when notifying a failure.
+		ctx, cancel := context.WithTimeout(context.Background(), notificationTimeout)
+		if err := sink.Notify(ctx, n); err != nil {
+			app.logger.Printf("[warn] %s notification failed: %s\n", sink.name, err)
+		} else {
+			app.logger.Printf("[debug] %s notification sent: %s\n", sink.name, event)
+		}
+		cancel()
+	}
+}
+
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, notification *Notification) error {
+	return postJSON(ctx, n.client, n.url, notification)
+}
+
+type slackNotifier struct {
+	url    string
+	client *http.Client
+}
+
+type slackMessage struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments,omitempty"`
+}
+
+type slackAttachment struct {
+	Color  string       `json:"color"`
+	Fields []slackField `json:"fields"`
+}
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+func (n *slackNotifier) Notify(ctx context.Context, notification *Notification) error {
+	color := "#439FE0"
+	switch notification.Event {
+	case NotificationEventSuccess:
+		color = "good"
+	case NotificationEventFailure:
+		color = "danger"
+	}
+	fields := []slackField{
+		{Title: "run id", Value: notification.RunID, Short: true},
+		{Title: "source db cluster", Value: notification.SourceDBClusterIdentifier, Short: true},
+	}
+	if notification.Stage != "" {
+		fields = append(fields, slackField{Title: "stage", Value: notification.Stage, Short: true})
+	}
+	if notification.SnapshotArn != "" {
+		fields = append(fields, slackField{Title: "snapshot arn", Value: notification.SnapshotArn})
+	}
+	if notification.Error != "" {
+		fields = append(fields, slackField{Title: "error", Value: notification.Error})
+	}
+	return postJSON(ctx, n.client, n.url, &slackMessage{
+		Text: notification.summary(),
+		Attachments: []slackAttachment{
+			{Color: color, Fields: fields},
+		},
+	})
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("POST %s: unexpected status %s", url, resp.Status)
+	}
+	return nil
+}
+
+type snsNotifier struct {
+	svc      snsiface.SNSAPI
+	topicArn string
+}
+
+func (n *snsNotifier) Notify(ctx context.Context, notification *Notification) error {
+	bs, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	_, err = n.svc.PublishWithContext(ctx, &sns.PublishInput{
+		TopicArn: aws.String(n.topicArn),
+		Subject:  aws.String(notification.subject()),
+		Message:  aws.String(string(bs)),
+	})
+	return err
+}
+
+type eventBridgeNotifier struct {
+	svc          eventbridgeiface.EventBridgeAPI
+	eventBusName string
+	source       string
+	detailType   string
+}
+
+func (n *eventBridgeNotifier) Notify(ctx context.Context, notification *Notification) error {
+	bs, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	entry := &eventbridge.PutEventsRequestEntry{
+		Source:     aws.String(n.source),
+		DetailType: aws.String(n.detailType),
+		Detail:     aws.String(string(bs)),
+		Time:       aws.Time(notification.Time),
+	}
+	if n.eventBusName != "" {
+		entry.EventBusName = aws.String(n.eventBusName)
+	}
+	output, err := n.svc.PutEventsWithContext(ctx, &eventbridge.PutEventsInput{
+		Entries: []*eventbridge.PutEventsRequestEntry{entry},
+	})
+	if err != nil {
+		return err
+	}
+	if aws.Int64Value(output.FailedEntryCount) > 0 {
+		for _, e := range output.Entries {
+			if e.ErrorCode != nil {
+				return fmt.Errorf("PutEvents failed: %s %s", aws.StringValue(e.ErrorCode), aws.StringValue(e.ErrorMessage))
+			}
+		}
+		return fmt.Errorf("PutEvents failed")
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package mascaras
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	parallelSectionMarker   = "-- mascaras:parallel"
+	sequentialSectionMarker = "-- mascaras:sequential"
+
+	defaultSQLConcurrency = 4
+)
+
+// sqlBlock is a part of a SQL file. Sections of a parallel block are independent of each other,
+// and executed concurrently over separate connections.
+type sqlBlock struct {
+	parallel bool
+	sections []string
+}
+
+// splitSQLBlocks splits the SQL by marker comment lines.
+// "-- mascaras:parallel" starts a section executed in parallel with the adjacent sections,
+// and "-- mascaras:sequential" ends the parallel sections.
+func splitSQLBlocks(sql string) []sqlBlock {
+	if !strings.Contains(sql, parallelSectionMarker) {
+		return []sqlBlock{{sections: []string{sql}}}
+	}
+	var blocks []sqlBlock
+	var current strings.Builder
+	parallel := false
+	flush := func() {
+		if strings.TrimSpace(current.String()) == "" {
+			current.Reset()
+			return
+		}
+		if parallel && len(blocks) > 0 && blocks[len(blocks)-1].parallel {
+			last := &blocks[len(blocks)-1]
+			last.sections = append(last.sections, current.String())
+		} else {
+			blocks = append(blocks, sqlBlock{parallel: parallel, sections: []string{current.String()}})
+		}
+		current.Reset()
+	}
+	scanner := bufio.NewScanner(strings.NewReader(sql))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch strings.TrimSpace(line) {
+		case parallelSectionMarker:
+			flush()
+			if !parallel {
+				// a new parallel block is not merged with the preceding one.
+				blocks = append(blocks, sqlBlock{parallel: true})
+			}
+			parallel = true
+			continue
+		case sequentialSectionMarker:
+			flush()
+			parallel = false
+			continue
+		}
+		current.WriteString(line)
+		current.WriteString("\n")
+	}
+	flush()
+	// remove parallel blocks without sections, e.g. a marker at the end of the file.
+	filtered := blocks[:0]
+	for _, b := range blocks {
+		if len(b.sections) > 0 {
+			filtered = append(filtered, b)
+		}
+	}
+	return filtered
+}
+
+func (cfg *Config) sqlConcurrency() int {
+	if cfg.SQLConcurrency <= 0 {
+		return defaultSQLConcurrency
+	}
+	return cfg.SQLConcurrency
+}
+
+// executeParallel executes the sections over a pool of executers, at most sql_concurrency sections at a time.
+// The first error cancels the other sections.
+func (app *App) executeParallel(ctx context.Context, sections []string, sess *sqlSession) error {
+	workers := app.cfg.sqlConcurrency()
+	if workers > len(sections) {
+		workers = len(sections)
+	}
+	app.logger.Printf("[info] start %d parallel sections on %d connections\n", len(sections), workers)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	queue := make(chan int, len(sections))
+	for i := range sections {
+		queue <- i
+	}
+	close(queue)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+	for w := 0; w < workers; w++ {
+		executer, err := sess.open()
+		if err != nil {
+			fail(err)
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer executer.Close()
+			for i := range queue {
+				if ctx.Err() != nil {
+					return
+				}
+				err := app.executeSQLText(ctx, executer, sections[i], sess)
+				sess.result.executed(executer)
+				if err != nil {
+					fail(fmt.Errorf("parallel section %d: %w", i+1, err))
+					return
+				}
+				app.logger.Printf("[info] end parallel section %d/%d\n", i+1, len(sections))
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
@@ -0,0 +1,141 @@
+package mascaras
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/chzyer/readline"
+)
+
+var errPromptAbort = errors.New("prompt abort")
+
+var completer = readline.NewPrefixCompleter(
+	readline.PcItem("help",
+		readline.PcItem("abort"),
+		readline.PcItem("exit"),
+	),
+	readline.PcItem("abort"),
+	readline.PcItem("exit"),
+)
+
+// promptSession interprets prompt commands and SQL lines.
+// It is shared by the readline prompt and the remote console.
+type promptSession struct {
+	executer executer
+	out      io.Writer
+	buf      strings.Builder
+}
+
+func newPromptSession(executer executer, out io.Writer) *promptSession {
+	s := &promptSession{
+		executer: executer,
+		out:      out,
+	}
+	executer.SetTableSelectHook(func(_, table string) {
+		fmt.Fprintln(s.out, "\n"+table)
+	})
+	executer.SetExecuteHook(func(_ string, rowsAffected int64, lastInsertId int64) {
+		fmt.Fprintf(s.out, "\nQuery OK, %d rowsAffected\nLast insert id = %d\n", rowsAffected, lastInsertId)
+	})
+	return s
+}
+
+// Handle processes a line. If done is true, the prompt should be closed,
+// and err is errPromptAbort when the prompt was aborted.
+func (s *promptSession) Handle(ctx context.Context, line string) (done bool, err error) {
+	line = strings.TrimSpace(line)
+	switch {
+	case strings.HasPrefix(line, "help"):
+		fmt.Fprintln(s.out, "commands:")
+		fmt.Fprintln(s.out, "\tabort:\tExit prompt as abnormal. Does not create a snapshot")
+		fmt.Fprintln(s.out, "\texit:\tExit prompt as successful, continue creating Snapshot")
+		fmt.Fprintln(s.out, "")
+	case line == "abort":
+		fmt.Fprintln(s.out, "abort prompt.")
+		return true, errPromptAbort
+	case line == "exit":
+		fmt.Fprintln(s.out, "exit prompt.")
+		return true, nil
+	default:
+		s.buf.WriteString(line)
+		if strings.ContainsRune(line, ';') {
+			if err := s.executer.ExecuteContext(ctx, strings.NewReader(s.buf.String())); err != nil {
+				fmt.Fprintln(s.out, err)
+			}
+			s.buf.Reset()
+		}
+	}
+	return false, nil
+}
+
+func (app *App) executePrompt(ctx context.Context, executer executer, dbClusterIdentifier string) error {
+	if app.cfg.RemoteConsole.Listen != "" {
+		return app.executeRemoteConsole(ctx, executer, dbClusterIdentifier)
+	}
+	redactor, err := newHistoryRedactor(app.cfg.Prompt.HistoryRedactPatterns)
+	if err != nil {
+		return err
+	}
+	historyFile, err := app.cfg.Prompt.historyFile()
+	if err != nil {
+		return err
+	}
+	if historyFile != "" {
+		if err := prepareHistoryFile(historyFile, historyLimit); err != nil {
+			return fmt.Errorf("prepare history file: %w", err)
+		}
+		app.logger.Printf("[debug] prompt history file: %s\n", historyFile)
+	}
+	l, err := readline.NewEx(&readline.Config{
+		Prompt:                 fmt.Sprintf("aurora[%s]>", dbClusterIdentifier),
+		HistoryFile:            historyFile,
+		HistoryLimit:           historyLimit,
+		DisableAutoSaveHistory: true,
+		AutoComplete:           completer,
+		InterruptPrompt:        "^C",
+		EOFPrompt:              "exit",
+		Stdin:                  app.stdin,
+		Stderr:                 app.stderr,
+		HistorySearchFold:      true,
+	})
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	session := newPromptSession(executer, l.Stderr())
+	app.logger.Println("[info] ")
+	app.logger.Println("[info] Use the `exit` or` abort` command to escape from Prompt.")
+	app.logger.Println("[info] Enter `help` command for more information.")
+	app.logger.Println("[info] Note: `^C` behaves the same as the `abort` command.")
+	l.SetVimMode(false)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		line, err := l.Readline()
+		if err == readline.ErrInterrupt {
+			if len(line) == 0 {
+				fmt.Fprintln(l.Stderr(), err)
+				return nil
+			} else {
+				continue
+			}
+		} else if err == io.EOF {
+			return nil
+		}
+		line = strings.TrimSpace(line)
+		if line != "" {
+			if err := l.SaveHistory(redactor.Redact(line)); err != nil {
+				app.logger.Printf("[warn] save prompt history: %s\n", err)
+			}
+		}
+		if done, err := session.Handle(ctx, line); done {
+			return err
+		}
+	}
+}
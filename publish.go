@@ -0,0 +1,116 @@
+package mascaras
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+const publishTimeout = 30 * time.Second
+
+// SnapshotPublication is the payload written to publish sinks after the run succeeded,
+// so consumers can find the latest masked snapshot of the source cluster.
+type SnapshotPublication struct {
+	SourceDBClusterIdentifier string     `json:"source_db_cluster_identifier"`
+	SnapshotIdentifier        string     `json:"snapshot_identifier"`
+	SnapshotArn               string     `json:"snapshot_arn"`
+	RunID                     string     `json:"run_id"`
+	JobName                   string     `json:"job_name,omitempty"`
+	Engine                    string     `json:"engine,omitempty"`
+	MaskedTime                *time.Time `json:"masked_time,omitempty"`
+	ExportTaskIdentifier      string     `json:"export_task_identifier,omitempty"`
+	PublishedAt               time.Time  `json:"published_at"`
+}
+
+type publisher interface {
+	Publish(ctx context.Context, target string, body []byte) error
+}
+
+// publishSink publishes to the target, a name template of the SSM parameter or the location.
+type publishSink struct {
+	publisher
+	name   string
+	target string
+}
+
+func newPublishSinks(sess *session.Session, cfgs []PublishConfig) ([]*publishSink, error) {
+	sinks := make([]*publishSink, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		var p publisher
+		target := cfg.Location
+		switch cfg.Type {
+		case "ssm":
+			p = &ssmPublisher{svc: ssm.New(sess)}
+			target = cfg.Name
+		case "s3", "file":
+			p = locationPublisher{}
+		default:
+			return nil, fmt.Errorf("unknown publish type `%s`", cfg.Type)
+		}
+		sinks = append(sinks, &publishSink{publisher: p, name: cfg.Type, target: target})
+	}
+	return sinks, nil
+}
+
+// snapshotWaitRequired reports whether the run waits for the snapshot to be available after creating it.
+func (app *App) snapshotWaitRequired() bool {
+	return app.cfg.EnableExportTask || app.cfg.Snapshot.copyRequired() || len(app.publishSinks) > 0 || app.cfg.Target.enabled()
+}
+
+// publish writes the publication to all sinks. A failure fails the run, because consumers can't find the snapshot.
+func (app *App) publish(ctx context.Context, p *SnapshotPublication, tempDBClusterIdentifier string) error {
+	p.JobName = app.jobName
+	p.PublishedAt = flextime.Now()
+	bs, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	data := nameTemplateData{
+		SourceDBClusterIdentifier: p.SourceDBClusterIdentifier,
+		TempDBClusterIdentifier:   tempDBClusterIdentifier,
+		RunID:                     p.RunID,
+		JobName:                   p.JobName,
+	}
+	for _, sink := range app.publishSinks {
+		target, err := renderName(sink.name+" publish target", sink.target, data, p.PublishedAt)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+		err = sink.Publish(ctx, target, bs)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("publish to %s `%s`: %w", sink.name, target, err)
+		}
+		app.logger.Printf("[info] published snapshot %s to %s `%s`\n", p.SnapshotArn, sink.name, target)
+	}
+	return nil
+}
+
+type ssmPublisher struct {
+	svc ssmiface.SSMAPI
+}
+
+func (p *ssmPublisher) Publish(ctx context.Context, name string, body []byte) error {
+	_, err := p.svc.PutParameterWithContext(ctx, &ssm.PutParameterInput{
+		Name:      aws.String(name),
+		Type:      aws.String(ssm.ParameterTypeString),
+		Value:     aws.String(string(body)),
+		Overwrite: aws.Bool(true),
+	})
+	return err
+}
+
+// locationPublisher writes to a file path or s3:// URL.
+type locationPublisher struct{}
+
+func (locationPublisher) Publish(_ context.Context, location string, body []byte) error {
+	return writeLocation(location, body)
+}
@@ -0,0 +1,220 @@
+package mascaras
+
+import (
+	"context"
+	"crypto/subtle"
+	_ "embed"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//go:embed remote_console.html
+var remoteConsoleHTML []byte
+
+var errRemoteConsoleTimeout = errors.New("remote console timeout")
+
+// remoteConsole serves the prompt commands over WebSocket.
+// Only one operator can be connected at a time.
+type remoteConsole struct {
+	executer executer
+	token    string
+	logger   *log.Logger
+	upgrader websocket.Upgrader
+
+	mu        sync.Mutex
+	conn      *websocket.Conn
+	connected bool
+	closed    bool
+	handlers  sync.WaitGroup
+	done      chan error
+	closeOnce sync.Once
+}
+
+func (app *App) executeRemoteConsole(ctx context.Context, executer executer, dbClusterIdentifier string) error {
+	timeout, err := app.cfg.RemoteConsole.timeout()
+	if err != nil {
+		return err
+	}
+	c := &remoteConsole{
+		executer: executer,
+		token:    app.cfg.RemoteConsole.Token,
+		logger:   app.logger,
+		done:     make(chan error, 1),
+	}
+	listener, err := net.Listen("tcp", app.cfg.RemoteConsole.Listen)
+	if err != nil {
+		return fmt.Errorf("remote console listen: %w", err)
+	}
+	handlerCtx, cancelHandler := context.WithCancel(ctx)
+	defer cancelHandler()
+	server := &http.Server{
+		Handler: c.handler(handlerCtx, dbClusterIdentifier),
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			app.logger.Printf("[error] remote console server: %s\n", err)
+			c.finish(err)
+		}
+	}()
+	defer func() {
+		// Shutdown does not wait for hijacked connections, and the caller closes the executer after return,
+		// so cancel the running statement and wait for the handler of the operator.
+		cancelHandler()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			app.logger.Printf("[warn] remote console shutdown: %s\n", err)
+		}
+		c.close()
+	}()
+	app.logger.Printf("[info] remote console listening on http://%s/ (timeout %s)\n", listener.Addr(), timeout)
+	app.logger.Println("[info] Use the `exit` or `abort` command to close the remote console.")
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-c.done:
+		return err
+	case <-timer.C:
+		app.logger.Println("[warn] remote console timed out, abort.")
+		return errRemoteConsoleTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *remoteConsole) handler(ctx context.Context, dbClusterIdentifier string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(remoteConsoleHTML)
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		if !c.authorized(r) {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if !c.acquire() {
+			http.Error(w, "another operator is already connected", http.StatusConflict)
+			return
+		}
+		defer c.release()
+		conn, err := c.upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			c.logger.Printf("[warn] remote console upgrade: %s\n", err)
+			return
+		}
+		defer conn.Close()
+		if !c.setConn(conn) {
+			return
+		}
+		c.logger.Printf("[info] remote console connected from %s\n", r.RemoteAddr)
+		c.serve(ctx, conn, dbClusterIdentifier)
+		c.logger.Printf("[info] remote console disconnected from %s\n", r.RemoteAddr)
+	})
+	return mux
+}
+
+func (c *remoteConsole) serve(ctx context.Context, conn *websocket.Conn, dbClusterIdentifier string) {
+	out := &websocketWriter{conn: conn}
+	session := newPromptSession(c.executer, out)
+	fmt.Fprintf(out, "connected to aurora[%s]. Enter `help` command for more information.\n", dbClusterIdentifier)
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		for _, line := range strings.Split(string(message), "\n") {
+			// lines may contain real values of the unmasked database, so string literals are never logged.
+			c.logger.Printf("[debug] remote console> %s\n", redactStringLiterals(line))
+			if done, err := session.Handle(ctx, line); done {
+				c.finish(err)
+				return
+			}
+		}
+	}
+}
+
+func (c *remoteConsole) authorized(r *http.Request) bool {
+	return authorizedRequest(r, c.token)
+}
+
+// authorizedRequest checks the token given by `Authorization: Bearer` header or `token` query.
+func authorizedRequest(r *http.Request, token string) bool {
+	given := r.URL.Query().Get("token")
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		given = strings.TrimPrefix(h, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+func (c *remoteConsole) acquire() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.connected {
+		return false
+	}
+	c.connected = true
+	c.handlers.Add(1)
+	return true
+}
+
+// setConn returns false if the console was closed while upgrading.
+func (c *remoteConsole) setConn(conn *websocket.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.conn = conn
+	return true
+}
+
+func (c *remoteConsole) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn = nil
+	c.connected = false
+	c.handlers.Done()
+}
+
+// close rejects new operators, closes the connection of the current operator, if any,
+// and waits for its handler to return.
+func (c *remoteConsole) close() {
+	c.mu.Lock()
+	c.closed = true
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.mu.Unlock()
+	c.handlers.Wait()
+}
+
+func (c *remoteConsole) finish(err error) {
+	c.closeOnce.Do(func() {
+		c.done <- err
+	})
+}
+
+type websocketWriter struct {
+	conn *websocket.Conn
+}
+
+func (w *websocketWriter) Write(p []byte) (int, error) {
+	if err := w.conn.WriteMessage(websocket.TextMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,109 @@
+package mascaras
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	ReportStatusSucceeded = "succeeded"
+	ReportStatusFailed    = "failed"
+)
+
+// Report is the record of a run. It is returned by App.Run, and written to Config.ReportLocation if set.
+type Report struct {
+	RunID                      string              `json:"run_id"`
+	Status                     string              `json:"status"`
+	Error                      string              `json:"error,omitempty"`
+	FailedStage                string              `json:"failed_stage,omitempty"`
+	SourceDBClusterIdentifier  string              `json:"source_db_cluster_identifier"`
+	RestoreTime                *time.Time          `json:"restore_time,omitempty"`
+	TempDBClusterIdentifier    string              `json:"temp_db_cluster_identifier,omitempty"`
+	TempDBInstanceIdentifier   string              `json:"temp_db_instance_identifier,omitempty"`
+	Engine                     string              `json:"engine,omitempty"`
+	SQLFiles                   []SQLFileReport     `json:"sql_files,omitempty"`
+	Statements                 []StatementReport   `json:"statements,omitempty"`
+	MaskedTime                 *time.Time          `json:"masked_time,omitempty"`
+	SnapshotIdentifier         string              `json:"snapshot_identifier,omitempty"`
+	SnapshotArn                string              `json:"snapshot_arn,omitempty"`
+	OriginalSnapshotIdentifier string              `json:"original_snapshot_identifier,omitempty"`
+	OriginalSnapshotArn        string              `json:"original_snapshot_arn,omitempty"`
+	ExportTaskIdentifier       string              `json:"export_task_identifier,omitempty"`
+	TargetDBClusterIdentifier  string              `json:"target_db_cluster_identifier,omitempty"`
+	SubsetTables               []SubsetTableReport `json:"subset_tables,omitempty"`
+	DumpTables                 []DumpTableReport   `json:"dump_tables,omitempty"`
+	UnclassifiedColumns        []string            `json:"unclassified_columns,omitempty"`
+	Stages                     []StageReport       `json:"stages"`
+	StartedAt                  time.Time           `json:"started_at"`
+	FinishedAt                 time.Time           `json:"finished_at"`
+}
+
+type SQLFileReport struct {
+	Database string `json:"database,omitempty"`
+	Location string `json:"location"`
+	SHA256   string `json:"sha256"`
+}
+
+type StatementReport struct {
+	Database        string  `json:"database,omitempty"`
+	Query           string  `json:"query"`
+	RowsAffected    int64   `json:"rows_affected"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+type StageReport struct {
+	Name            string    `json:"name"`
+	StartedAt       time.Time `json:"started_at"`
+	FinishedAt      time.Time `json:"finished_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+}
+
+func newSQLFileReport(database, location, content string) SQLFileReport {
+	sum := sha256.Sum256([]byte(content))
+	return SQLFileReport{
+		Database: database,
+		Location: location,
+		SHA256:   hex.EncodeToString(sum[:]),
+	}
+}
+
+func sqlFileReports(targets []maskSQLTarget) []SQLFileReport {
+	var reports []SQLFileReport
+	for _, t := range targets {
+		for _, f := range t.Files {
+			reports = append(reports, newSQLFileReport(t.Database, f.Location, f.Content))
+		}
+	}
+	return reports
+}
+
+func (app *App) writeReport(report *Report) error {
+	loc := app.cfg.ReportLocation
+	if loc == "" {
+		return nil
+	}
+	if err := writeJSONLocation(loc, report); err != nil {
+		return err
+	}
+	if loc != "-" {
+		app.logger.Printf("[info] report written to %s\n", loc)
+	}
+	return nil
+}
+
+// writeJSONLocation writes v as indented JSON to loc. "-" means stdout.
+func writeJSONLocation(loc string, v interface{}) error {
+	bs, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if loc == "-" {
+		_, err := fmt.Fprintln(os.Stdout, string(bs))
+		return err
+	}
+	return writeLocation(loc, bs)
+}
@@ -0,0 +1,290 @@
+package mascaras
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	tagKeyRunID                     = "mascaras:run-id"
+	tagKeySourceDBClusterIdentifier = "mascaras:source-db-cluster-identifier"
+	tagKeyJob                       = "mascaras:job"
+)
+
+// JobStatus is the status of a job, returned by the HTTP API of `mascaras serve`.
+type JobStatus struct {
+	Name                      string     `json:"name"`
+	Schedule                  string     `json:"schedule,omitempty"`
+	SourceDBClusterIdentifier string     `json:"source_db_cluster_identifier,omitempty"`
+	Running                   bool       `json:"running"`
+	RunningSince              *time.Time `json:"running_since,omitempty"`
+	NextRun                   *time.Time `json:"next_run,omitempty"`
+	SkippedRuns               int        `json:"skipped_runs"`
+	LastRun                   *Report    `json:"last_run,omitempty"`
+}
+
+type job struct {
+	cfg     *JobConfig
+	entryID cron.EntryID
+
+	mu           sync.Mutex
+	running      bool
+	runningSince time.Time
+	skippedRuns  int
+	lastReport   *Report
+}
+
+// Server runs jobs on schedule, or all at once.
+type Server struct {
+	cfg    *JobsConfig
+	rdsSvc rdsiface.RDSAPI
+	newApp func(cfg *Config) (*App, error)
+	jobs   []*job
+	cron   *cron.Cron
+	logger *log.Logger
+	// startedAt is the time the server started. Clusters created after it belong to the runs of this server.
+	startedAt time.Time
+}
+
+func NewServer(cfg *JobsConfig, cfgs ...*aws.Config) (*Server, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	session, err := session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	rdsSvc := rds.New(session, cfgs...)
+	instrumentAWSClient(rdsSvc.Client)
+	return newServer(cfg, rdsSvc, func(c *Config) (*App, error) {
+		return New(c, cfgs...)
+	}), nil
+}
+
+func newServer(cfg *JobsConfig, rdsSvc rdsiface.RDSAPI, newApp func(cfg *Config) (*App, error)) *Server {
+	s := &Server{
+		cfg:       cfg,
+		rdsSvc:    rdsSvc,
+		newApp:    newApp,
+		cron:      cron.New(),
+		logger:    log.Default(),
+		startedAt: flextime.Now(),
+	}
+	for _, c := range cfg.Jobs {
+		s.jobs = append(s.jobs, &job{cfg: c})
+	}
+	return s
+}
+
+// Run cleans up orphans of the jobs, and runs the jobs on schedule until ctx is canceled.
+// Running jobs are canceled with ctx and cleaned up before returning.
+func (s *Server) Run(ctx context.Context) error {
+	for _, j := range s.jobs {
+		if j.cfg.Schedule == "" {
+			return fmt.Errorf("job `%s`: schedule is required", j.cfg.name())
+		}
+	}
+	if err := s.cleanupOrphans(ctx); err != nil {
+		return fmt.Errorf("cleanup orphans: %w", err)
+	}
+	for _, j := range s.jobs {
+		j := j
+		id, err := s.cron.AddFunc(j.cfg.Schedule, func() {
+			s.runJob(ctx, j)
+		})
+		if err != nil {
+			return err
+		}
+		j.entryID = id
+		s.logger.Printf("[info] job `%s` scheduled `%s`\n", j.cfg.name(), j.cfg.Schedule)
+	}
+	if s.cfg.Listen != "" {
+		listener, err := net.Listen("tcp", s.cfg.Listen)
+		if err != nil {
+			return fmt.Errorf("listen: %w", err)
+		}
+		server := &http.Server{Handler: s.handler()}
+		go func() {
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				s.logger.Printf("[error] status server: %s\n", err)
+			}
+		}()
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			server.Shutdown(shutdownCtx)
+		}()
+		s.logger.Printf("[info] status listening on http://%s/jobs\n", listener.Addr())
+	}
+	s.cron.Start()
+	<-ctx.Done()
+	s.logger.Println("[info] shutting down, waiting for running jobs...")
+	<-s.cron.Stop().Done()
+	return nil
+}
+
+// runJob runs the job, unless the previous run of the job is still running.
+func (s *Server) runJob(ctx context.Context, j *job) {
+	name := j.cfg.name()
+	j.mu.Lock()
+	if j.running {
+		j.skippedRuns++
+		j.mu.Unlock()
+		s.logger.Printf("[warn] job `%s` is still running since %s, skip\n", name, j.runningSince.Format(time.RFC3339))
+		return
+	}
+	j.running = true
+	j.runningSince = flextime.Now()
+	j.mu.Unlock()
+	defer func() {
+		j.mu.Lock()
+		j.running = false
+		j.mu.Unlock()
+	}()
+
+	report := s.runJobOnce(ctx, j)
+	j.mu.Lock()
+	j.lastReport = report
+	j.mu.Unlock()
+}
+
+// runJobOnce runs the job and returns the report. The report is failed if the run could not be started.
+func (s *Server) runJobOnce(ctx context.Context, j *job) *Report {
+	name := j.cfg.name()
+	s.logger.Printf("[info] job `%s` start\n", name)
+	startedAt := flextime.Now()
+	report, err := func() (*Report, error) {
+		cfg, err := j.cfg.loadConfig()
+		if err != nil {
+			return nil, err
+		}
+		app, err := s.newApp(cfg)
+		if err != nil {
+			return nil, err
+		}
+		app.jobName = name
+		return app.Run(ctx, cfg.SourceDBClusterIdentifier)
+	}()
+	if report == nil {
+		report = &Report{
+			SourceDBClusterIdentifier: j.cfg.SourceDBClusterIdentifier,
+			Status:                    ReportStatusFailed,
+			StartedAt:                 startedAt,
+			FinishedAt:                flextime.Now(),
+		}
+		if err != nil {
+			report.Error = err.Error()
+		}
+	}
+	if err != nil {
+		s.logger.Printf("[error] job `%s` failed: %s\n", name, err)
+	} else {
+		s.logger.Printf("[info] job `%s` succeeded\n", name)
+	}
+	return report
+}
+
+func (s *Server) jobStatus(j *job) *JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := &JobStatus{
+		Name:                      j.cfg.name(),
+		Schedule:                  j.cfg.Schedule,
+		SourceDBClusterIdentifier: j.cfg.SourceDBClusterIdentifier,
+		Running:                   j.running,
+		SkippedRuns:               j.skippedRuns,
+		LastRun:                   j.lastReport,
+	}
+	if j.running {
+		status.RunningSince = aws.Time(j.runningSince)
+	}
+	if j.entryID != 0 {
+		if next := s.cron.Entry(j.entryID).Next; !next.IsZero() {
+			status.NextRun = aws.Time(next)
+		}
+	}
+	return status
+}
+
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) {
+		statuses := make([]*JobStatus, 0, len(s.jobs))
+		for _, j := range s.jobs {
+			statuses = append(statuses, s.jobStatus(j))
+		}
+		writeJSON(w, statuses)
+	})
+	mux.HandleFunc("/jobs/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/jobs/")
+		for _, j := range s.jobs {
+			if j.cfg.name() == name {
+				writeJSON(w, s.jobStatus(j))
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// cleanupOrphans deletes temporary db clusters and instances left by previous runs of the jobs,
+// for example when the server was killed. They are identified by the mascaras:job tag, and created
+// before the server started, so clusters of the runs of this server are never deleted.
+// It assumes a single server instance runs the jobs; clusters of in-progress runs of another
+// server running the same jobs are deleted too.
+func (s *Server) cleanupOrphans(ctx context.Context) error {
+	names := make(map[string]bool, len(s.jobs))
+	for _, j := range s.jobs {
+		names[j.cfg.name()] = true
+	}
+	var orphans []*rds.DBCluster
+	err := s.rdsSvc.DescribeDBClustersPagesWithContext(ctx, &rds.DescribeDBClustersInput{}, func(output *rds.DescribeDBClustersOutput, _ bool) bool {
+		for _, c := range output.DBClusters {
+			if strings.ToLower(aws.StringValue(c.Status)) == "deleting" {
+				continue
+			}
+			if c.ClusterCreateTime == nil || !c.ClusterCreateTime.Before(s.startedAt) {
+				continue
+			}
+			if names[tagValue(c.TagList, tagKeyJob)] {
+				orphans = append(orphans, c)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	app := &App{rdsSvc: s.rdsSvc, logger: s.logger}
+	for _, c := range orphans {
+		s.logger.Printf("[info] orphan db cluster found: %s\n", aws.StringValue(c.DBClusterIdentifier))
+		if err := app.deleteDBClusterMembers(ctx, c); err != nil {
+			s.logger.Printf("[warn] cleanup orphan db cluster `%s` failed: %s\n", aws.StringValue(c.DBClusterIdentifier), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,778 @@
+package mascaras
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	StepRestore             = "restore"
+	StepCreateInstance      = "create_instance"
+	StepWaitAvailable       = "wait_available"
+	StepSubset              = "subset"
+	StepCheckClassification = "check_classification"
+	StepExecuteSQL          = "execute_sql"
+	StepScaleDown           = "scale_down"
+	StepApproval            = "approval"
+	StepDump                = "dump"
+	StepWaitRestorable      = "wait_restorable"
+	StepCreateSnapshot      = "create_snapshot"
+	StepCleanup             = "cleanup"
+	StepWaitSnapshot        = "wait_snapshot"
+	StepCopySnapshot        = "copy_snapshot"
+	StepWaitCopy            = "wait_snapshot_copy"
+	StepExportTask          = "export_task"
+	StepPublish             = "publish"
+	StepRestoreTarget       = "restore_target"
+	StepWaitTarget          = "wait_target"
+	StepSwapTarget          = "swap_target"
+	StepDeleteOldTarget     = "delete_old_target"
+	// StepAbort deletes the temporary db cluster and instance, and finishes the run.
+	// Use it as the fallback when a step failed.
+	StepAbort = "abort"
+)
+
+// State is the serializable state of a run executed step by step by App.Step.
+// Pass the returned state to the next App.Step invocation as is.
+type State struct {
+	RunID                      string     `json:"run_id,omitempty"`
+	Step                       string     `json:"step,omitempty"`
+	Wait                       bool       `json:"wait"`
+	Done                       bool       `json:"done"`
+	SourceDBClusterIdentifier  string     `json:"source_db_cluster_identifier,omitempty"`
+	TempDBClusterIdentifier    string     `json:"temp_db_cluster_identifier,omitempty"`
+	TempDBInstanceIdentifier   string     `json:"temp_db_instance_identifier,omitempty"`
+	Engine                     string     `json:"engine,omitempty"`
+	Endpoint                   string     `json:"endpoint,omitempty"`
+	Port                       int        `json:"port,omitempty"`
+	MaskedTime                 *time.Time `json:"masked_time,omitempty"`
+	SnapshotIdentifier         string     `json:"snapshot_identifier,omitempty"`
+	SnapshotArn                string     `json:"snapshot_arn,omitempty"`
+	OriginalSnapshotIdentifier string     `json:"original_snapshot_identifier,omitempty"`
+	TargetDBClusterResourceID  string     `json:"target_db_cluster_resource_id,omitempty"`
+	ExportTaskIdentifier       string     `json:"export_task_identifier,omitempty"`
+	DumpLocation               string     `json:"dump_location,omitempty"`
+	// SQLTarget and SQLFile are the position of the SQL file executed by the next execute_sql step.
+	SQLTarget       int   `json:"sql_target,omitempty"`
+	SQLFile         int   `json:"sql_file,omitempty"`
+	SQLRowsAffected int64 `json:"sql_rows_affected,omitempty"`
+	// ApprovalRequested is true after the approval summary is written.
+	ApprovalRequested bool `json:"approval_requested,omitempty"`
+}
+
+// createdSnapshotIdentifier returns the identifier of the snapshot created from the temporary cluster.
+// It is the original snapshot when the snapshot is copied to SnapshotIdentifier with another KMS key.
+func (state *State) createdSnapshotIdentifier() string {
+	return coalesceString(state.OriginalSnapshotIdentifier, state.SnapshotIdentifier)
+}
+
+// Step executes a step of the run and returns the state for the next step.
+// Each step starts an action or checks a status once, and is idempotent, so it can be retried.
+// If the returned state has Wait, the step is not completed yet and should be invoked again after a while.
+// If the returned state has Done, the run is finished.
+// An empty Step in the state means the first step (restore).
+func (app *App) Step(ctx context.Context, state *State) (next *State, err error) {
+	if state == nil {
+		state = &State{}
+	}
+	if app.cfg.Interactive {
+		return nil, errors.New("interactive mode is not supported in step execution")
+	}
+	next = &State{}
+	*next = *state
+	next.Wait = false
+	if next.Step == "" {
+		next.Step = StepRestore
+	}
+	if next.SourceDBClusterIdentifier == "" {
+		next.SourceDBClusterIdentifier = app.cfg.SourceDBClusterIdentifier
+	}
+	if next.SourceDBClusterIdentifier == "" {
+		return nil, errors.New("source db cluster is required")
+	}
+	if next.RunID == "" {
+		if next.RunID, err = randstr(16); err != nil {
+			return nil, err
+		}
+	}
+	now := flextime.Now()
+	run := &runInfo{
+		id:                        next.RunID,
+		startedAt:                 now,
+		stage:                     next.Step,
+		stages:                    []StageReport{{Name: next.Step, StartedAt: now}},
+		sourceDBClusterIdentifier: next.SourceDBClusterIdentifier,
+		tempDBClusterIdentifier:   next.TempDBClusterIdentifier,
+		tempDBInstanceIdentifier:  next.TempDBInstanceIdentifier,
+	}
+	app.run = run
+	app.logger = newRunLogger(run)
+	ctx, span := tracer().Start(ctx, "mascaras.Step", trace.WithAttributes(
+		attribute.String("mascaras.run_id", next.RunID),
+		attribute.String("mascaras.step", next.Step),
+		attribute.String("mascaras.source_db_cluster_identifier", next.SourceDBClusterIdentifier),
+	))
+	defer func() {
+		if err != nil {
+			run.setError(err)
+			app.logger.Printf("[error] failed at step %s: %s\n", state.Step, err)
+		}
+		endSpan(span, err)
+	}()
+	app.logger.Printf("[info] step %s run_id=%s\n", next.Step, next.RunID)
+
+	switch next.Step {
+	case StepRestore:
+		err = app.stepRestore(ctx, next)
+	case StepCreateInstance:
+		err = app.stepCreateInstance(ctx, next)
+	case StepWaitAvailable:
+		err = app.stepWaitAvailable(ctx, next)
+	case StepSubset:
+		err = app.stepSubset(ctx, next)
+	case StepCheckClassification:
+		err = app.stepCheckClassification(ctx, next)
+	case StepExecuteSQL:
+		err = app.stepExecuteSQL(ctx, next)
+	case StepScaleDown:
+		err = app.stepScaleDown(ctx, next)
+	case StepApproval:
+		err = app.stepApproval(ctx, next)
+	case StepDump:
+		err = app.stepDump(ctx, next)
+	case StepWaitRestorable:
+		err = app.stepWaitRestorable(ctx, next)
+	case StepCreateSnapshot:
+		err = app.stepCreateSnapshot(ctx, next)
+	case StepCleanup:
+		err = app.stepCleanup(ctx, next)
+	case StepWaitSnapshot:
+		err = app.stepWaitSnapshot(ctx, next)
+	case StepCopySnapshot:
+		err = app.stepCopySnapshot(ctx, next)
+	case StepWaitCopy:
+		err = app.stepWaitCopy(ctx, next)
+	case StepExportTask:
+		err = app.stepExportTask(ctx, next)
+	case StepPublish:
+		err = app.stepPublish(ctx, next)
+	case StepRestoreTarget:
+		err = app.stepRestoreTarget(ctx, next)
+	case StepWaitTarget:
+		err = app.stepWaitTarget(ctx, next)
+	case StepSwapTarget:
+		err = app.stepSwapTarget(ctx, next)
+	case StepDeleteOldTarget:
+		err = app.stepDeleteOldTarget(ctx, next)
+	case StepAbort:
+		err = app.stepAbort(ctx, next)
+	default:
+		err = fmt.Errorf("unknown step `%s`", next.Step)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if next.Wait {
+		app.logger.Printf("[info] step %s is not completed yet, wait\n", next.Step)
+	}
+	return next, nil
+}
+
+func isAWSErrorCode(err error, code string) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == code
+}
+
+func (app *App) stepRestore(ctx context.Context, state *State) error {
+	if state.TempDBClusterIdentifier == "" {
+		id, err := app.newTempDBClusterIdentifier()
+		if err != nil {
+			return err
+		}
+		state.TempDBClusterIdentifier = id
+		app.run.setTempDBClusterIdentifier(id)
+	}
+	if state.SnapshotIdentifier == "" {
+		// names are rendered once, so the following steps use the same names even if retried.
+		names, err := app.resourceNames(state.TempDBClusterIdentifier)
+		if err != nil {
+			return err
+		}
+		state.SnapshotIdentifier = names.SnapshotIdentifier
+		state.OriginalSnapshotIdentifier = names.OriginalSnapshotIdentifier
+		state.ExportTaskIdentifier = names.ExportTaskIdentifier
+		state.DumpLocation = names.DumpLocation
+	}
+	dbCluster, err := app.restoreDBCluster(ctx, state.SourceDBClusterIdentifier, state.TempDBClusterIdentifier, nil)
+	if isAWSErrorCode(err, rds.ErrCodeDBClusterAlreadyExistsFault) {
+		// restored by the previous attempt of this run if tagged with the run id, otherwise it is not ours.
+		dbCluster, _, err = app.checkDBClusterAvailable(ctx, state.TempDBClusterIdentifier)
+		if err == nil && tagValue(dbCluster.TagList, tagKeyRunID) != state.RunID {
+			err = fmt.Errorf("db cluster `%s` already exists and is not restored by run %s", state.TempDBClusterIdentifier, state.RunID)
+		}
+		if err == nil {
+			app.logger.Printf("[info] db cluster `%s` already exists\n", state.TempDBClusterIdentifier)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	app.logger.Printf("[info] cloned db cluster: %s\n", *dbCluster.DBClusterArn)
+	state.Engine = *dbCluster.Engine
+	state.Step = StepCreateInstance
+	return nil
+}
+
+func (app *App) stepCreateInstance(ctx context.Context, state *State) error {
+	state.TempDBInstanceIdentifier = tempDBInstanceIdentifierOf(state.TempDBClusterIdentifier)
+	app.run.setTempDBInstanceIdentifier(state.TempDBInstanceIdentifier)
+	dbInstance, err := app.createDBInstance(ctx, state.TempDBClusterIdentifier, state.TempDBInstanceIdentifier, state.Engine)
+	if isAWSErrorCode(err, rds.ErrCodeDBInstanceAlreadyExistsFault) {
+		app.logger.Printf("[info] db instance `%s` already exists\n", state.TempDBInstanceIdentifier)
+		state.Step = StepWaitAvailable
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	app.logger.Printf("[info] create db instance: %s\n", *dbInstance.DBInstanceArn)
+	state.Step = StepWaitAvailable
+	return nil
+}
+
+func (app *App) stepWaitAvailable(ctx context.Context, state *State) error {
+	dbCluster, available, err := app.checkDBClusterAvailable(ctx, state.TempDBClusterIdentifier)
+	if err != nil {
+		return err
+	}
+	app.logger.Printf("[info] db cluster status is %s\n", *dbCluster.Status)
+	if !available {
+		state.Wait = true
+		return nil
+	}
+	dbInstance, available, err := app.checkDBInstanceAvailable(ctx, state.TempDBInstanceIdentifier)
+	if err != nil {
+		return err
+	}
+	app.logger.Printf("[info] db instance status is %s\n", *dbInstance.DBInstanceStatus)
+	if !available {
+		state.Wait = true
+		return nil
+	}
+	endpoint, available, err := app.checkDBClusterEndpointAvailable(ctx, state.TempDBClusterIdentifier)
+	if err != nil {
+		return err
+	}
+	app.logger.Printf("[info] db cluster endpoint status is %s\n", *endpoint.Status)
+	if !available {
+		state.Wait = true
+		return nil
+	}
+	state.Endpoint = *endpoint.Endpoint
+	state.Port = int(*dbCluster.Port)
+	if app.cfg.Subset.enabled() {
+		state.Step = StepSubset
+		return nil
+	}
+	app.stepAfterSubset(state)
+	return nil
+}
+
+// stepSubset deletes rows out of the subset. If retried, the sampled root tables are sampled again.
+func (app *App) stepSubset(ctx context.Context, state *State) error {
+	_, subsetTime, err := app.subset(ctx, app.dbType(state.Engine), state.Endpoint, state.Port)
+	if err != nil {
+		return err
+	}
+	state.MaskedTime = &subsetTime
+	app.stepAfterSubset(state)
+	return nil
+}
+
+// stepAfterSubset checks the classification of columns if the classification file is set.
+func (app *App) stepAfterSubset(state *State) {
+	if app.cfg.ClassificationFile != "" {
+		state.Step = StepCheckClassification
+		return
+	}
+	app.stepAfterCheckClassification(state)
+}
+
+// stepCheckClassification fails if any column is not classified.
+func (app *App) stepCheckClassification(ctx context.Context, state *State) error {
+	c, err := readClassification(app.cfg.ClassificationFile)
+	if err != nil {
+		return err
+	}
+	if _, err := app.checkClassification(ctx, c, app.dbType(state.Engine), state.Endpoint, state.Port); err != nil {
+		return err
+	}
+	app.stepAfterCheckClassification(state)
+	return nil
+}
+
+// stepAfterCheckClassification executes SQL, or continues without masking.
+func (app *App) stepAfterCheckClassification(state *State) {
+	if len(app.cfg.maskSQLTargets()) > 0 {
+		state.Step = StepExecuteSQL
+		return
+	}
+	state.Step = app.stepAfterExecuteSQL(state)
+}
+
+// stepExecuteSQL executes a SQL file per invocation, so each invocation is bounded by the file, and a retry
+// executes the failed file again. Tables are dropped and truncated with the first file of the database.
+func (app *App) stepExecuteSQL(ctx context.Context, state *State) error {
+	targets := app.cfg.maskSQLTargets()
+	if state.SQLTarget >= len(targets) {
+		return fmt.Errorf("sql target %d is out of %d targets, the config has been changed", state.SQLTarget, len(targets))
+	}
+	if err := readMaskSQLTargets(targets); err != nil {
+		return err
+	}
+	target := targets[state.SQLTarget]
+	stepTarget := maskSQLTarget{
+		Database:            target.Database,
+		skipTableStatements: state.SQLFile > 0,
+	}
+	if state.SQLFile < len(target.Files) {
+		stepTarget.Files = target.Files[state.SQLFile : state.SQLFile+1]
+	} else if len(target.Files) > 0 {
+		return fmt.Errorf("sql file %d is out of %d files of database `%s`, the config has been changed", state.SQLFile, len(target.Files), target.Database)
+	}
+	result, err := app.executeSQL(ctx, app.dbType(state.Engine), []maskSQLTarget{stepTarget}, state.TempDBClusterIdentifier, state.Endpoint, state.Port)
+	if err != nil {
+		return err
+	}
+	state.MaskedTime = &result.LastExecuteTime
+	state.SQLRowsAffected += result.totalRowsAffected()
+	if state.SQLFile++; state.SQLFile >= len(target.Files) {
+		state.SQLTarget++
+		state.SQLFile = 0
+	}
+	if state.SQLTarget < len(targets) {
+		// execute the next file by the next invocation.
+		return nil
+	}
+	app.deleteChunkState()
+	state.Step = app.stepAfterExecuteSQL(state)
+	return nil
+}
+
+// stepAfterExecuteSQL returns the next step of execute_sql, or of the subset without SQL.
+func (app *App) stepAfterExecuteSQL(state *State) string {
+	switch {
+	case app.cfg.TempCluster.scaleDownRequired():
+		return StepScaleDown
+	case app.cfg.EnableApproval:
+		return StepApproval
+	}
+	return app.stepAfterApproval(state)
+}
+
+// stepAfterApproval returns the next step after masking, dump or waiting for the masked data to be restorable.
+func (app *App) stepAfterApproval(state *State) string {
+	if app.cfg.Dump.enabled() {
+		return StepDump
+	}
+	return stepAfterDump(state)
+}
+
+func stepAfterDump(state *State) string {
+	if state.MaskedTime == nil {
+		return StepCreateSnapshot
+	}
+	return StepWaitRestorable
+}
+
+func (app *App) stepScaleDown(ctx context.Context, state *State) error {
+	cfg := app.cfg.TempCluster
+	if cfg.capacityScaleDownRequired() {
+		dbCluster, modified, err := app.checkDBClusterCapacityModified(ctx, state.TempDBClusterIdentifier, cfg.MinCapacity, cfg.MaxCapacity)
+		if err != nil {
+			return err
+		}
+		if !modified {
+			if strings.ToLower(*dbCluster.Status) == "available" {
+				if err := app.modifyDBClusterCapacity(ctx, state.TempDBClusterIdentifier, cfg.MinCapacity, cfg.MaxCapacity); err != nil {
+					return err
+				}
+			}
+			app.logger.Printf("[info] db cluster status is %s\n", *dbCluster.Status)
+			state.Wait = true
+			return nil
+		}
+	}
+	if cfg.instanceScaleDownRequired() {
+		dbInstance, modified, err := app.checkDBInstanceModified(ctx, state.TempDBInstanceIdentifier, cfg.DBInstanceClass)
+		if err != nil {
+			return err
+		}
+		if !modified {
+			pending := dbInstance.PendingModifiedValues != nil && dbInstance.PendingModifiedValues.DBInstanceClass != nil
+			if !pending && aws.StringValue(dbInstance.DBInstanceClass) != cfg.DBInstanceClass && strings.ToLower(*dbInstance.DBInstanceStatus) == "available" {
+				if err := app.modifyDBInstanceClass(ctx, state.TempDBInstanceIdentifier, cfg.DBInstanceClass); err != nil {
+					return err
+				}
+			}
+			app.logger.Printf("[info] db instance status is %s\n", *dbInstance.DBInstanceStatus)
+			state.Wait = true
+			return nil
+		}
+	}
+	if app.cfg.EnableApproval {
+		state.Step = StepApproval
+	} else {
+		state.Step = app.stepAfterApproval(state)
+	}
+	return nil
+}
+
+// stepApproval writes the approval summary at the first invocation, and checks the approval signal.
+// Only approval.signal_location is supported in step execution.
+func (app *App) stepApproval(ctx context.Context, state *State) error {
+	loc := app.cfg.Approval.SignalLocation
+	if loc == "" {
+		return errors.New("approval-signal-location is required for approval in step execution")
+	}
+	if !state.ApprovalRequested {
+		if err := app.writeStepApprovalSummary(ctx, state); err != nil {
+			return err
+		}
+		state.ApprovalRequested = true
+	}
+	found, rejected, err := app.consumeApprovalSignal(loc, state.RunID)
+	if errors.Is(err, errApprovalSignalIgnored) {
+		app.logger.Printf("[warn] %s\n", err)
+	} else if err != nil {
+		return err
+	}
+	if !found {
+		app.logger.Printf("[info] waiting for approval signal at %s\n", loc)
+		state.Wait = true
+		return nil
+	}
+	if rejected {
+		return errApprovalRejected
+	}
+	app.logger.Println("[info] approved!")
+	state.Step = app.stepAfterApproval(state)
+	return nil
+}
+
+func (app *App) writeStepApprovalSummary(ctx context.Context, state *State) error {
+	targets := app.cfg.maskSQLTargets()
+	if err := readMaskSQLTargets(targets); err != nil {
+		return err
+	}
+	summary := &approvalSummary{
+		RunID:                     state.RunID,
+		SourceDBClusterIdentifier: state.SourceDBClusterIdentifier,
+		TempDBClusterIdentifier:   state.TempDBClusterIdentifier,
+		SQLFiles:                  sqlFileReports(targets),
+		TotalRowsAffected:         state.SQLRowsAffected,
+	}
+	if state.MaskedTime != nil {
+		summary.MaskedTime = *state.MaskedTime
+	}
+	if err := app.inspectMaskedData(ctx, summary, app.dbType(state.Engine), state.Endpoint, state.Port); err != nil {
+		return err
+	}
+	bs, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	app.logger.Printf("[info] approval summary:\n%s\n", string(bs))
+	if loc := app.cfg.Approval.SummaryLocation; loc != "" {
+		if err := writeLocation(loc, bs); err != nil {
+			return fmt.Errorf("write approval summary: %w", err)
+		}
+		app.logger.Printf("[info] approval summary written to %s\n", loc)
+	}
+	return nil
+}
+
+// stepDump dumps all tables in an invocation, so it must be completed within the timeout of the invocation.
+func (app *App) stepDump(ctx context.Context, state *State) error {
+	if _, err := app.dump(ctx, app.dbType(state.Engine), state.DumpLocation, state.Endpoint, state.Port); err != nil {
+		return err
+	}
+	if app.cfg.Dump.SkipSnapshot {
+		state.Step = StepCleanup
+		return nil
+	}
+	state.Step = stepAfterDump(state)
+	return nil
+}
+
+func (app *App) stepWaitRestorable(ctx context.Context, state *State) error {
+	if state.MaskedTime == nil {
+		return errors.New("masked time is unknown")
+	}
+	latestRestorableTime, restorable, err := app.checkDBClusterLatestRestorableTime(ctx, state.TempDBClusterIdentifier, *state.MaskedTime)
+	if err != nil {
+		return err
+	}
+	if !restorable {
+		if latestRestorableTime != nil {
+			app.logger.Printf("[info] now db cluster LatestRestorableTime=%s\n", latestRestorableTime.Format(time.RFC3339))
+		}
+		state.Wait = true
+		return nil
+	}
+	state.Step = StepCreateSnapshot
+	return nil
+}
+
+func (app *App) stepCreateSnapshot(ctx context.Context, state *State) error {
+	if state.SnapshotIdentifier == "" {
+		state.SnapshotIdentifier = snapshotIdentifierOf(state.TempDBClusterIdentifier)
+	}
+	if app.cfg.Snapshot.copyRequired() && state.OriginalSnapshotIdentifier == "" {
+		state.OriginalSnapshotIdentifier = originalSnapshotIdentifierOf(state.SnapshotIdentifier)
+	}
+	snapshotIdentifier := state.createdSnapshotIdentifier()
+	app.logger.Println("[info] create snapshot:", snapshotIdentifier)
+	snapshot, err := app.createDBClusterSnapshot(ctx, state.TempDBClusterIdentifier, snapshotIdentifier)
+	if isAWSErrorCode(err, rds.ErrCodeDBClusterSnapshotAlreadyExistsFault) {
+		// created by the previous attempt if it is a snapshot of the temporary cluster, otherwise it is not ours.
+		snapshot, _, err = app.checkDBClusterSnapshotAvailable(ctx, snapshotIdentifier)
+		if err == nil && aws.StringValue(snapshot.DBClusterIdentifier) != state.TempDBClusterIdentifier {
+			err = fmt.Errorf("db cluster snapshot `%s` already exists and is not a snapshot of `%s`", snapshotIdentifier, state.TempDBClusterIdentifier)
+		}
+		if err == nil {
+			app.logger.Printf("[info] db cluster snapshot `%s` already exists\n", snapshotIdentifier)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	app.logger.Println("[info] success arn =", *snapshot.DBClusterSnapshotArn)
+	state.SnapshotArn = *snapshot.DBClusterSnapshotArn
+	state.Step = StepCleanup
+	return nil
+}
+
+// cleanupIgnoreNotFound deletes the temporary db instance and cluster, ignoring already deleted ones.
+func (app *App) cleanupIgnoreNotFound(state *State) error {
+	if state.TempDBInstanceIdentifier != "" {
+		err := app.cleanup(&cleanupInfo{tempDBInstanceIdentifier: &state.TempDBInstanceIdentifier})
+		if err != nil && !isAWSErrorCode(err, rds.ErrCodeDBInstanceNotFoundFault) {
+			return err
+		}
+	}
+	if state.TempDBClusterIdentifier != "" {
+		err := app.cleanup(&cleanupInfo{tempDBClusterIdentifier: &state.TempDBClusterIdentifier})
+		if err != nil && !isAWSErrorCode(err, rds.ErrCodeDBClusterNotFoundFault) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (app *App) stepCleanup(ctx context.Context, state *State) error {
+	if err := app.cleanupIgnoreNotFound(state); err != nil {
+		return err
+	}
+	if !app.snapshotWaitRequired() {
+		app.logger.Println("[info] all finish.")
+		state.Done = true
+		return nil
+	}
+	state.Step = StepWaitSnapshot
+	return nil
+}
+
+func (app *App) stepWaitSnapshot(ctx context.Context, state *State) error {
+	snapshot, available, err := app.checkDBClusterSnapshotAvailable(ctx, state.createdSnapshotIdentifier())
+	if err != nil {
+		return err
+	}
+	app.logger.Printf("[info] db cluster snapshot status is %s progress=%d%%\n", *snapshot.Status, *snapshot.PercentProgress)
+	if !available {
+		state.Wait = true
+		return nil
+	}
+	if app.cfg.Snapshot.copyRequired() {
+		state.Step = StepCopySnapshot
+		return nil
+	}
+	app.stepAfterSnapshot(state)
+	return nil
+}
+
+// stepAfterSnapshot starts the export task, or publishes the snapshot.
+func (app *App) stepAfterSnapshot(state *State) {
+	if app.cfg.EnableExportTask {
+		state.Step = StepExportTask
+		return
+	}
+	app.stepAfterExportTask(state)
+}
+
+// stepAfterExportTask publishes the snapshot, or refreshes the target cluster.
+func (app *App) stepAfterExportTask(state *State) {
+	if len(app.publishSinks) > 0 {
+		state.Step = StepPublish
+		return
+	}
+	app.stepAfterPublish(state)
+}
+
+// stepAfterPublish refreshes the target cluster, or finishes the run.
+func (app *App) stepAfterPublish(state *State) {
+	if app.cfg.Target.enabled() {
+		state.Step = StepRestoreTarget
+		return
+	}
+	app.logger.Println("[info] all finish.")
+	state.Done = true
+}
+
+func (app *App) stepCopySnapshot(ctx context.Context, state *State) error {
+	copiedIdentifier := state.SnapshotIdentifier
+	snapshot, err := app.copyDBClusterSnapshot(ctx, state.OriginalSnapshotIdentifier, copiedIdentifier)
+	if isAWSErrorCode(err, rds.ErrCodeDBClusterSnapshotAlreadyExistsFault) {
+		app.logger.Printf("[info] db cluster snapshot `%s` already exists\n", copiedIdentifier)
+		snapshot, _, err = app.checkDBClusterSnapshotAvailable(ctx, copiedIdentifier)
+	}
+	if err != nil {
+		return err
+	}
+	state.SnapshotArn = *snapshot.DBClusterSnapshotArn
+	state.Step = StepWaitCopy
+	return nil
+}
+
+func (app *App) stepWaitCopy(ctx context.Context, state *State) error {
+	snapshot, available, err := app.checkDBClusterSnapshotAvailable(ctx, state.SnapshotIdentifier)
+	if err != nil {
+		return err
+	}
+	app.logger.Printf("[info] copied db cluster snapshot status is %s progress=%d%%\n", *snapshot.Status, *snapshot.PercentProgress)
+	if !available {
+		state.Wait = true
+		return nil
+	}
+	if app.cfg.Snapshot.DeleteOriginal {
+		err := app.deleteDBClusterSnapshot(ctx, state.OriginalSnapshotIdentifier)
+		if isAWSErrorCode(err, rds.ErrCodeDBClusterSnapshotNotFoundFault) {
+			app.logger.Printf("[info] db cluster snapshot `%s` already deleted\n", state.OriginalSnapshotIdentifier)
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	app.stepAfterSnapshot(state)
+	return nil
+}
+
+func (app *App) stepExportTask(ctx context.Context, state *State) error {
+	state.ExportTaskIdentifier = exportTaskIdentifierOf(state.ExportTaskIdentifier, state.SnapshotIdentifier)
+	err := app.startExportTask(ctx, state.ExportTaskIdentifier, state.SnapshotArn)
+	if isAWSErrorCode(err, rds.ErrCodeExportTaskAlreadyExistsFault) {
+		app.logger.Printf("[info] export task `%s` already exists\n", state.ExportTaskIdentifier)
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	app.stepAfterExportTask(state)
+	return nil
+}
+
+func (app *App) stepPublish(ctx context.Context, state *State) error {
+	p := &SnapshotPublication{
+		SourceDBClusterIdentifier: state.SourceDBClusterIdentifier,
+		SnapshotIdentifier:        state.SnapshotIdentifier,
+		SnapshotArn:               state.SnapshotArn,
+		RunID:                     state.RunID,
+		Engine:                    state.Engine,
+		MaskedTime:                state.MaskedTime,
+	}
+	if app.cfg.EnableExportTask {
+		p.ExportTaskIdentifier = state.ExportTaskIdentifier
+	}
+	if err := app.publish(ctx, p, state.TempDBClusterIdentifier); err != nil {
+		return err
+	}
+	app.stepAfterPublish(state)
+	return nil
+}
+
+func (app *App) targetClusterNames(state *State) *targetClusterNames {
+	names := targetClusterNamesOf(app.cfg.Target.DBClusterIdentifier, state.RunID)
+	names.GreenResourceID = state.TargetDBClusterResourceID
+	return names
+}
+
+func (app *App) stepRestoreTarget(ctx context.Context, state *State) error {
+	names := app.targetClusterNames(state)
+	if err := app.restoreTargetCluster(ctx, names, state.SnapshotIdentifier, state.Engine); err != nil {
+		return err
+	}
+	state.TargetDBClusterResourceID = names.GreenResourceID
+	state.Step = StepWaitTarget
+	return nil
+}
+
+func (app *App) stepWaitTarget(ctx context.Context, state *State) error {
+	available, err := app.checkTargetClusterAvailable(ctx, app.targetClusterNames(state))
+	if err != nil {
+		return err
+	}
+	if !available {
+		state.Wait = true
+		return nil
+	}
+	state.Step = StepSwapTarget
+	return nil
+}
+
+func (app *App) stepSwapTarget(ctx context.Context, state *State) error {
+	swapped, err := app.swapTargetCluster(ctx, app.targetClusterNames(state))
+	if err != nil {
+		return err
+	}
+	if !swapped {
+		state.Wait = true
+		return nil
+	}
+	state.Step = StepDeleteOldTarget
+	return nil
+}
+
+func (app *App) stepDeleteOldTarget(ctx context.Context, state *State) error {
+	if err := app.deleteDBClusterWithInstances(ctx, app.targetClusterNames(state).Old); err != nil {
+		return err
+	}
+	app.logger.Println("[info] all finish.")
+	state.Done = true
+	return nil
+}
+
+func (app *App) stepAbort(ctx context.Context, state *State) error {
+	if err := app.cleanupIgnoreNotFound(state); err != nil {
+		return err
+	}
+	if app.cfg.Target.enabled() {
+		if err := app.cleanupTargetGreen(ctx, app.targetClusterNames(state)); err != nil {
+			return err
+		}
+	}
+	app.logger.Println("[info] aborted.")
+	state.Done = true
+	return nil
+}
@@ -0,0 +1,247 @@
+package mascaras
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Songmu/flextime"
+)
+
+// foreignKey is a foreign key of Table referencing RefTable.
+type foreignKey struct {
+	Name       string
+	Table      string
+	Columns    []string
+	RefTable   string
+	RefColumns []string
+}
+
+// subsetExecuter is implemented by executers which can delete rows out of the subset.
+type subsetExecuter interface {
+	foreignKeys(ctx context.Context) ([]foreignKey, error)
+	// withoutForeignKeyChecks calls fn with exec on a connection where foreign key checks are disabled.
+	withoutForeignKeyChecks(ctx context.Context, fn func(exec func(query string) (int64, error)) error) error
+	now(ctx context.Context) (time.Time, error)
+}
+
+// SubsetTableReport is the number of rows deleted from a table by the subset.
+type SubsetTableReport struct {
+	Database    string `json:"database,omitempty"`
+	Table       string `json:"table"`
+	RowsDeleted int64  `json:"rows_deleted"`
+}
+
+func (cfg *SubsetConfig) enabled() bool {
+	return len(cfg.Roots) > 0
+}
+
+func (cfg *SubsetConfig) Validate() error {
+	tables := make(map[string]bool, len(cfg.Roots))
+	for i, root := range cfg.Roots {
+		if root.Table == "" {
+			return fmt.Errorf("subset.roots[%d]: table is required", i)
+		}
+		if tables[root.Table] {
+			return fmt.Errorf("subset.roots[%d]: table `%s` is duplicated", i, root.Table)
+		}
+		tables[root.Table] = true
+		if root.Where == "" && root.Percent == 0 {
+			return fmt.Errorf("subset.roots[%d]: where or percent is required", i)
+		}
+		if root.Percent < 0 || root.Percent > 100 {
+			return fmt.Errorf("subset.roots[%d]: percent must be between 0 and 100, got %g", i, root.Percent)
+		}
+	}
+	return nil
+}
+
+// subsetRootQuery returns DELETE of rows of the root table out of the filters.
+// Rows which Where evaluates to NULL are deleted.
+func subsetRootQuery(dbtype string, root SubsetRootConfig) string {
+	var conds []string
+	if root.Where != "" {
+		conds = append(conds, fmt.Sprintf("NOT COALESCE((%s), FALSE)", root.Where))
+	}
+	if root.Percent > 0 {
+		random := "RAND()"
+		if dbtype == "postgresql" {
+			random = "random()"
+		}
+		conds = append(conds, fmt.Sprintf("%s * 100 >= %g", random, root.Percent))
+	}
+	return fmt.Sprintf("DELETE FROM %s WHERE %s", quoteIdentifier(dbtype, root.Table), strings.Join(conds, " OR "))
+}
+
+// subsetOrphanQuery returns DELETE of rows referencing deleted rows by the foreign key.
+// Rows with NULL in the foreign key columns reference nothing, as MATCH SIMPLE.
+func subsetOrphanQuery(dbtype string, fk foreignKey) string {
+	column := func(alias, name string) string {
+		return alias + "." + quoteIdentifier(dbtype, name)
+	}
+	notNull := make([]string, len(fk.Columns))
+	join := make([]string, len(fk.Columns))
+	for i, c := range fk.Columns {
+		notNull[i] = column("c", c) + " IS NOT NULL"
+		join[i] = column("p", fk.RefColumns[i]) + " = " + column("c", c)
+	}
+	table := quoteIdentifier(dbtype, fk.Table)
+	refTable := quoteIdentifier(dbtype, fk.RefTable)
+	if dbtype == "postgresql" {
+		return fmt.Sprintf("DELETE FROM %s AS c WHERE %s AND NOT EXISTS (SELECT 1 FROM %s AS p WHERE %s)",
+			table, strings.Join(notNull, " AND "), refTable, strings.Join(join, " AND "))
+	}
+	// MySQL can't select the deleted table in a subquery, so self-referencing foreign keys are joined.
+	return fmt.Sprintf("DELETE c FROM %s AS c LEFT JOIN %s AS p ON %s WHERE %s AND %s IS NULL",
+		table, refTable, strings.Join(join, " AND "), strings.Join(notNull, " AND "), column("p", fk.RefColumns[0]))
+}
+
+// subset deletes rows out of the subset on the temporary cluster, and returns the time after deleted.
+// Rows of the root tables are deleted by the filters, then rows referencing deleted rows are deleted
+// by following foreign keys until no rows are deleted.
+func (app *App) subset(ctx context.Context, dbtype, host string, port int) ([]SubsetTableReport, time.Time, error) {
+	database := coalesceString(app.cfg.Subset.Database, app.cfg.Database)
+	e, err := app.newExecuter(app.cfg, dbtype, database, host, port)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer e.Close()
+	se, ok := e.(subsetExecuter)
+	if !ok {
+		return nil, time.Time{}, errors.New("subset is not supported by the executer")
+	}
+	fks, err := se.foreignKeys(ctx)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("foreign keys of database `%s`: %w", database, err)
+	}
+	referencing := make(map[string][]foreignKey)
+	for _, fk := range fks {
+		referencing[fk.RefTable] = append(referencing[fk.RefTable], fk)
+	}
+	app.logger.Printf("[info] subset database `%s`, %d foreign keys\n", database, len(fks))
+
+	var reports []SubsetTableReport
+	deleted := func(table string, n int64) {
+		for i := range reports {
+			if reports[i].Table == table {
+				reports[i].RowsDeleted += n
+				return
+			}
+		}
+		reports = append(reports, SubsetTableReport{Database: database, Table: table, RowsDeleted: n})
+	}
+	err = se.withoutForeignKeyChecks(ctx, func(exec func(string) (int64, error)) error {
+		execQuery := func(query string) (int64, error) {
+			startedAt := flextime.Now()
+			n, err := exec(query)
+			if err == nil {
+				traceSQLStatement(ctx, dbtype, query, n, startedAt, flextime.Now())
+			}
+			return n, err
+		}
+		var queue []string
+		for _, root := range app.cfg.Subset.Roots {
+			n, err := execQuery(subsetRootQuery(dbtype, root))
+			if err != nil {
+				return fmt.Errorf("subset root table `%s`: %w", root.Table, err)
+			}
+			app.logger.Printf("[info] subset: deleted %d rows of root table `%s`\n", n, root.Table)
+			deleted(root.Table, n)
+			if n > 0 {
+				queue = append(queue, root.Table)
+			}
+		}
+		for len(queue) > 0 {
+			table := queue[0]
+			queue = queue[1:]
+			for _, fk := range referencing[table] {
+				n, err := execQuery(subsetOrphanQuery(dbtype, fk))
+				if err != nil {
+					return fmt.Errorf("subset table `%s` by foreign key %s: %w", fk.Table, fk.Name, err)
+				}
+				if n == 0 {
+					continue
+				}
+				app.logger.Printf("[info] subset: deleted %d rows of table `%s` referencing deleted rows of `%s` by %s\n", n, fk.Table, fk.RefTable, fk.Name)
+				deleted(fk.Table, n)
+				queue = append(queue, fk.Table)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return reports, time.Time{}, err
+	}
+	now, err := se.now(ctx)
+	return reports, now, err
+}
+
+func (e *dbExecuter) foreignKeys(ctx context.Context) ([]foreignKey, error) {
+	query := `SELECT constraint_name, table_name, column_name, referenced_table_name, referenced_column_name
+FROM information_schema.key_column_usage
+WHERE table_schema = DATABASE() AND referenced_table_schema = DATABASE() AND referenced_table_name IS NOT NULL
+ORDER BY table_name, constraint_name, ordinal_position`
+	if e.dbtype == "postgresql" {
+		query = `SELECT c.conname, cl.relname, a.attname, rcl.relname, ra.attname
+FROM pg_catalog.pg_constraint c
+JOIN pg_catalog.pg_class cl ON cl.oid = c.conrelid
+JOIN pg_catalog.pg_class rcl ON rcl.oid = c.confrelid
+CROSS JOIN LATERAL unnest(c.conkey, c.confkey) WITH ORDINALITY AS k(attnum, refattnum, n)
+JOIN pg_catalog.pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = k.attnum
+JOIN pg_catalog.pg_attribute ra ON ra.attrelid = c.confrelid AND ra.attnum = k.refattnum
+WHERE c.contype = 'f' AND cl.relnamespace = current_schema()::regnamespace AND rcl.relnamespace = cl.relnamespace
+ORDER BY cl.relname, c.conname, k.n`
+	}
+	rows, err := e.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var fks []foreignKey
+	for rows.Next() {
+		var name, table, column, refTable, refColumn string
+		if err := rows.Scan(&name, &table, &column, &refTable, &refColumn); err != nil {
+			return nil, err
+		}
+		if n := len(fks); n > 0 && fks[n-1].Name == name && fks[n-1].Table == table {
+			fks[n-1].Columns = append(fks[n-1].Columns, column)
+			fks[n-1].RefColumns = append(fks[n-1].RefColumns, refColumn)
+			continue
+		}
+		fks = append(fks, foreignKey{
+			Name:       name,
+			Table:      table,
+			Columns:    []string{column},
+			RefTable:   refTable,
+			RefColumns: []string{refColumn},
+		})
+	}
+	return fks, rows.Err()
+}
+
+// withoutForeignKeyChecks disables foreign key checks of the session. For PostgreSQL, it requires rds_superuser
+// to set session_replication_role.
+func (e *dbExecuter) withoutForeignKeyChecks(ctx context.Context, fn func(exec func(query string) (int64, error)) error) error {
+	conn, err := e.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	disable, enable := "SET FOREIGN_KEY_CHECKS = 0", "SET FOREIGN_KEY_CHECKS = 1"
+	if e.dbtype == "postgresql" {
+		disable, enable = "SET session_replication_role = replica", "SET session_replication_role = DEFAULT"
+	}
+	if _, err := conn.ExecContext(ctx, disable); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, enable)
+	return fn(func(query string) (int64, error) {
+		result, err := conn.ExecContext(ctx, query)
+		if err != nil {
+			return 0, err
+		}
+		return result.RowsAffected()
+	})
+}
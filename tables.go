@@ -0,0 +1,149 @@
+package mascaras
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// tableLister is implemented by executers which can list tables of the database.
+type tableLister interface {
+	tables(ctx context.Context) ([]string, error)
+}
+
+func (e *dbExecuter) tables(ctx context.Context) ([]string, error) {
+	query := "SELECT table_name FROM information_schema.tables WHERE table_schema = DATABASE() AND table_type = 'BASE TABLE' ORDER BY table_name"
+	if e.dbtype == "postgresql" {
+		query = "SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema() AND table_type = 'BASE TABLE' ORDER BY table_name"
+	}
+	rows, err := e.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, rows.Err()
+}
+
+// tableStatementsRequired reports whether tables are truncated or dropped before executing SQL files.
+func (cfg *Config) tableStatementsRequired() bool {
+	return len(cfg.TruncateTables) > 0 || len(cfg.DropTables) > 0
+}
+
+func validateTablePatterns(name string, patterns []string) error {
+	for _, p := range patterns {
+		if p == "" {
+			return fmt.Errorf("%s: empty pattern", name)
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("%s: pattern `%s`: %w", name, p, err)
+		}
+	}
+	return nil
+}
+
+// matchTables returns tables matching any of the glob patterns, and patterns matching no tables.
+func matchTables(tables, patterns []string) (matched []string, unmatched []string) {
+	used := make(map[string]bool, len(patterns))
+	for _, table := range tables {
+		for _, p := range patterns {
+			// patterns are validated, so Match never fails.
+			if ok, _ := path.Match(p, table); ok {
+				matched = append(matched, table)
+				used[p] = true
+				break
+			}
+		}
+	}
+	for _, p := range patterns {
+		if !used[p] {
+			unmatched = append(unmatched, p)
+		}
+	}
+	return matched, unmatched
+}
+
+// tableStatements returns SQL to drop and truncate tables. For MySQL, foreign key checks are disabled while
+// truncating, because TRUNCATE fails on tables referenced by foreign keys. For PostgreSQL, tables are truncated
+// in a statement, so tables referencing each other can be truncated together.
+func tableStatements(dbtype string, drop, truncate []string) string {
+	quote := func(tables []string) []string {
+		quoted := make([]string, len(tables))
+		for i, t := range tables {
+			quoted[i] = quoteIdentifier(dbtype, t)
+		}
+		return quoted
+	}
+	var b strings.Builder
+	if dbtype == "postgresql" {
+		if len(drop) > 0 {
+			fmt.Fprintf(&b, "DROP TABLE IF EXISTS %s CASCADE;\n", strings.Join(quote(drop), ", "))
+		}
+		if len(truncate) > 0 {
+			fmt.Fprintf(&b, "TRUNCATE TABLE %s;\n", strings.Join(quote(truncate), ", "))
+		}
+		return b.String()
+	}
+	b.WriteString("SET FOREIGN_KEY_CHECKS = 0;\n")
+	if len(drop) > 0 {
+		fmt.Fprintf(&b, "DROP TABLE IF EXISTS %s;\n", strings.Join(quote(drop), ", "))
+	}
+	for _, t := range quote(truncate) {
+		fmt.Fprintf(&b, "TRUNCATE TABLE %s;\n", t)
+	}
+	b.WriteString("SET FOREIGN_KEY_CHECKS = 1;\n")
+	return b.String()
+}
+
+// executeTableStatements drops and truncates tables matching drop_tables and truncate_tables, expanded against
+// tables of the database. A table matching both is dropped.
+func (app *App) executeTableStatements(ctx context.Context, e executer, sess *sqlSession) error {
+	if !app.cfg.tableStatementsRequired() {
+		return nil
+	}
+	tl, ok := e.(tableLister)
+	if !ok {
+		return errors.New("truncate_tables and drop_tables are not supported by the executer")
+	}
+	tables, err := tl.tables(ctx)
+	if err != nil {
+		return fmt.Errorf("tables of database `%s`: %w", sess.database, err)
+	}
+	drop, unmatched := matchTables(tables, app.cfg.DropTables)
+	for _, p := range unmatched {
+		app.logger.Printf("[warn] drop_tables pattern `%s` matches no tables of database `%s`\n", p, sess.database)
+	}
+	dropped := make(map[string]bool, len(drop))
+	for _, t := range drop {
+		dropped[t] = true
+	}
+	var truncate []string
+	matched, unmatched := matchTables(tables, app.cfg.TruncateTables)
+	for _, t := range matched {
+		if !dropped[t] {
+			truncate = append(truncate, t)
+		}
+	}
+	for _, p := range unmatched {
+		app.logger.Printf("[warn] truncate_tables pattern `%s` matches no tables of database `%s`\n", p, sess.database)
+	}
+	if len(drop) == 0 && len(truncate) == 0 {
+		return nil
+	}
+	if len(drop) > 0 {
+		app.logger.Printf("[info] drop tables of database `%s`: %s\n", sess.database, strings.Join(drop, ", "))
+	}
+	if len(truncate) > 0 {
+		app.logger.Printf("[info] truncate tables of database `%s`: %s\n", sess.database, strings.Join(truncate, ", "))
+	}
+	return e.ExecuteContext(ctx, strings.NewReader(tableStatements(sess.dbtype, drop, truncate)))
+}
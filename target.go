@@ -0,0 +1,280 @@
+package mascaras
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rds"
+)
+
+const (
+	maxDBClusterIdentifierLength = 63
+	targetSuffixLength           = 8
+)
+
+// targetClusterNames are the names of clusters while refreshing the target cluster, blue/green style.
+// The green cluster is restored from the masked snapshot, and renamed to the target after the old one is renamed.
+type targetClusterNames struct {
+	Target string
+	Green  string
+	Old    string
+	// GreenResourceID identifies the green cluster across renames.
+	GreenResourceID string
+}
+
+func targetClusterNamesOf(target, runID string) *targetClusterNames {
+	suffix := strings.ToLower(runID)
+	if len(suffix) > targetSuffixLength {
+		suffix = suffix[:targetSuffixLength]
+	}
+	return &targetClusterNames{
+		Target: target,
+		Green:  target + "-" + suffix,
+		Old:    target + "-old-" + suffix,
+	}
+}
+
+func (cfg *TargetClusterConfig) enabled() bool {
+	return cfg.DBClusterIdentifier != ""
+}
+
+func (cfg *TargetClusterConfig) Validate() error {
+	if !cfg.enabled() {
+		return nil
+	}
+	if cfg.DBInstanceClass == "" {
+		return errors.New("target-db-instance-class is required if target-db-cluster-identifier is set")
+	}
+	// the name of the old cluster, <target>-old-<suffix>, must be a valid identifier.
+	maxLength := maxDBClusterIdentifierLength - len("-old-") - targetSuffixLength
+	return validateRDSIdentifier("target db cluster identifier", cfg.DBClusterIdentifier, maxLength)
+}
+
+func (cfg *TargetClusterConfig) securityGroupIDs() []string {
+	if cfg.SecurityGroupIDs == "" {
+		return nil
+	}
+	return strings.Split(cfg.SecurityGroupIDs, ",")
+}
+
+// restoreTargetCluster restores the green cluster from the snapshot, and creates the instance of it.
+// Already existing ones are reused, to retry.
+func (app *App) restoreTargetCluster(ctx context.Context, names *targetClusterNames, snapshotIdentifier, engine string) error {
+	cfg := app.cfg.Target
+	// without the engine version, the cluster is restored with the default version of the engine.
+	snapshot, _, err := app.checkDBClusterSnapshotAvailable(ctx, snapshotIdentifier)
+	if err != nil {
+		return err
+	}
+	app.logger.Printf("[info] restore target db cluster `%s` from snapshot `%s` (engine version %s)\n", names.Green, snapshotIdentifier, aws.StringValue(snapshot.EngineVersion))
+	output, err := app.rdsSvc.RestoreDBClusterFromSnapshotWithContext(ctx, &rds.RestoreDBClusterFromSnapshotInput{
+		DBClusterIdentifier:         &names.Green,
+		SnapshotIdentifier:          &snapshotIdentifier,
+		Engine:                      &engine,
+		EngineVersion:               snapshot.EngineVersion,
+		VpcSecurityGroupIds:         aws.StringSlice(cfg.securityGroupIDs()),
+		DBSubnetGroupName:           stringOrNil(cfg.DBSubnetGroupName),
+		DBClusterParameterGroupName: stringOrNil(cfg.DBClusterParameterGroupName),
+	})
+	var dbCluster *rds.DBCluster
+	switch {
+	case isAWSErrorCode(err, rds.ErrCodeDBClusterAlreadyExistsFault):
+		app.logger.Printf("[info] db cluster `%s` already exists\n", names.Green)
+		dbCluster, _, err = app.checkDBClusterAvailable(ctx, names.Green)
+	case err == nil:
+		dbCluster = output.DBCluster
+	}
+	if err != nil {
+		return fmt.Errorf("RestoreDBClusterFromSnapshot:%w", err)
+	}
+	names.GreenResourceID = aws.StringValue(dbCluster.DbClusterResourceId)
+
+	instanceIdentifier := tempDBInstanceIdentifierOf(names.Green)
+	_, err = app.rdsSvc.CreateDBInstanceWithContext(ctx, &rds.CreateDBInstanceInput{
+		DBClusterIdentifier:  &names.Green,
+		DBInstanceIdentifier: &instanceIdentifier,
+		DBInstanceClass:      &cfg.DBInstanceClass,
+		Engine:               &engine,
+		DBParameterGroupName: stringOrNil(cfg.DBParameterGroupName),
+	})
+	if isAWSErrorCode(err, rds.ErrCodeDBInstanceAlreadyExistsFault) {
+		app.logger.Printf("[info] db instance `%s` already exists\n", instanceIdentifier)
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	app.logger.Printf("[info] create target db instance: %s\n", instanceIdentifier)
+	return nil
+}
+
+// checkTargetClusterAvailable reports whether the green cluster and the instance are available.
+func (app *App) checkTargetClusterAvailable(ctx context.Context, names *targetClusterNames) (bool, error) {
+	dbCluster, available, err := app.checkDBClusterAvailable(ctx, names.Green)
+	if err != nil {
+		return false, err
+	}
+	if !available {
+		app.logger.Printf("[info] now target db cluster status is %s ...\n", *dbCluster.Status)
+		return false, nil
+	}
+	dbInstance, available, err := app.checkDBInstanceAvailable(ctx, tempDBInstanceIdentifierOf(names.Green))
+	if err != nil {
+		return false, err
+	}
+	if !available {
+		app.logger.Printf("[info] now target db instance status is %s ...\n", *dbInstance.DBInstanceStatus)
+	}
+	return available, nil
+}
+
+// describeDBClusterIfExists returns nil if the cluster does not exist.
+func (app *App) describeDBClusterIfExists(ctx context.Context, dbClusterIdentifier string) (*rds.DBCluster, error) {
+	output, err := app.rdsSvc.DescribeDBClustersWithContext(ctx, &rds.DescribeDBClustersInput{
+		DBClusterIdentifier: &dbClusterIdentifier,
+	})
+	if isAWSErrorCode(err, rds.ErrCodeDBClusterNotFoundFault) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(output.DBClusters) == 0 {
+		return nil, nil
+	}
+	return output.DBClusters[0], nil
+}
+
+func (app *App) renameDBCluster(ctx context.Context, dbClusterIdentifier, newDBClusterIdentifier string, deletionProtection bool) error {
+	app.logger.Printf("[info] rename db cluster `%s` to `%s`\n", dbClusterIdentifier, newDBClusterIdentifier)
+	_, err := app.rdsSvc.ModifyDBClusterWithContext(ctx, &rds.ModifyDBClusterInput{
+		DBClusterIdentifier:    &dbClusterIdentifier,
+		NewDBClusterIdentifier: &newDBClusterIdentifier,
+		DeletionProtection:     aws.Bool(deletionProtection),
+		ApplyImmediately:       aws.Bool(true),
+	})
+	return err
+}
+
+// swapTargetCluster advances the swap by a rename at most, and reports whether the green cluster is
+// available as the target. The old target is renamed first, then the green cluster is renamed to the target.
+// It is idempotent, to be called repeatedly until swapped.
+func (app *App) swapTargetCluster(ctx context.Context, names *targetClusterNames) (bool, error) {
+	if names.GreenResourceID == "" {
+		return false, fmt.Errorf("resource id of the target db cluster `%s` is unknown", names.Green)
+	}
+	target, err := app.describeDBClusterIfExists(ctx, names.Target)
+	if err != nil {
+		return false, err
+	}
+	if target != nil {
+		available := strings.ToLower(aws.StringValue(target.Status)) == "available"
+		if aws.StringValue(target.DbClusterResourceId) == names.GreenResourceID {
+			if !available {
+				app.logger.Printf("[info] now target db cluster status is %s ...\n", aws.StringValue(target.Status))
+			}
+			return available, nil
+		}
+		if !available {
+			app.logger.Printf("[info] now old target db cluster status is %s ...\n", aws.StringValue(target.Status))
+			return false, nil
+		}
+		// deletion protection is disabled to delete the old one after swapped.
+		return false, app.renameDBCluster(ctx, names.Target, names.Old, false)
+	}
+	green, err := app.describeDBClusterIfExists(ctx, names.Green)
+	if err != nil {
+		return false, err
+	}
+	if green == nil || strings.ToLower(aws.StringValue(green.Status)) != "available" {
+		// the green cluster may be renaming.
+		app.logger.Printf("[info] wait target db cluster `%s` renamed ...\n", names.Target)
+		return false, nil
+	}
+	return false, app.renameDBCluster(ctx, names.Green, names.Target, app.cfg.Target.DeletionProtection)
+}
+
+func (app *App) waitTargetClusterSwapped(ctx context.Context, names *targetClusterNames) (err error) {
+	app.logger.Printf("[info] swap target db cluster `%s` with `%s`...\n", names.Target, names.Green)
+	ctx, span, status := startWaitSpan(ctx, "target_db_cluster_swap", names.Target)
+	defer func() { endSpan(span, err) }()
+	act := func() bool {
+		var swapped bool
+		swapped, err = app.swapTargetCluster(ctx, names)
+		if err != nil {
+			return true
+		}
+		if swapped {
+			status.record("swapped")
+			app.logger.Printf("[info] target db cluster `%s` swapped!\n", names.Target)
+		}
+		return swapped
+	}
+	if waitErr := app.wait(ctx, "target_db_cluster_swap", 10*time.Minute, act); waitErr != nil {
+		return waitErr
+	}
+	return err
+}
+
+// deleteDBClusterWithInstances deletes the cluster and the member instances without the final snapshot.
+// It does nothing if the cluster does not exist.
+func (app *App) deleteDBClusterWithInstances(ctx context.Context, dbClusterIdentifier string) error {
+	dbCluster, err := app.describeDBClusterIfExists(ctx, dbClusterIdentifier)
+	if err != nil || dbCluster == nil {
+		return err
+	}
+	if strings.ToLower(aws.StringValue(dbCluster.Status)) == "deleting" {
+		return nil
+	}
+	return app.deleteDBClusterMembers(ctx, dbCluster)
+}
+
+// deleteDBClusterMembers deletes all member instances of the described cluster, and the cluster.
+func (app *App) deleteDBClusterMembers(ctx context.Context, dbCluster *rds.DBCluster) error {
+	for _, m := range dbCluster.DBClusterMembers {
+		_, err := app.rdsSvc.DeleteDBInstanceWithContext(ctx, &rds.DeleteDBInstanceInput{
+			DBInstanceIdentifier: m.DBInstanceIdentifier,
+			SkipFinalSnapshot:    aws.Bool(true),
+		})
+		if err != nil && !isAWSErrorCode(err, rds.ErrCodeDBInstanceNotFoundFault) {
+			return err
+		}
+		app.logger.Printf("[info] delete db instance: %s\n", aws.StringValue(m.DBInstanceIdentifier))
+	}
+	_, err := app.rdsSvc.DeleteDBClusterWithContext(ctx, &rds.DeleteDBClusterInput{
+		DBClusterIdentifier: dbCluster.DBClusterIdentifier,
+		SkipFinalSnapshot:   aws.Bool(true),
+	})
+	if err != nil {
+		return err
+	}
+	app.logger.Printf("[info] delete db cluster: %s\n", aws.StringValue(dbCluster.DBClusterIdentifier))
+	return nil
+}
+
+// cleanupTargetGreen deletes the green cluster of a failed refresh. After the swap started, the green cluster
+// is kept, because it may be the only copy of the target.
+func (app *App) cleanupTargetGreen(ctx context.Context, names *targetClusterNames) error {
+	old, err := app.describeDBClusterIfExists(ctx, names.Old)
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		app.logger.Printf("[warn] target db cluster swap was started, keep `%s` and `%s`\n", names.Green, names.Old)
+		return nil
+	}
+	return app.deleteDBClusterWithInstances(ctx, names.Green)
+}
+
+// cleanupTargetGreenOnError cleans up the green cluster after the run failed. The run context may be already canceled.
+func (app *App) cleanupTargetGreenOnError(names *targetClusterNames) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := app.cleanupTargetGreen(ctx, names); err != nil {
+		app.logger.Printf("[error] cleanup target db cluster `%s` failed: %s\n", names.Green, err)
+	}
+}
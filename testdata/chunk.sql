@@ -0,0 +1,5 @@
+SET SESSION sql_log_bin = 0;
+-- mascaras:chunk table=users size=10
+UPDATE users SET name = md5(name)
+  WHERE id BETWEEN :chunk_start AND :chunk_end;
+UPDATE config SET value = '';
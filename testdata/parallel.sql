@@ -0,0 +1,9 @@
+SET SESSION foreign_key_checks = 0;
+-- mascaras:parallel
+UPDATE users SET name = md5(name);
+-- mascaras:parallel
+UPDATE orders SET address = md5(address);
+-- mascaras:parallel
+UPDATE payments SET card_number = NULL;
+-- mascaras:sequential
+DELETE FROM sessions;
@@ -0,0 +1,155 @@
+package mascaras
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/kayac/mascaras"
+
+func tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// SetupTracing installs the global tracer provider exporting spans via OTLP/HTTP,
+// if OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set.
+// The exporter is configured by the standard OTEL_EXPORTER_OTLP_* env vars.
+// The returned function flushes and shuts down the provider.
+func SetupTracing(ctx context.Context, version string) (func(context.Context) error, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the default attributes.
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			semconv.ServiceNameKey.String("mascaras"),
+			semconv.ServiceVersionKey.String(version),
+		),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// FlushTracing exports the buffered spans of the tracer provider installed by SetupTracing.
+func FlushTracing(ctx context.Context) error {
+	if tp, ok := otel.GetTracerProvider().(*sdktrace.TracerProvider); ok {
+		return tp.ForceFlush(ctx)
+	}
+	return nil
+}
+
+// endSpan records err to the span and ends it.
+func endSpan(span trace.Span, err error, options ...trace.SpanEndOption) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End(options...)
+}
+
+// statusRecorder adds a span event when the polled status changes.
+type statusRecorder struct {
+	span trace.Span
+	last string
+}
+
+func (r *statusRecorder) record(status string) {
+	if status == r.last {
+		return
+	}
+	r.span.AddEvent("status", trace.WithAttributes(
+		attribute.String("mascaras.status.from", r.last),
+		attribute.String("mascaras.status.to", status),
+	))
+	r.last = status
+}
+
+// startWaitSpan starts the span of a wait* function.
+func startWaitSpan(ctx context.Context, target, identifier string) (context.Context, trace.Span, *statusRecorder) {
+	ctx, span := tracer().Start(ctx, "wait "+target, trace.WithAttributes(
+		attribute.String("mascaras.wait.target", target),
+		attribute.String("mascaras.wait.identifier", identifier),
+	))
+	return ctx, span, &statusRecorder{span: span}
+}
+
+// traceSQLStatement records an executed statement as a span, after the execution.
+func traceSQLStatement(ctx context.Context, dbtype, query string, rowsAffected int64, startedAt, finishedAt time.Time) {
+	attrs := []attribute.KeyValue{
+		semconv.DBSystemKey.String(dbtype),
+		semconv.DBStatementKey.String(query),
+	}
+	if rowsAffected >= 0 {
+		attrs = append(attrs, attribute.Int64("db.rows_affected", rowsAffected))
+	}
+	_, span := tracer().Start(ctx, "sql",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithTimestamp(startedAt),
+		trace.WithAttributes(attrs...),
+	)
+	span.End(trace.WithTimestamp(finishedAt))
+}
+
+type awsSpanKey struct{}
+
+// instrumentAWSClient adds request handlers to trace each AWS API call as a span.
+func instrumentAWSClient(c *client.Client) {
+	c.Handlers.Build.PushFrontNamed(request.NamedHandler{
+		Name: "mascaras.tracing.start",
+		Fn: func(r *request.Request) {
+			ctx, span := tracer().Start(r.Context(), c.ServiceName+"."+r.Operation.Name,
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(
+					semconv.RPCSystemKey.String("aws-api"),
+					semconv.RPCServiceKey.String(c.ServiceName),
+					semconv.RPCMethodKey.String(r.Operation.Name),
+				),
+			)
+			r.SetContext(context.WithValue(ctx, awsSpanKey{}, span))
+		},
+	})
+	c.Handlers.Complete.PushBackNamed(request.NamedHandler{
+		Name: "mascaras.tracing.end",
+		Fn: func(r *request.Request) {
+			// the request may be completed without building, e.g. on a validation error.
+			span, ok := r.Context().Value(awsSpanKey{}).(trace.Span)
+			if !ok {
+				return
+			}
+			span.SetAttributes(
+				attribute.String("aws.request_id", r.RequestID),
+				attribute.Int("aws.retry_count", r.RetryCount),
+			)
+			if r.HTTPResponse != nil {
+				span.SetAttributes(semconv.HTTPStatusCodeKey.Int(r.HTTPResponse.StatusCode))
+			}
+			endSpan(span, r.Error)
+		},
+	})
+}